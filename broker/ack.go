@@ -0,0 +1,450 @@
+package broker
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+	"github.com/sirupsen/logrus"
+)
+
+type (
+	// The AckRequest type is the body of a request acknowledging messages written
+	// to a client that uses acknowledgements.
+	AckRequest struct {
+		IDs []string `json:"ids"`
+	}
+
+	// The AckResponse type is the body of a response to an AckRequest. It contains
+	// the number of messages that were waiting to be acknowledged.
+	AckResponse struct {
+		Acknowledged int `json:"acknowledged"`
+	}
+
+	// The HandoverResponse type is the body of a response to a request from another
+	// node for the messages a client that reconnected to it didn't acknowledge.
+	HandoverResponse struct {
+		Messages []Message `json:"messages"`
+	}
+
+	// The inflight type holds the messages written to a client that uses
+	// acknowledgements until it acknowledges them. It outlives the client's
+	// connection, so that unacknowledged messages can be redelivered when the
+	// client reconnects. Messages beyond the client's window are held until
+	// acknowledgements make room for them, rather than waiting in the client's
+	// buffer, so that a client that is slow to acknowledge never holds up writes
+	// to the other clients of its channels.
+	inflight struct {
+		mux     sync.Mutex
+		window  int
+		limit   int
+		pending []Message
+		held    []Message
+		out     chan Message
+		expiry  *time.Timer
+	}
+)
+
+const (
+	// DefaultAckWindow is the number of unacknowledged messages a client can have
+	// before no more are written to it when no window is specified.
+	DefaultAckWindow = 100
+
+	// DefaultAckRetention is how long the unacknowledged messages of a client that
+	// disconnected are kept for it to reconnect when no retention is specified.
+	DefaultAckRetention = time.Minute * 10
+)
+
+// WithAcks makes the client use acknowledgements. Messages written to it are held
+// by the broker until it acknowledges them and are redelivered if it reconnects,
+// and the broker's acknowledgement window limits how many can be outstanding.
+func WithAcks() ClientOption {
+	return func(c *Client) {
+		c.acks = true
+	}
+}
+
+// WithAckWindow sets the number of unacknowledged messages a client that uses
+// acknowledgements can have before further messages are held back from it, and how
+// long the unacknowledged messages of a client that disconnected are kept for it
+// to reconnect.
+func WithAckWindow(window int, retention time.Duration) Option {
+	return func(b *Broker) {
+		b.ackWindow = window
+		b.ackRetention = retention
+	}
+}
+
+// Ack acknowledges the messages with the given identifiers published to a channel
+// for a client that uses acknowledgements, returning the number acknowledged. If
+// the client is connected to another node, the acknowledgements are sent to it.
+// Returns ErrClientNotFound if no node holds messages for the client.
+func (b *Broker) Ack(channelID, clientID string, ids []string) (int, error) {
+	if b.locations != nil {
+		if node, ok := b.locations.lookup(clientID); ok && node != b.memberlist.LocalNode().Name {
+			if member := b.member(node); member != nil {
+				return b.sendAck(member, channelID, clientID, ids)
+			}
+		}
+	}
+
+	b.mux.Lock()
+	in, ok := b.inflight[clientID]
+	b.mux.Unlock()
+
+	if !ok {
+		return 0, ErrClientNotFound
+	}
+
+	return in.ack(channelID, ids), nil
+}
+
+// sendAck sends an HTTP POST request to the acknowledgement endpoint of the node a
+// client is connected to.
+func (b *Broker) sendAck(member *memberlist.Node, channelID, clientID string, ids []string) (int, error) {
+	url := fmt.Sprintf("http://%s:%s/channel/%s/client/%s/ack", member.Addr, member.Meta, channelID, clientID)
+
+	data, _ := json.Marshal(AckRequest{IDs: ids})
+	resp, err := b.http.Post(url, "application/json", bytes.NewBuffer(data))
+
+	if err != nil {
+		return 0, err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return 0, ErrClientNotFound
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		data, _ := ioutil.ReadAll(resp.Body)
+		return 0, fmt.Errorf(string(data))
+	}
+
+	var res AckResponse
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return 0, err
+	}
+
+	return res.Acknowledged, nil
+}
+
+// Handover removes and returns the messages a client that uses acknowledgements
+// didn't acknowledge before it disconnected from this node, so that the node it
+// reconnected to can redeliver them. Nothing is returned while the client is
+// still connected to this node.
+func (b *Broker) Handover(clientID string) []Message {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	in, ok := b.inflight[clientID]
+
+	if !ok {
+		return nil
+	}
+
+	in.mux.Lock()
+	defer in.mux.Unlock()
+
+	if in.out != nil {
+		return nil
+	}
+
+	if in.expiry != nil {
+		in.expiry.Stop()
+	}
+
+	delete(b.inflight, clientID)
+
+	return append(in.pending, in.held...)
+}
+
+// takeover asks every other node in the cluster, in parallel and each within the
+// broker's status timeout, for the messages a client that uses acknowledgements
+// didn't acknowledge before it disconnected from them, and adds them to those
+// held for the client by this node.
+func (b *Broker) takeover(cl *Client) {
+	var mux sync.Mutex
+	var wg sync.WaitGroup
+	var msgs []Message
+
+	for _, member := range b.memberlist.Members() {
+		if member.Name == b.memberlist.LocalNode().Name {
+			continue
+		}
+
+		wg.Add(1)
+		go func(member *memberlist.Node) {
+			defer wg.Done()
+
+			remote, err := b.sendHandover(member, cl.id)
+
+			if err != nil {
+				b.log.WithFields(logrus.Fields{
+					"targetNodeId": member.Name,
+					"client":       cl.id,
+				}).WithError(err).Error("failed to get unacknowledged messages from node")
+
+				return
+			}
+
+			mux.Lock()
+			msgs = append(msgs, remote...)
+			mux.Unlock()
+		}(member)
+	}
+
+	wg.Wait()
+
+	for _, msg := range msgs {
+		cl.inflight.track(msg)
+	}
+}
+
+// sendHandover sends an HTTP POST request to the handover endpoint of another node,
+// returning the messages it held for the client.
+func (b *Broker) sendHandover(member *memberlist.Node, clientID string) ([]Message, error) {
+	ctx := context.Background()
+	if b.statusTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, b.statusTimeout)
+		defer cancel()
+	}
+
+	u := fmt.Sprintf("http://%s:%s/client/%s/handover", member.Addr, member.Meta, url.PathEscape(clientID))
+	req, err := http.NewRequest(http.MethodPost, u, nil)
+
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := b.http.Do(req.WithContext(ctx))
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		data, _ := ioutil.ReadAll(resp.Body)
+		return nil, fmt.Errorf(string(data))
+	}
+
+	var res HandoverResponse
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return nil, err
+	}
+
+	return res.Messages, nil
+}
+
+// attachInflight gives a client that uses acknowledgements the messages it didn't
+// acknowledge before it last disconnected, if they are still held. Messages that
+// were held beyond its window are written to its buffer if there is now room for
+// them. Must be called with the broker's lock held, before the client is added to
+// any channel.
+func (b *Broker) attachInflight(cl *Client) {
+	in, ok := b.inflight[cl.id]
+
+	if !ok {
+		in = &inflight{window: b.ackWindow}
+		b.inflight[cl.id] = in
+	}
+
+	in.mux.Lock()
+	if in.expiry != nil {
+		in.expiry.Stop()
+		in.expiry = nil
+	}
+
+	in.out = cl.messages
+	in.limit = cap(cl.messages)
+	in.fill()
+	in.mux.Unlock()
+
+	cl.inflight = in
+}
+
+// detachInflight keeps the unacknowledged messages of a client that disconnected
+// for the broker's retention, in case it reconnects. Must be called with the
+// broker's lock held.
+func (b *Broker) detachInflight(clientID string) {
+	in, ok := b.inflight[clientID]
+
+	if !ok {
+		return
+	}
+
+	in.mux.Lock()
+	defer in.mux.Unlock()
+
+	in.out = nil
+
+	if in.expiry != nil {
+		in.expiry.Stop()
+	}
+
+	in.expiry = time.AfterFunc(b.ackRetention, func() {
+		b.mux.Lock()
+		defer b.mux.Unlock()
+
+		if b.inflight[clientID] == in {
+			delete(b.inflight, clientID)
+		}
+	})
+}
+
+// write queues a message for the client. It is recorded as soon as it is queued,
+// so that it is redelivered if the client disconnects before it is written to the
+// stream. Messages beyond the window are held until acknowledgements make room for
+// them, and once as many are held as the client's buffer can hold, its overflow
+// policy applies. A client that uses acknowledgements is never waited on, so the
+// OverflowBlock policy disconnects it like OverflowDisconnect. Returns false if a
+// message was dropped as a result.
+func (in *inflight) write(c *Client, msg Message) bool {
+	in.mux.Lock()
+	defer in.mux.Unlock()
+
+	// Messages already waiting to be acknowledged, such as those replayed on
+	// reconnection, are only written once.
+	if in.tracked(msg) {
+		return true
+	}
+
+	ok := true
+	if len(in.held) >= in.limit {
+		switch c.policy {
+		case OverflowDropNewest:
+			return false
+		case OverflowDropOldest:
+			in.held = in.held[1:]
+			ok = false
+		default:
+			c.Close()
+			return false
+		}
+	}
+
+	in.held = append(in.held, msg)
+	in.fill()
+
+	return ok
+}
+
+// fill moves held messages into the client's buffer while its window and buffer
+// have room for them. Must be called with the lock held.
+func (in *inflight) fill() {
+	for len(in.held) > 0 && in.out != nil && (in.window <= 0 || len(in.pending) < in.window) {
+		select {
+		case in.out <- in.held[0]:
+			in.pending = append(in.pending, in.held[0])
+			in.held = in.held[1:]
+		default:
+			return
+		}
+	}
+}
+
+// tracked returns true if the message is already waiting to be acknowledged. Must
+// be called with the lock held.
+func (in *inflight) tracked(msg Message) bool {
+	if msg.ID == "" {
+		return false
+	}
+
+	for _, msgs := range [][]Message{in.pending, in.held} {
+		for _, m := range msgs {
+			if m.Channel == msg.Channel && m.ID == msg.ID {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// track records a message as written to the client outside of its buffer.
+func (in *inflight) track(msg Message) {
+	in.mux.Lock()
+	defer in.mux.Unlock()
+
+	if !in.tracked(msg) {
+		in.pending = append(in.pending, msg)
+	}
+}
+
+// untrack removes a message that will never be written to the client.
+func (in *inflight) untrack(msg Message) {
+	in.mux.Lock()
+	defer in.mux.Unlock()
+
+	for i, m := range in.pending {
+		if m.Channel == msg.Channel && m.ID == msg.ID {
+			in.pending = append(in.pending[:i], in.pending[i+1:]...)
+			break
+		}
+	}
+
+	in.fill()
+}
+
+// ack removes acknowledged messages, returning the number removed. Held messages
+// are written to the client's buffer if the window now has room for them.
+func (in *inflight) ack(channelID string, ids []string) int {
+	acked := make(map[string]bool)
+	for _, id := range ids {
+		acked[id] = true
+	}
+
+	in.mux.Lock()
+	defer in.mux.Unlock()
+
+	n := 0
+	for _, msgs := range []*[]Message{&in.pending, &in.held} {
+		remaining := (*msgs)[:0]
+		for _, msg := range *msgs {
+			if msg.Channel == channelID && acked[msg.ID] {
+				continue
+			}
+
+			remaining = append(remaining, msg)
+		}
+
+		n += len(*msgs) - len(remaining)
+		*msgs = remaining
+	}
+
+	in.fill()
+
+	return n
+}
+
+// messages returns the messages written to the client that haven't been
+// acknowledged, in the order they were written.
+func (in *inflight) messages() []Message {
+	in.mux.Lock()
+	defer in.mux.Unlock()
+
+	out := make([]Message, len(in.pending))
+	copy(out, in.pending)
+
+	return out
+}
+
+// len returns the number of messages waiting to be acknowledged, including those
+// held beyond the window.
+func (in *inflight) len() int {
+	in.mux.Lock()
+	defer in.mux.Unlock()
+
+	return len(in.pending) + len(in.held)
+}
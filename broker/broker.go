@@ -3,12 +3,17 @@ package broker
 
 import (
 	"bytes"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"hash/fnv"
 	"io/ioutil"
 	"net/http"
 	"runtime"
+	"sort"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/hashicorp/memberlist"
 	"github.com/sirupsen/logrus"
@@ -25,14 +30,84 @@ type (
 		channels   map[string]*Channel
 		log        *logrus.Entry
 		wg         sync.WaitGroup
+		expired    map[string]uint64
+		ids        *idGenerator
+		dedup      *deduplicator
+		scheduler  *scheduler
+
+		histories        map[string]*history
+		historySize      int
+		historyRetention time.Duration
+		seq              uint64
+		swept            time.Time
+		replayLimit      int
+
+		presence       map[string]presenceCache
+		presenceMaxAge time.Duration
+		presenceEvents []string
+		statusTimeout  time.Duration
+		locations      *Locations
+
+		propagation         Propagation
+		parallelism         int
+		transport           Transport
+		peers               PeerTransport
+		peerPort            int
+		propagated          map[string]uint64
+		propagationFailures map[string]uint64
+		retries             *retrier
+		inflight            map[string]*inflight
+		ackWindow           int
+		ackRetention        time.Duration
+		queueChannels       []queueChannels
+		turns               map[string]int
+		configs             *channelConfigs
+
+		channelOpts []ChannelOption
+		store       EventStore
+	}
+
+	// The BatchResult type describes the outcome of publishing a single message
+	// as part of a batch. It contains the message's identifier and any error that
+	// occurred, which is ErrDuplicate if the message was discarded as a retry.
+	BatchResult struct {
+		ID  string
+		Err error
+	}
+
+	// The DedupRequest type asks the node that owns a deduplication key to check it
+	// for a message published to another node, or to release it if the message
+	// could not be published. Requests are sent to the owner in batches.
+	DedupRequest struct {
+		Key     string `json:"key"`
+		ID      string `json:"id,omitempty"`
+		Release bool   `json:"release,omitempty"`
 	}
 
+	// The DedupResponse type is the result of a DedupRequest. It contains the
+	// identifier of the original message if the key was a duplicate.
+	DedupResponse struct {
+		ID        string `json:"id"`
+		Duplicate bool   `json:"duplicate"`
+	}
+
+	// The Option type is a function that modifies the configuration of the
+	// broker on creation.
+	Option func(*Broker)
+
 	// The Memberlist type represents the gossip implementation used by the
 	// broker for service discovery.
 	Memberlist interface {
 		NumMembers() int
 		LocalNode() *memberlist.Node
 		Members() []*memberlist.Node
+		SendReliable(*memberlist.Node, []byte) error
+	}
+
+	// The PeerTransport type sends messages to other nodes over connections that
+	// are maintained between them, for use with TransportPeer.
+	PeerTransport interface {
+		Send(addr string, msgs []Message) error
 	}
 
 	// The Status type represents the status of a node/cluster. It contains
@@ -43,16 +118,146 @@ type (
 			MemberCount int            `json:"member_count"`
 			Members     map[string]int `json:"members"`
 		} `json:"gossip"`
-		Channels map[string][]string `json:"channels"`
+		Channels  map[string][]string `json:"channels"`
+		Dropped   map[string]uint64   `json:"dropped"`
+		Expired   map[string]uint64   `json:"expired"`
+		Scheduled int                 `json:"scheduled"`
+
+		// The number of times messages were sent to each node, and the number of
+		// times sending them failed.
+		Propagated          map[string]uint64 `json:"propagated"`
+		PropagationFailures map[string]uint64 `json:"propagation_failures"`
+
+		// The number of messages waiting to be retried to each node, the number
+		// successfully retried and the number given up on as dead letters.
+		RetryQueued  map[string]int    `json:"retry_queued"`
+		Retried      map[string]uint64 `json:"retried"`
+		RetryDropped map[string]uint64 `json:"retry_dropped"`
+
+		// The number of messages waiting to be acknowledged by each client that
+		// uses acknowledgements.
+		Unacked map[string]int `json:"unacked"`
 	}
 )
 
+// ErrDuplicate is returned when publishing a message whose idempotency key or
+// identifier was already published within the deduplication window.
+var ErrDuplicate = errors.New("message is a duplicate")
+
+// ErrClientNotFound is returned when publishing a message to a client that isn't
+// connected to any node in the cluster.
+var ErrClientNotFound = errors.New("client not found")
+
+// ErrChannelNotFound is returned when deleting a channel that hasn't been declared.
+var ErrChannelNotFound = errors.New("channel not found")
+
+// ErrChannelFull is returned when subscribing to a declared channel that already
+// has as many clients on this node as it allows.
+var ErrChannelFull = errors.New("channel has too many clients")
+
+// ErrUnauthorized is returned when subscribing to a declared channel without the
+// token it requires.
+var ErrUnauthorized = errors.New("a valid token is required for this channel")
+
+const (
+	// DefaultHistorySize is the number of messages kept for each channel for
+	// replaying to reconnecting clients when no size is specified.
+	DefaultHistorySize = 100
+
+	// DefaultHistoryRetention is how long the history of a channel is kept after
+	// the last message was published to it when no retention is specified.
+	DefaultHistoryRetention = time.Hour
+
+	// DefaultReplayLimit is the maximum number of messages read from the history
+	// for a single replay when no limit is specified.
+	DefaultReplayLimit = 1000
+)
+
+// WithHistorySize sets the number of messages kept for each channel for replaying
+// to reconnecting clients. A size of zero disables the history.
+func WithHistorySize(size int) Option {
+	return func(b *Broker) {
+		b.historySize = size
+	}
+}
+
+// WithHistoryRetention sets how long the history of a channel is kept after the
+// last message was published to it. Histories are kept whether or not the channel
+// has any clients, so that clients can reconnect and catch up.
+func WithHistoryRetention(retention time.Duration) Option {
+	return func(b *Broker) {
+		b.historyRetention = retention
+	}
+}
+
+// WithChannelOptions sets the options applied to each channel the broker
+// creates.
+func WithChannelOptions(opts ...ChannelOption) Option {
+	return func(b *Broker) {
+		b.channelOpts = append(b.channelOpts, opts...)
+	}
+}
+
+// WithReplayLimit sets the maximum number of messages read from the history for a
+// single replay or history request, so that clients with an unknown or missing
+// last event identifier cannot load an entire channel's history. A limit of zero
+// places no limit on replays.
+func WithReplayLimit(limit int) Option {
+	return func(b *Broker) {
+		b.replayLimit = limit
+	}
+}
+
+// WithEventStore sets the store every message published to a channel is written
+// to. When set, replays are read from the store rather than the in-memory history.
+func WithEventStore(store EventStore) Option {
+	return func(b *Broker) {
+		b.store = store
+	}
+}
+
+// WithDedupWindow sets how long the keys of published messages are remembered so
+// that retried publishes can be discarded. A window of zero disables deduplication.
+// Each key is owned by a single node in the cluster, chosen by hashing the key, and
+// every node asks the owner whether a key has been seen before accepting a message.
+// Retries sent to any node are therefore discarded, unless the owner cannot be
+// reached or membership changes within the window.
+func WithDedupWindow(window time.Duration) Option {
+	return func(b *Broker) {
+		b.dedup = newDeduplicator(window)
+	}
+}
+
 // New creates a new instance of the Broker type using the given member list and
 // node.
-func New(ml Memberlist, cl *http.Client) *Broker {
+func New(ml Memberlist, cl *http.Client, opts ...Option) *Broker {
 	br := &Broker{
+		historySize:      DefaultHistorySize,
+		historyRetention: DefaultHistoryRetention,
+		replayLimit:      DefaultReplayLimit,
+		presence:         make(map[string]presenceCache),
+		presenceMaxAge:   DefaultPresenceMaxAge,
+		statusTimeout:    DefaultStatusTimeout,
+		propagation:      PropagationChain,
+		parallelism:      DefaultFanOutParallelism,
+		transport:        TransportHTTP,
+
+		propagated:          make(map[string]uint64),
+		propagationFailures: make(map[string]uint64),
+		retries:             newRetrier(),
+		inflight:            make(map[string]*inflight),
+		ackWindow:           DefaultAckWindow,
+		ackRetention:        DefaultAckRetention,
+		turns:               make(map[string]int),
+		configs:             newChannelConfigs(),
+
 		memberlist: ml,
 		channels:   make(map[string]*Channel),
+		expired:    make(map[string]uint64),
+		ids:        newIDGenerator(ml.LocalNode().Name),
+		dedup:      newDeduplicator(0),
+		scheduler:  newScheduler(),
+		histories:  make(map[string]*history),
 		http:       cl,
 		log: logrus.WithFields(logrus.Fields{
 			"name":     "broker",
@@ -60,18 +265,41 @@ func New(ml Memberlist, cl *http.Client) *Broker {
 		}),
 	}
 
+	for _, opt := range opts {
+		opt(br)
+	}
+
+	// Declared channels are shared with other nodes through the locations
+	if br.locations != nil {
+		br.configs = br.locations.configs
+	}
+
+	if br.gossip() {
+		br.locations.handle(br.receive)
+	}
+
+	if br.transport == TransportPeer && br.locations != nil {
+		br.locations.advertise(br.peerPort)
+	}
+
 	return br
 }
 
 // Close blocks the goroutine until all asynchronous operations of the broker
-// have stopped.
+// have stopped. Messages scheduled for later delivery are discarded, other nodes
+// in the cluster deliver their own copies. Messages waiting to be retried to other
+// nodes are discarded.
 func (b *Broker) Close() {
+	b.scheduler.stop()
 	b.wg.Wait()
+	b.retries.stop()
 }
 
 // Status returns information on the broker. It contains the number of running
 // goroutines, the gossip members and total member count, as well as client information
-// for this broker.
+// and the number of messages dropped for slow clients or because they expired on each
+// channel for this broker, along with the number of messages waiting to be delivered
+// at a later time and the messages retried to other nodes.
 func (b *Broker) Status() *Status {
 	health := &Status{}
 
@@ -84,200 +312,1307 @@ func (b *Broker) Status() *Status {
 	}
 
 	health.Channels = make(map[string][]string)
+	health.Dropped = make(map[string]uint64)
 
 	b.mux.Lock()
 	defer b.mux.Unlock()
 
 	for id, channel := range b.channels {
 		health.Channels[id] = channel.ClientIDs()
+		health.Dropped[id] = channel.Dropped()
+	}
+
+	health.Expired = make(map[string]uint64)
+	for id, count := range b.expired {
+		health.Expired[id] = count
+	}
+
+	health.Scheduled = b.scheduler.len()
+
+	health.Propagated = make(map[string]uint64)
+	for id, count := range b.propagated {
+		health.Propagated[id] = count
+	}
+
+	health.PropagationFailures = make(map[string]uint64)
+	for id, count := range b.propagationFailures {
+		health.PropagationFailures[id] = count
 	}
 
+	health.Unacked = make(map[string]int)
+	for id, in := range b.inflight {
+		health.Unacked[id] = in.len()
+	}
+
+	b.retries.status(health)
+
 	return health
 }
 
 // Publish writes a given message to a client. If no client identifier is specified,
-// the message is written to the entire channel. If running in a cluster, the event
-// is forwarded asynchronously via HTTP to the next node whose id does not exist in
-// the message's BeenTo field.
-func (b *Broker) Publish(channelID, clientID string, msg Message) error {
-	switch {
-	// If we've got no channel or client identifier, publish to all clients
-	// on all channels
-	case channelID == "" && clientID == "":
-		b.wg.Add(1)
-		go b.publishAll(msg)
-	// If we've got a channel identifier but no client identifier, write to
-	// the entire channel
-	case channelID != "" && clientID == "":
-		b.wg.Add(1)
-		go b.publishChannel(channelID, msg)
-	// If we've got both a client and channel identifier, write to the client
-	// on the given channel
-	case channelID != "" && clientID != "":
-		b.wg.Add(1)
-		go b.publishClient(channelID, clientID, msg)
-	default:
-		return errors.New("invalid channel/client identifier combination")
+// the message is written to the entire channel. Messages are delivered to every
+// channel whose subscription matches the channel name, including wildcard
+// subscriptions. Messages cannot be published to a wildcard. If running in a
+// cluster, the event is forwarded asynchronously via HTTP to the next node whose
+// id does not exist in the message's BeenTo field. Messages written to an entire
+// channel are also written to the event store, if one is configured. Messages that
+// have already expired are discarded. If the message has no identifier, one is
+// assigned that increases for each channel and is unique across the cluster. The
+// message's identifier is returned. If deduplication is enabled and a message with
+// the same idempotency key or identifier was published within the window, the
+// message is discarded and ErrDuplicate is returned along with the identifier of
+// the original. Messages with a delay or delivery time in the future are held until
+// then by every node, and their TTL starts once they are delivered. If the broker
+// tracks client locations, messages for a single client are sent straight to the
+// node it is connected to, and ErrClientNotFound is returned if no node holds it.
+// Such messages are never sent on by the node that receives them, so they are
+// discarded if the client has since moved to another node.
+func (b *Broker) Publish(channelID, clientID string, msg Message) (string, error) {
+	msg, ok, err := b.publish(channelID, clientID, msg)
+
+	if err != nil || !ok {
+		return msg.ID, err
+	}
+
+	if b.route(channelID, clientID, msg) {
+		return msg.ID, nil
 	}
 
 	// If we're not the only member, propagate the event
 	if b.memberlist.NumMembers() > 1 {
-		b.wg.Add(1)
-		go b.sendToNextNode(channelID, clientID, msg)
+		b.propagate(channelID, clientID, msg)
 	}
 
-	return nil
+	return msg.ID, nil
 }
 
-func (b *Broker) publishAll(msg Message) {
-	b.mux.Lock()
-	defer b.mux.Unlock()
-	defer b.wg.Done()
+// PublishBatch publishes many messages at once. Each message is written to its
+// Channel, or to its Client within that channel if one is set, in the same way as
+// Publish. The result of publishing each message is returned in the same order.
+// The deduplication keys of the batch are checked with a single request to each
+// node that owns any of them. If running in a cluster, all messages that were
+// published are forwarded to the next node as a single batch.
+func (b *Broker) PublishBatch(msgs []Message) []BatchResult {
+	results := make([]BatchResult, len(msgs))
+	prepared := make([]Message, len(msgs))
+	keys := make([]string, len(msgs))
 
-	for _, ch := range b.channels {
-		b.mux.Unlock()
+	var checks []DedupRequest
+	for i, msg := range msgs {
+		msg, key, ok, err := b.prepare(msg.Channel, msg.Client, msg)
+		results[i] = BatchResult{ID: msg.ID, Err: err}
+		prepared[i] = msg
 
-		ch.Write(msg)
+		if err != nil || !ok {
+			continue
+		}
 
-		b.mux.Lock()
+		keys[i] = key
+		if key != "" {
+			checks = append(checks, DedupRequest{Key: key, ID: msg.ID})
+		}
 	}
-}
 
-func (b *Broker) publishChannel(channelID string, msg Message) {
-	b.mux.Lock()
-	defer b.mux.Unlock()
-	defer b.wg.Done()
+	duplicates := b.checkDuplicates(checks)
+
+	var published []Message
+	for i, msg := range prepared {
+		if results[i].Err != nil {
+			continue
+		}
+
+		// Only prepared messages have a key, so they are checked in order
+		if keys[i] != "" {
+			dup := duplicates[0]
+			duplicates = duplicates[1:]
+
+			if dup.Duplicate {
+				results[i] = BatchResult{ID: dup.ID, Err: ErrDuplicate}
+				continue
+			}
+		}
 
-	if ch, ok := b.channels[channelID]; ok {
-		ch.Write(msg)
+		msg, ok, err := b.commit(msg.Channel, msg.Client, keys[i], msg)
+		results[i] = BatchResult{ID: msg.ID, Err: err}
+
+		if err != nil || !ok || b.route(msg.Channel, msg.Client, msg) {
+			continue
+		}
+
+		published = append(published, msg)
 	}
+
+	if len(published) > 0 && b.memberlist.NumMembers() > 1 {
+		b.propagateBatch(published)
+	}
+
+	return results
 }
 
-func (b *Broker) publishClient(channelID, clientID string, msg Message) {
-	b.mux.Lock()
-	defer b.mux.Unlock()
-	defer b.wg.Done()
+// route sends a message for a single client straight to the node it's connected
+// to. It returns false if the message should be propagated instead, as the broker
+// doesn't track client locations. Messages sent by other nodes were routed here,
+// so they are only written to the client if it is connected to this node, even if
+// this node believes it has moved elsewhere. Otherwise, nodes with different views
+// of the client's location could send the message back and forth.
+func (b *Broker) route(channelID, clientID string, msg Message) bool {
+	if clientID == "" || b.locations == nil {
+		return false
+	}
 
-	if ch, ok := b.channels[channelID]; ok {
-		ch.WriteTo(clientID, msg)
+	if len(msg.BeenTo) > 0 {
+		return true
 	}
+
+	if node, ok := b.locations.lookup(clientID); ok && node != b.memberlist.LocalNode().Name {
+		b.wg.Add(1)
+		go b.sendToNode(node, channelID, clientID, msg)
+	}
+
+	return true
 }
 
-func (b *Broker) sendToNextNode(channelID, clientID string, msg Message) {
-	defer b.wg.Done()
+// publish writes a message to the local node's clients. It returns the message as
+// published and whether it should be propagated to other nodes, which it should
+// not be if it was discarded. Messages published to queue channels are sent to
+// other nodes when they are delivered, so they are not propagated.
+func (b *Broker) publish(channelID, clientID string, msg Message) (Message, bool, error) {
+	msg, key, ok, err := b.prepare(channelID, clientID, msg)
 
-	// Obtain the individual node ids from the X-Been-To header
-	ids := make(map[string]interface{})
-	for _, nodeID := range msg.BeenTo {
-		ids[nodeID] = true
+	if err != nil || !ok {
+		return msg, false, err
 	}
 
-	// For each member in the list
-	for _, member := range b.memberlist.Members() {
-		evtInfo := logrus.Fields{
-			"targetNodeId": member.Name,
-			"eventId":      msg.ID,
-			"event":        msg.Event,
-			"channel":      channelID,
+	// Discard messages that have already been published, such as those retried by
+	// publishers after a timeout.
+	if key != "" {
+		if id, ok := b.checkDuplicate(key, msg.ID); ok {
+			msg.ID = id
+			return msg, false, ErrDuplicate
 		}
+	}
 
-		// If we're looking at ourselves, or a node the message has already
-		// been through, skip.
-		if _, ok := ids[member.Name]; ok || member == b.memberlist.LocalNode() {
-			continue
+	return b.commit(channelID, clientID, key, msg)
+}
+
+// prepare validates a message and fills in the fields set by the broker, such as
+// its identifier and expiry. It returns the message along with its deduplication
+// key, and false if the message has already expired. Messages forwarded by other
+// nodes were checked for duplicates by the node they were published to, so have
+// no key.
+func (b *Broker) prepare(channelID, clientID string, msg Message) (Message, string, bool, error) {
+	if IsWildcard(channelID) {
+		return msg, "", false, fmt.Errorf("cannot publish to wildcard channel %s", channelID)
+	}
+
+	if channelID == "" && clientID != "" {
+		return msg, "", false, errors.New("invalid channel/client identifier combination")
+	}
+
+	// Messages forwarded by other nodes were routed here by the node they were
+	// published to.
+	if clientID != "" && b.locations != nil && len(msg.BeenTo) == 0 {
+		if _, ok := b.locations.lookup(clientID); !ok {
+			return msg, "", false, ErrClientNotFound
 		}
+	}
 
-		// Append this node's id to the list of node ids this event
-		// has already been to
-		msg.BeenTo = append(msg.BeenTo, b.memberlist.LocalNode().Name)
-		url := fmt.Sprintf("http://%s:%s/publish/%s", member.Addr, member.Meta, channelID)
+	key := msg.IdempotencyKey
+	if key == "" {
+		key = msg.ID
+	}
 
-		// Send an HTTP POST request to the event publishing endpoint of the member
-		// node.
-		resp, err := b.http.Post(url, "application/json", bytes.NewBuffer(msg.JSON()))
+	// Assign an identifier if the publisher didn't provide one, so that clients
+	// can resume from this message.
+	if msg.ID == "" {
+		msg.ID = b.ids.next(channelID)
+	} else {
+		b.ids.observe(channelID, msg.ID)
+	}
 
-		if err != nil {
-			b.log.
-				WithFields(evtInfo).
-				WithError(err).
-				Error("failed to perform http request")
+	// Record the channel the message was published to, so that clients subscribed
+	// to many channels know where it came from.
+	if channelID != "" {
+		msg.Channel = channelID
+		msg.Client = clientID
+	}
 
-			continue
+	// Declared channels can give messages a default reconnection time
+	if msg.Retry == 0 && channelID != "" {
+		if cfg, ok := b.configs.get(channelID); ok {
+			msg.Retry = cfg.Retry
 		}
+	}
 
-		// The publish endpoint should return a 200
-		if resp.StatusCode != http.StatusOK {
-			// If not, log the error and try the next node
-			data, _ := ioutil.ReadAll(resp.Body)
-			err := fmt.Errorf(string(data))
+	if msg.Delay < 0 {
+		return msg, "", false, errors.New("delay cannot be negative")
+	}
 
-			b.log.
-				WithFields(evtInfo).
-				WithError(err).
-				Error("failed to propagate event to node")
+	now := time.Now()
 
-			continue
+	if msg.DeliverAt == nil && msg.Delay > 0 {
+		deliverAt := now.Add(time.Duration(msg.Delay) * time.Millisecond)
+		msg.DeliverAt = &deliverAt
+	}
+
+	// The TTL of a scheduled message starts once it is delivered
+	if msg.ExpiresAt == nil && msg.TTL > 0 {
+		start := now
+		if msg.DeliverAt != nil && msg.DeliverAt.After(now) {
+			start = *msg.DeliverAt
 		}
 
-		b.log.
-			WithFields(evtInfo).
-			Info("propagated message to node")
+		expiresAt := start.Add(time.Duration(msg.TTL) * time.Millisecond)
+		msg.ExpiresAt = &expiresAt
+	}
 
-		// If we were successful, break, we will write the message to the first
-		// node that isn't in the been to list
-		break
+	// Messages that expired before reaching this node, such as those forwarded by
+	// a slow peer, are not delivered.
+	if msg.Expired() {
+		b.Expire(msg)
+		return msg, "", false, nil
+	}
+
+	if key == "" || len(msg.BeenTo) > 0 {
+		return msg, "", true, nil
 	}
+
+	return msg, channelID + "/" + clientID + "/" + key, true, nil
 }
 
-// NewClient creates a new client for a given channel. If the channel does not
-// exist, it is created.
-func (b *Broker) NewClient(channelID, clientID string) (*Client, error) {
-	b.mux.Lock()
-	defer b.mux.Unlock()
+// commit delivers a message that has been prepared and checked for duplicates. It
+// returns the message and whether it should be propagated to other nodes. If the
+// message can't be delivered, its deduplication key is released so that it can be
+// retried.
+func (b *Broker) commit(channelID, clientID, dedupKey string, msg Message) (Message, bool, error) {
+	now := time.Now()
 
-	ch, ok := b.channels[channelID]
+	_, queued := b.queued(channelID)
+	propagate := !queued || clientID != ""
 
-	if !ok {
-		ch = NewChannel(channelID)
-		b.channels[channelID] = ch
+	// Messages to be delivered later are held by every node they are propagated
+	// to, each delivering them to its own clients, so they are still delivered if
+	// the node they were published to leaves the cluster. Messages published to
+	// queue channels are only held by the node they were published to.
+	if msg.DeliverAt != nil && msg.DeliverAt.After(now) {
+		b.scheduler.schedule(channelID+"/"+clientID+"/"+msg.ID, *msg.DeliverAt, func() {
+			b.deliverScheduled(channelID, clientID, msg)
+		})
+
+		return msg, propagate, nil
+	}
+
+	if err := b.deliver(channelID, clientID, msg); err != nil {
+		// The message wasn't published, so a retry shouldn't be discarded
+		if dedupKey != "" {
+			b.releaseDuplicate(dedupKey)
+		}
+
+		return msg, false, err
+	}
+
+	return msg, propagate, nil
+}
+
+// deliverScheduled delivers a message to this node's clients once the time it was
+// scheduled for has been reached.
+func (b *Broker) deliverScheduled(channelID, clientID string, msg Message) {
+	if msg.Expired() {
+		b.Expire(msg)
+		return
+	}
 
+	if err := b.deliver(channelID, clientID, msg); err != nil {
 		b.log.WithFields(logrus.Fields{
 			"channel": channelID,
-		}).Info("created new channel")
+			"eventId": msg.ID,
+		}).WithError(err).Error("failed to deliver scheduled message")
 	}
+}
 
-	b.log.WithFields(logrus.Fields{
-		"channel": channelID,
-		"client":  clientID,
-	}).Info("creating new client")
+// deliver writes a message to the event store and history, then to the clients of
+// this node. Messages published to queue channels are given to a single client in
+// the cluster and are not kept for replaying.
+func (b *Broker) deliver(channelID, clientID string, msg Message) error {
+	if selection, ok := b.queued(channelID); ok && clientID == "" {
+		b.wg.Add(1)
+		go b.publishQueue(channelID, selection, msg)
+
+		return nil
+	}
+
+	if b.store != nil && channelID != "" && clientID == "" {
+		if err := b.store.Append(channelID, msg); err != nil {
+			return fmt.Errorf("failed to write message to event store: %v", err)
+		}
+	}
 
-	return ch.NewClient(clientID)
+	if clientID == "" {
+		b.record(channelID, msg)
+	}
+
+	switch {
+	// If we've got no channel or client identifier, publish to all clients
+	// on all channels
+	case channelID == "" && clientID == "":
+		b.wg.Add(1)
+		go b.publishAll(msg)
+	// If we've got a channel identifier but no client identifier, write to
+	// the entire channel
+	case channelID != "" && clientID == "":
+		b.wg.Add(1)
+		go b.publishChannel(channelID, msg)
+	// If we've got both a client and channel identifier, write to the client
+	// on the given channel
+	case channelID != "" && clientID != "":
+		b.wg.Add(1)
+		go b.publishClient(channelID, clientID, msg)
+	}
+
+	return nil
 }
 
-// RemoveClient removes a client from a channel. If the channel has no
-// connected clients, it is also removed.
-func (b *Broker) RemoveClient(channelID, clientID string) {
-	b.mux.Lock()
-	defer b.mux.Unlock()
+// CheckDuplicate records a deduplication key on behalf of another node in the
+// cluster, as this node owns the key. If the key was already seen within the
+// window, the identifier of the original message is returned along with true.
+func (b *Broker) CheckDuplicate(key, id string) (string, bool) {
+	return b.dedup.check(key, id)
+}
 
-	channel, ok := b.channels[channelID]
+// ReleaseDuplicate forgets a deduplication key recorded by CheckDuplicate, as the
+// message it was recorded for could not be published.
+func (b *Broker) ReleaseDuplicate(key string) {
+	b.dedup.release(key)
+}
 
-	if !ok {
+// checkDuplicate records a deduplication key with the node that owns it. If the
+// owner cannot be reached, the key is checked locally instead.
+func (b *Broker) checkDuplicate(key, id string) (string, bool) {
+	resp := b.checkDuplicates([]DedupRequest{{Key: key, ID: id}})[0]
+
+	return resp.ID, resp.Duplicate
+}
+
+// checkDuplicates records many deduplication keys with the nodes that own them,
+// sending a single request to each owner at the same time. Keys whose owner cannot
+// be reached are checked locally instead. The result of each check is returned in
+// the same order as the requests.
+func (b *Broker) checkDuplicates(reqs []DedupRequest) []DedupResponse {
+	out := make([]DedupResponse, len(reqs))
+
+	owners := make(map[string]*memberlist.Node)
+	groups := make(map[string][]int)
+
+	for i, req := range reqs {
+		owner := b.owner(req.Key)
+
+		if owner == nil {
+			out[i].ID, out[i].Duplicate = b.dedup.check(req.Key, req.ID)
+			continue
+		}
+
+		owners[owner.Name] = owner
+		groups[owner.Name] = append(groups[owner.Name], i)
+	}
+
+	var wg sync.WaitGroup
+	for name, indexes := range groups {
+		wg.Add(1)
+
+		go func(owner *memberlist.Node, indexes []int) {
+			defer wg.Done()
+
+			batch := make([]DedupRequest, len(indexes))
+			for j, i := range indexes {
+				batch[j] = reqs[i]
+			}
+
+			var resps []DedupResponse
+			err := b.sendDedup(owner, batch, &resps)
+
+			if err == nil && len(resps) != len(batch) {
+				err = fmt.Errorf("expected %d results, got %d", len(batch), len(resps))
+			}
+
+			if err != nil {
+				b.log.
+					WithField("targetNodeId", owner.Name).
+					WithError(err).
+					Warn("failed to check for duplicates with owning node, checking locally")
+
+				for _, i := range indexes {
+					out[i].ID, out[i].Duplicate = b.dedup.check(reqs[i].Key, reqs[i].ID)
+				}
+
+				return
+			}
+
+			for j, i := range indexes {
+				out[i] = resps[j]
+			}
+		}(owners[name], indexes)
+	}
+
+	wg.Wait()
+
+	return out
+}
+
+// releaseDuplicate forgets a deduplication key on the node that owns it.
+func (b *Broker) releaseDuplicate(key string) {
+	owner := b.owner(key)
+
+	if owner == nil {
+		b.dedup.release(key)
 		return
 	}
 
-	channel.RemoveClient(clientID)
+	if err := b.sendDedup(owner, []DedupRequest{{Key: key, Release: true}}, nil); err != nil {
+		b.log.
+			WithField("targetNodeId", owner.Name).
+			WithError(err).
+			Error("failed to release duplicate with owning node")
 
-	b.log.WithFields(logrus.Fields{
-		"channel": channelID,
-		"client":  clientID,
-	}).Info("removed client from channel")
+		// The key may have been recorded locally if the owner was unreachable
+		b.dedup.release(key)
+	}
+}
 
-	if channel.NumClients() == 0 {
-		delete(b.channels, channelID)
+// owner returns the member of the cluster that owns a deduplication key, or nil if
+// it is owned by this node or deduplication is disabled. Members are sorted by name
+// so that every node agrees on the owner.
+func (b *Broker) owner(key string) *memberlist.Node {
+	if b.dedup.window <= 0 || b.memberlist.NumMembers() <= 1 {
+		return nil
+	}
 
-		b.log.WithFields(logrus.Fields{
-			"channel": channelID,
+	members := append([]*memberlist.Node(nil), b.memberlist.Members()...)
+
+	if len(members) == 0 {
+		return nil
+	}
+
+	sort.Slice(members, func(i, j int) bool {
+		return members[i].Name < members[j].Name
+	})
+
+	h := fnv.New32a()
+	h.Write([]byte(key))
+
+	owner := members[h.Sum32()%uint32(len(members))]
+	if owner.Name == b.memberlist.LocalNode().Name {
+		return nil
+	}
+
+	return owner
+}
+
+func (b *Broker) sendDedup(member *memberlist.Node, reqs []DedupRequest, out *[]DedupResponse) error {
+	data, err := json.Marshal(reqs)
+
+	if err != nil {
+		return err
+	}
+
+	url := fmt.Sprintf("http://%s:%s/dedup", member.Addr, member.Meta)
+	resp, err := b.http.Post(url, "application/json", bytes.NewBuffer(data))
+
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		data, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf(string(data))
+	}
+
+	if out == nil {
+		return nil
+	}
+
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// record writes a message to the history of the channel it was published to, so
+// that it can be replayed to clients that reconnect later. Messages published to
+// all channels are written to the history of every channel with a history or a
+// subscription. Histories that haven't been written to within the retention
+// period are removed.
+func (b *Broker) record(channelID string, msg Message) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	ids := []string{channelID}
+	if channelID == "" {
+		ids = ids[:0]
+		for id := range b.histories {
+			ids = append(ids, id)
+		}
+
+		for id := range b.channels {
+			if _, ok := b.histories[id]; !ok && !IsWildcard(id) {
+				ids = append(ids, id)
+			}
+		}
+	}
+
+	for _, id := range ids {
+		h, ok := b.histories[id]
+		if !ok {
+			h = newHistory(b.historySize)
+			b.histories[id] = h
+		}
+
+		// The size of a declared channel's history can change at any time
+		h.size = b.channelHistorySize(id)
+
+		out := msg
+		if out.Channel == "" {
+			out.Channel = id
+		}
+
+		b.seq++
+		h.write(b.seq, out)
+	}
+
+	// Histories are swept as often as the shortest retention allows
+	interval := b.historyRetention
+	for _, cfg := range b.configs.all() {
+		retention := time.Duration(cfg.Retention) * time.Millisecond
+		if retention > 0 && (interval <= 0 || retention < interval) {
+			interval = retention
+		}
+	}
+
+	if interval <= 0 || time.Since(b.swept) < interval {
+		return
+	}
+
+	b.swept = time.Now()
+	for id, h := range b.histories {
+		if retention := b.channelRetention(id); retention > 0 && time.Since(h.written) > retention {
+			delete(b.histories, id)
+		}
+	}
+}
+
+func (b *Broker) publishAll(msg Message) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	defer b.wg.Done()
+
+	seen := make(map[*Client]bool)
+	for id, ch := range b.channels {
+		b.mux.Unlock()
+
+		out := msg
+		if out.Channel == "" {
+			out.Channel = id
+		}
+
+		ch.write(out, seen)
+
+		b.mux.Lock()
+	}
+}
+
+func (b *Broker) publishChannel(channelID string, msg Message) {
+	defer b.wg.Done()
+
+	// Clients subscribed to many matching channels, such as 'orders.>' and
+	// 'orders.created', receive the message once.
+	seen := make(map[*Client]bool)
+	for _, ch := range b.matching(channelID) {
+		ch.write(msg, seen)
+	}
+}
+
+func (b *Broker) publishClient(channelID, clientID string, msg Message) {
+	defer b.wg.Done()
+
+	seen := make(map[*Client]bool)
+	for _, ch := range b.matching(channelID) {
+		ch.writeTo(clientID, msg, seen)
+	}
+}
+
+// matching returns all channels whose subscription matches the given channel name,
+// including those subscribed to using wildcards.
+func (b *Broker) matching(channelID string) []*Channel {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	var out []*Channel
+	for id, ch := range b.channels {
+		if Match(id, channelID) {
+			out = append(out, ch)
+		}
+	}
+
+	return out
+}
+
+func (b *Broker) sendToNextNode(channelID, clientID string, msg Message) {
+	defer b.wg.Done()
+
+	// Obtain the individual node ids from the X-Been-To header
+	ids := make(map[string]interface{})
+	for _, nodeID := range msg.BeenTo {
+		ids[nodeID] = true
+	}
+
+	// Append this node's id to the list of node ids this event
+	// has already been to
+	msg.BeenTo = append(msg.BeenTo, b.memberlist.LocalNode().Name)
+
+	// For each member in the list
+	var failed []*memberlist.Node
+	for _, member := range b.memberlist.Members() {
+		evtInfo := logrus.Fields{
+			"targetNodeId": member.Name,
+			"eventId":      msg.ID,
+			"event":        msg.Event,
+			"channel":      channelID,
+		}
+
+		// Don't forward messages that expired while being propagated
+		if msg.Expired() {
+			b.Expire(msg)
+			return
+		}
+
+		// If we're looking at ourselves, a node the message has already been
+		// through or a node without subscribers for the channel, skip.
+		if _, ok := ids[member.Name]; ok || member == b.memberlist.LocalNode() || !b.interested(member, channelID) {
+			continue
+		}
+
+		err := b.send(member, channelID, clientID, msg)
+		b.recordPropagation(member.Name, err)
+
+		if err != nil {
+			// If the node couldn't be reached, log the error and try the next node
+			b.log.
+				WithFields(evtInfo).
+				WithError(err).
+				Error("failed to propagate event to node")
+
+			failed = append(failed, member)
+			continue
+		}
+
+		b.log.
+			WithFields(evtInfo).
+			Info("propagated message to node")
+
+		// If we were successful, return, we will write the message to the first
+		// node that isn't in the been to list
+		return
+	}
+
+	b.retryAll(failed, []Message{msg})
+}
+
+// retryAll queues messages that couldn't be sent to any of the given nodes to be
+// retried to each of them. Every node is added to the nodes the messages have been
+// through, so that the nodes don't forward them to one another once retried.
+func (b *Broker) retryAll(members []*memberlist.Node, msgs []Message) {
+	for i := range msgs {
+		for _, member := range members {
+			msgs[i].BeenTo = append(msgs[i].BeenTo, member.Name)
+		}
+	}
+
+	for _, member := range members {
+		b.retry(member.Name, msgs)
+	}
+}
+
+// interested returns true if a member node has subscribers for the given channel.
+// If the broker doesn't track the channels of other nodes, every node is assumed
+// to be interested.
+func (b *Broker) interested(member *memberlist.Node, channelID string) bool {
+	return b.locations == nil || b.locations.interested(member.Name, channelID)
+}
+
+func (b *Broker) interestedInAny(member *memberlist.Node, msgs []Message) bool {
+	for _, msg := range msgs {
+		if b.interested(member, msg.Channel) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// sendToNode sends a message for a single client straight to the node it is
+// connected to.
+func (b *Broker) sendToNode(nodeID, channelID, clientID string, msg Message) {
+	defer b.wg.Done()
+
+	evtInfo := logrus.Fields{
+		"targetNodeId": nodeID,
+		"eventId":      msg.ID,
+		"event":        msg.Event,
+		"channel":      channelID,
+		"client":       clientID,
+	}
+
+	if msg.Expired() {
+		b.Expire(msg)
+		return
+	}
+
+	// Never send a message back to a node it has already been through
+	for _, name := range msg.BeenTo {
+		if name == nodeID {
+			b.log.
+				WithFields(evtInfo).
+				Warn("discarded event, it has already been through the node")
+
+			return
+		}
+	}
+
+	for _, member := range b.memberlist.Members() {
+		if member.Name != nodeID {
+			continue
+		}
+
+		msg.BeenTo = append(msg.BeenTo, b.memberlist.LocalNode().Name)
+
+		err := b.send(member, channelID, clientID, msg)
+		b.recordPropagation(member.Name, err)
+
+		if err != nil {
+			b.log.
+				WithFields(evtInfo).
+				WithError(err).
+				Error("failed to send event to node")
+
+			b.retry(member.Name, []Message{msg})
+			return
+		}
+
+		b.log.
+			WithFields(evtInfo).
+			Info("sent message to node")
+
+		return
+	}
+
+	b.log.
+		WithFields(evtInfo).
+		Error("failed to send event to node, node is not a member")
+}
+
+// send sends an HTTP POST request to the event publishing endpoint of a member
+// node, or sends the message using the broker's transport if it isn't TransportHTTP.
+// Messages that can't be sent over a peer connection are sent using HTTP instead.
+func (b *Broker) send(member *memberlist.Node, channelID, clientID string, msg Message) error {
+	if addr, ok := b.peerAddr(member); ok {
+		err := b.peers.Send(addr, []Message{msg})
+
+		if err == nil {
+			return nil
+		}
+
+		b.log.
+			WithField("targetNodeId", member.Name).
+			WithError(err).
+			Warn("failed to send event over peer connection, sending using HTTP")
+	}
+
+	if b.gossip() {
+		return b.sendReliable(member, messageEvent, msg.JSON())
+	}
+
+	url := fmt.Sprintf("http://%s:%s/channel", member.Addr, member.Meta)
+
+	switch {
+	case channelID != "" && clientID != "":
+		url += "/" + channelID + "/client/" + clientID
+	case channelID != "":
+		url += "/" + channelID
+	}
+
+	resp, err := b.http.Post(url, "application/json", bytes.NewBuffer(msg.JSON()))
+
+	if err != nil {
+		return err
+	}
+
+	data, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	// The publish endpoint should return a 200
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf(string(data))
+	}
+
+	return nil
+}
+
+func (b *Broker) sendBatchToNextNode(msgs []Message) {
+	defer b.wg.Done()
+
+	// Messages in a batch travel together, so obtain the node ids every message
+	// has already been through
+	ids := make(map[string]interface{})
+	for _, msg := range msgs {
+		for _, nodeID := range msg.BeenTo {
+			ids[nodeID] = true
+		}
+	}
+
+	// Don't forward messages that expired while being published, and append this
+	// node's id to the list of node ids each remaining event has already been to
+	unexpired := msgs[:0]
+	for _, msg := range msgs {
+		if msg.Expired() {
+			b.Expire(msg)
+			continue
+		}
+
+		msg.BeenTo = append(msg.BeenTo, b.memberlist.LocalNode().Name)
+		unexpired = append(unexpired, msg)
+	}
+
+	if len(unexpired) == 0 {
+		return
+	}
+
+	msgs = unexpired
+
+	var failed []*memberlist.Node
+	for _, member := range b.memberlist.Members() {
+		batchInfo := logrus.Fields{
+			"targetNodeId": member.Name,
+			"batchSize":    len(msgs),
+		}
+
+		// If we're looking at ourselves, a node the batch has already been
+		// through or a node without subscribers for any of its channels, skip.
+		if _, ok := ids[member.Name]; ok || member == b.memberlist.LocalNode() || !b.interestedInAny(member, msgs) {
+			continue
+		}
+
+		err := b.sendBatch(member, msgs)
+		b.recordPropagation(member.Name, err)
+
+		if err != nil {
+			// If the node couldn't be reached, log the error and try the next node
+			b.log.
+				WithFields(batchInfo).
+				WithError(err).
+				Error("failed to propagate batch to node")
+
+			failed = append(failed, member)
+			continue
+		}
+
+		b.log.
+			WithFields(batchInfo).
+			Info("propagated batch to node")
+
+		return
+	}
+
+	b.retryAll(failed, msgs)
+}
+
+// sendBatch sends an HTTP POST request to the batch publishing endpoint of a member
+// node, or sends the batch using the broker's transport if it isn't TransportHTTP.
+// Batches that can't be sent over a peer connection are sent using HTTP instead.
+func (b *Broker) sendBatch(member *memberlist.Node, msgs []Message) error {
+	if addr, ok := b.peerAddr(member); ok {
+		err := b.peers.Send(addr, msgs)
+
+		if err == nil {
+			return nil
+		}
+
+		b.log.
+			WithField("targetNodeId", member.Name).
+			WithError(err).
+			Warn("failed to send batch over peer connection, sending using HTTP")
+	}
+
+	data, _ := json.Marshal(msgs)
+
+	if b.gossip() {
+		return b.sendReliable(member, messageBatch, data)
+	}
+
+	url := fmt.Sprintf("http://%s:%s/batch", member.Addr, member.Meta)
+	resp, err := b.http.Post(url, "application/json", bytes.NewBuffer(data))
+
+	if err != nil {
+		return err
+	}
+
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	// The batch endpoint should return a 200, client errors mean the batch itself
+	// was invalid.
+	if resp.StatusCode >= 400 && resp.StatusCode < 500 {
+		return &rejectedError{status: resp.StatusCode, msg: strings.TrimSpace(string(body))}
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf(string(body))
+	}
+
+	return nil
+}
+
+// NewClient creates a new client subscribed to the given channels. A single client
+// is shared across all channels so that events from each are delivered to one
+// stream. If a channel does not exist, it is created. Channels may be wildcard
+// subscriptions such as 'orders.*.created' or 'orders.>'. The given options are
+// applied to the client after those configured for the channel. If the client uses
+// acknowledgements, the messages it didn't acknowledge before disconnecting from
+// other nodes in the cluster are taken from them to be redelivered.
+func (b *Broker) NewClient(channelIDs []string, clientID string, opts ...ClientOption) (*Client, error) {
+	cl, joined, err := b.newClient(channelIDs, clientID, opts...)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if cl.acks {
+		b.takeover(cl)
+	}
+
+	if b.locations != nil {
+		b.locations.add(clientID)
+	}
+
+	for _, channelID := range joined {
+		b.publishPresence(channelID, EventPresenceJoin, cl)
+	}
+
+	return cl, nil
+}
+
+// newClient subscribes a new client to the given channels. It returns the client
+// along with the channels that publish presence events.
+func (b *Broker) newClient(channelIDs []string, clientID string, opts ...ClientOption) (*Client, []string, error) {
+	if len(channelIDs) == 0 {
+		return nil, nil, errors.New("a client must subscribe to at least one channel")
+	}
+
+	seen := make(map[string]bool)
+	unique := channelIDs[:0:0]
+
+	for _, channelID := range channelIDs {
+		if !ValidPattern(channelID) {
+			return nil, nil, fmt.Errorf("invalid channel %s, '%s' must be the last token", channelID, trailingWildcard)
+		}
+
+		if !seen[channelID] {
+			seen[channelID] = true
+			unique = append(unique, channelID)
+		}
+	}
+
+	// Acknowledgement state is attached before the client is added to any channel,
+	// as messages can be written to it as soon as it is.
+	opts = append(opts[:len(opts):len(opts)], func(c *Client) {
+		if c.acks {
+			b.attachInflight(c)
+		}
+	})
+
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	var cl *Client
+	var added []string
+
+	for _, channelID := range unique {
+		ch, ok := b.channels[channelID]
+
+		if !ok {
+			ch = NewChannel(channelID, b.channelOpts...)
+			b.channels[channelID] = ch
+
+			if b.locations != nil {
+				b.locations.subscribe(channelID)
+			}
+
+			b.log.WithFields(logrus.Fields{
+				"channel": channelID,
+			}).Info("created new channel")
+		}
+
+		b.log.WithFields(logrus.Fields{
+			"channel": channelID,
+			"client":  clientID,
+		}).Info("creating new client")
+
+		var err error
+		switch {
+		case b.full(ch):
+			err = ErrChannelFull
+		case cl == nil:
+			cl, err = ch.NewClient(clientID, opts...)
+		default:
+			err = ch.AddClient(cl)
+		}
+
+		if err != nil {
+			// Undo any memberships created so far, so the client isn't left
+			// half-subscribed.
+			for _, id := range added {
+				b.removeClient(id, clientID)
+			}
+
+			if ch.NumClients() == 0 {
+				b.removeChannel(channelID)
+			}
+
+			if cl != nil && cl.acks {
+				b.detachInflight(clientID)
+			}
+
+			return nil, nil, err
+		}
+
+		added = append(added, channelID)
+	}
+
+	var joined []string
+	for _, channelID := range added {
+		if b.presenceEnabled(channelID) {
+			joined = append(joined, channelID)
+		}
+	}
+
+	return cl, joined, nil
+}
+
+// Replay returns the messages published to the given channels after the message
+// with the given identifier, so that reconnecting clients can catch up on events
+// they missed. A stream's last event identifier belongs to a single channel, so
+// when replaying many channels, only those that contain the identifier are replayed
+// from it. Other channels are replayed from the time the identifier was assigned if
+// it was assigned by a broker, otherwise they are not replayed as the client's
+// position within them is unknown. Messages delivered through more than one of the
+// channels are only replayed once. If the event store cannot be read, the in-memory
+// history is used instead.
+func (b *Broker) Replay(channelIDs []string, lastEventID string) []Message {
+	ts, timed := idTimestamp(lastEventID)
+	seen := make(map[string]bool)
+
+	var out []Message
+	for _, channelID := range channelIDs {
+		msgs, found, err := b.since(channelID, lastEventID, 0)
+
+		if err != nil {
+			b.log.WithError(err).WithField("channel", channelID).Error("failed to read event store")
+
+			msgs, found = b.history(channelID, lastEventID, b.replayLimit)
+			msgs = b.unexpired(msgs)
+		}
+
+		if !found && len(channelIDs) > 1 && !timed {
+			continue
+		}
+
+		for _, msg := range msgs {
+			if !found && len(channelIDs) > 1 {
+				if msgTS, ok := idTimestamp(msg.ID); !ok || msgTS <= ts {
+					continue
+				}
+			}
+
+			key := msg.Channel + "/" + msg.ID
+			if seen[key] {
+				continue
+			}
+
+			seen[key] = true
+			out = append(out, msg)
+		}
+	}
+
+	return out
+}
+
+// History returns the messages published to a channel after the message with the
+// given identifier. If the identifier is empty, all known messages are returned.
+// Messages are read from the event store if one is configured, otherwise from the
+// in-memory history. The in-memory history of wildcard subscriptions merges the
+// histories of every matching channel. The event store is keyed by the channels
+// messages were published to, so the history of wildcard subscriptions is always
+// read from memory. At most limit of the most recent messages are returned, or the
+// broker's replay limit if that is lower or no limit is given. The history size
+// and retention of a declared channel apply to messages read from the event store
+// too. Expired messages are omitted.
+func (b *Broker) History(channelID, since string, limit int) ([]Message, error) {
+	msgs, _, err := b.since(channelID, since, limit)
+
+	return msgs, err
+}
+
+// since returns the unexpired messages published to a channel after the message
+// with the given identifier and whether the identifier was found.
+func (b *Broker) since(channelID, id string, limit int) ([]Message, bool, error) {
+	if limit <= 0 || (b.replayLimit > 0 && limit > b.replayLimit) {
+		limit = b.replayLimit
+	}
+
+	var msgs []Message
+	var found bool
+
+	if b.store != nil && !IsWildcard(channelID) {
+		// The history size of a declared channel limits the events read from the
+		// store as it does the in-memory history.
+		cfg, declared := b.configs.get(channelID)
+		if declared && cfg.HistorySize > 0 && (limit <= 0 || cfg.HistorySize < limit) {
+			limit = cfg.HistorySize
+		}
+
+		var err error
+		if msgs, found, err = b.store.Since(channelID, id, limit); err != nil {
+			return nil, false, err
+		}
+
+		if declared && cfg.Retention > 0 {
+			msgs = retained(msgs, time.Duration(cfg.Retention)*time.Millisecond)
+		}
+	} else {
+		msgs, found = b.history(channelID, id, limit)
+	}
+
+	return b.unexpired(msgs), found, nil
+}
+
+// retained returns the messages read from the event store for a channel, unless
+// the newest was published longer ago than the channel's retention, after which
+// its in-memory history would have been removed. Only identifiers assigned by a
+// broker record when a message was published, so messages with other identifiers
+// are always returned.
+func retained(msgs []Message, retention time.Duration) []Message {
+	if len(msgs) == 0 {
+		return msgs
+	}
+
+	ts, ok := idTimestamp(msgs[len(msgs)-1].ID)
+
+	if ok && time.Since(time.Unix(0, ts)) > retention {
+		return nil
+	}
+
+	return msgs
+}
+
+// Expire records that a message was discarded because it expired before it could
+// be delivered.
+func (b *Broker) Expire(msg Message) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	b.expired[msg.Channel]++
+
+	b.log.WithFields(logrus.Fields{
+		"channel": msg.Channel,
+		"eventId": msg.ID,
+		"event":   msg.Event,
+	}).Info("discarded expired message")
+}
+
+func (b *Broker) unexpired(msgs []Message) []Message {
+	out := msgs[:0]
+	for _, msg := range msgs {
+		if msg.Expired() {
+			b.Expire(msg)
+			continue
+		}
+
+		out = append(out, msg)
+	}
+
+	return out
+}
+
+func (b *Broker) history(channelID, id string, limit int) ([]Message, bool) {
+	b.mux.Lock()
+
+	var entries []historyEntry
+	for name, h := range b.histories {
+		if Match(channelID, name) {
+			entries = append(entries, h.entries...)
+		}
+	}
+
+	b.mux.Unlock()
+
+	return since(entries, id, limit)
+}
+
+// RemoveClient removes a client from each of the given channels. If a channel has
+// no connected clients, it is also removed.
+func (b *Broker) RemoveClient(channelIDs []string, clientID string) {
+	b.mux.Lock()
+
+	left := make(map[string]*Client)
+	for _, channelID := range channelIDs {
+		if ch, ok := b.channels[channelID]; ok && b.presenceEnabled(channelID) {
+			if cl, ok := ch.client(clientID); ok {
+				left[channelID] = cl
+			}
+		}
+
+		b.removeClient(channelID, clientID)
+	}
+
+	b.detachInflight(clientID)
+	b.mux.Unlock()
+
+	if b.locations != nil {
+		b.locations.remove(clientID)
+	}
+
+	for _, channelID := range channelIDs {
+		if cl, ok := left[channelID]; ok {
+			b.publishPresence(channelID, EventPresenceLeave, cl)
+		}
+	}
+}
+
+func (b *Broker) removeClient(channelID, clientID string) {
+	channel, ok := b.channels[channelID]
+
+	if !ok {
+		return
+	}
+
+	channel.RemoveClient(clientID)
+
+	b.log.WithFields(logrus.Fields{
+		"channel": channelID,
+		"client":  clientID,
+	}).Info("removed client from channel")
+
+	if channel.NumClients() == 0 {
+		b.removeChannel(channelID)
+
+		b.log.WithFields(logrus.Fields{
+			"channel": channelID,
 		}).Info("removed empty channel")
 	}
 }
+
+func (b *Broker) removeChannel(channelID string) {
+	delete(b.channels, channelID)
+	b.forgetTurns(channelID)
+
+	if b.locations != nil {
+		b.locations.unsubscribe(channelID)
+	}
+}
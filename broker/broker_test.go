@@ -1,14 +1,24 @@
 package broker_test
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
 	"net"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"gopkg.in/h2non/gock.v1"
 
 	"github.com/davidsbond/sse-cluster/broker"
+	"github.com/davidsbond/sse-cluster/handler"
+	"github.com/gorilla/mux"
 	"github.com/hashicorp/memberlist"
 	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
@@ -50,7 +60,7 @@ func TestBroker_Publish(t *testing.T) {
 					},
 				})
 
-				g.Post("/publish").Reply(200)
+				g.Post("/channel/test/client/test$").Reply(200)
 			},
 		},
 		{
@@ -76,7 +86,7 @@ func TestBroker_Publish(t *testing.T) {
 					},
 				})
 
-				g.Post("/publish").Reply(200)
+				g.Post("/channel/test$").Reply(200)
 			},
 		},
 		{
@@ -101,7 +111,7 @@ func TestBroker_Publish(t *testing.T) {
 					},
 				})
 
-				g.Post("/publish").Reply(200)
+				g.Post("/channel$").Reply(200)
 			},
 		},
 	}
@@ -117,21 +127,25 @@ func TestBroker_Publish(t *testing.T) {
 			b := broker.New(m, http.DefaultClient)
 			defer b.Close()
 
-			c, err := b.NewClient(tc.Channel, tc.Client)
+			c, err := b.NewClient([]string{tc.Channel}, tc.Client)
 
 			if err != nil {
 				assert.Fail(t, err.Error())
 				return
 			}
 
-			if err := b.Publish(tc.Channel, tc.Client, tc.Message); err != nil {
+			if _, err := b.Publish(tc.Channel, tc.Client, tc.Message); err != nil {
 				assert.Fail(t, err.Error())
 				return
 			}
 
 			result := <-c.Messages()
 
-			assert.Equal(t, tc.Message, result)
+			expected := tc.Message
+			expected.Channel = tc.Channel
+			expected.Client = tc.Client
+
+			assert.Equal(t, expected, result)
 
 			<-time.After(time.Millisecond * 250)
 			assert.Equal(t, true, gock.IsDone())
@@ -185,7 +199,7 @@ func TestBroker_Status(t *testing.T) {
 			b := broker.New(m, http.DefaultClient)
 			defer b.Close()
 
-			if _, err := b.NewClient("test", "test"); err != nil {
+			if _, err := b.NewClient([]string{"test"}, "test"); err != nil {
 				assert.Fail(t, err.Error())
 				return
 			}
@@ -207,6 +221,82 @@ func TestBroker_Status(t *testing.T) {
 
 }
 
+func TestBroker_ClusterStatus(t *testing.T) {
+	t.Parallel()
+	logrus.SetLevel(logrus.PanicLevel)
+
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(broker.Status{
+			Goroutines: 10,
+			Channels: map[string][]string{
+				"test":  {"a", "b"},
+				"other": {"a"},
+			},
+		})
+	}))
+	defer fast.Close()
+
+	done := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-done
+	}))
+	defer slow.Close()
+	defer close(done)
+
+	member := func(name string, srv *httptest.Server) *memberlist.Node {
+		u, _ := url.Parse(srv.URL)
+
+		return &memberlist.Node{
+			Name: name,
+			Addr: net.ParseIP(u.Hostname()),
+			Meta: []byte(u.Port()),
+		}
+	}
+
+	m := &MockMemberlist{}
+	m.On("LocalNode").Return(&memberlist.Node{Name: "test"})
+	m.On("NumMembers").Return(3)
+	m.On("Members").Return([]*memberlist.Node{
+		{Name: "test"},
+		member("fast", fast),
+		member("slow", slow),
+	})
+
+	// Use a separate transport so requests aren't intercepted by gock
+	cl := &http.Client{Transport: &http.Transport{}}
+
+	b := broker.New(m, cl, broker.WithStatusTimeout(time.Millisecond*100))
+	defer b.Close()
+
+	if _, err := b.NewClient([]string{"test"}, "c"); err != nil {
+		assert.Fail(t, err.Error())
+		return
+	}
+
+	start := time.Now()
+	status := b.ClusterStatus()
+
+	assert.True(t, time.Since(start) < time.Second, "slow node delayed the response")
+
+	if assert.Contains(t, status.Nodes, "test") {
+		assert.Equal(t, map[string]int{"test": 1}, status.Nodes["test"].Channels)
+		assert.Equal(t, 1, status.Nodes["test"].Clients)
+	}
+
+	assert.Equal(t, &broker.NodeStatus{
+		Goroutines: 10,
+		Channels:   map[string]int{"test": 2, "other": 1},
+		Clients:    2,
+	}, status.Nodes["fast"])
+
+	assert.Contains(t, status.Unreachable, "slow")
+	assert.Equal(t, 2, status.Totals.Nodes)
+	assert.Equal(t, 1, status.Totals.Unreachable)
+	assert.Equal(t, 2, status.Totals.Channels)
+	assert.Equal(t, 3, status.Totals.Clients)
+	assert.Equal(t, 10+status.Nodes["test"].Goroutines, status.Totals.Goroutines)
+}
+
 func TestBroker_NewClient(t *testing.T) {
 	t.Parallel()
 	logrus.SetLevel(logrus.PanicLevel)
@@ -237,7 +327,7 @@ func TestBroker_NewClient(t *testing.T) {
 			b := broker.New(m, http.DefaultClient)
 			defer b.Close()
 
-			cl, err := b.NewClient(tc.Channel, tc.Client)
+			cl, err := b.NewClient([]string{tc.Channel}, tc.Client)
 
 			if err != nil {
 				assert.Fail(t, err.Error())
@@ -284,7 +374,7 @@ func TestBroker_RemoveClient(t *testing.T) {
 			b := broker.New(m, http.DefaultClient)
 			defer b.Close()
 
-			if _, err := b.NewClient(tc.Channel, tc.Client); err != nil {
+			if _, err := b.NewClient([]string{tc.Channel}, tc.Client); err != nil {
 				assert.Fail(t, err.Error())
 				return
 			}
@@ -292,10 +382,2706 @@ func TestBroker_RemoveClient(t *testing.T) {
 			status := b.Status()
 			assert.Len(t, status.Channels, 1)
 
-			b.RemoveClient(tc.Channel, tc.Client)
+			b.RemoveClient([]string{tc.Channel}, tc.Client)
 
 			status = b.Status()
 			assert.Len(t, status.Channels, 0)
 		})
 	}
 }
+
+func TestBroker_Replay(t *testing.T) {
+	t.Parallel()
+	logrus.SetLevel(logrus.PanicLevel)
+
+	tt := []struct {
+		Name             string
+		Channel          string
+		HistorySize      int
+		Messages         []broker.Message
+		LastEventID      string
+		ExpectedMessages []broker.Message
+	}{
+		{
+			Name:        "It should replay messages after the last event id",
+			Channel:     "test",
+			HistorySize: 10,
+			Messages: []broker.Message{
+				{ID: "1"},
+				{ID: "2"},
+				{ID: "3"},
+			},
+			LastEventID: "1",
+			ExpectedMessages: []broker.Message{
+				{ID: "2", Channel: "test"},
+				{ID: "3", Channel: "test"},
+			},
+		},
+		{
+			Name:        "It should replay all messages for an unknown id",
+			Channel:     "test",
+			HistorySize: 2,
+			Messages: []broker.Message{
+				{ID: "1"},
+				{ID: "2"},
+				{ID: "3"},
+			},
+			LastEventID: "1",
+			ExpectedMessages: []broker.Message{
+				{ID: "2", Channel: "test"},
+				{ID: "3", Channel: "test"},
+			},
+		},
+		{
+			Name:        "It should replay nothing for the latest id",
+			Channel:     "test",
+			HistorySize: 10,
+			Messages: []broker.Message{
+				{ID: "1"},
+			},
+			LastEventID: "1",
+		},
+		{
+			Name:        "It should replay all messages without an id",
+			Channel:     "test",
+			HistorySize: 10,
+			Messages: []broker.Message{
+				{ID: "1"},
+			},
+			ExpectedMessages: []broker.Message{
+				{ID: "1", Channel: "test"},
+			},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.Name, func(t *testing.T) {
+			m := &MockMemberlist{}
+			m.On("LocalNode").Return(&memberlist.Node{Name: "test"})
+			m.On("NumMembers").Return(1)
+
+			b := broker.New(m, http.DefaultClient, broker.WithHistorySize(tc.HistorySize))
+			defer b.Close()
+
+			cl, err := b.NewClient([]string{tc.Channel}, "test")
+
+			if err != nil {
+				assert.Fail(t, err.Error())
+				return
+			}
+
+			for _, msg := range tc.Messages {
+				if _, err := b.Publish(tc.Channel, "", msg); err != nil {
+					assert.Fail(t, err.Error())
+					return
+				}
+
+				<-cl.Messages()
+			}
+
+			assert.Equal(t, tc.ExpectedMessages, b.Replay([]string{tc.Channel}, tc.LastEventID))
+		})
+	}
+}
+
+func TestBroker_ReplayAfterReconnect(t *testing.T) {
+	t.Parallel()
+	logrus.SetLevel(logrus.PanicLevel)
+
+	m := &MockMemberlist{}
+	m.On("LocalNode").Return(&memberlist.Node{Name: "test"})
+	m.On("NumMembers").Return(1)
+	m.On("Members").Return([]*memberlist.Node{})
+
+	b := broker.New(m, http.DefaultClient)
+	defer b.Close()
+
+	cl, err := b.NewClient([]string{"test"}, "test")
+
+	if err != nil {
+		assert.Fail(t, err.Error())
+		return
+	}
+
+	if _, err := b.Publish("test", "", broker.Message{ID: "1"}); err != nil {
+		assert.Fail(t, err.Error())
+		return
+	}
+
+	lastEventID := (<-cl.Messages()).ID
+
+	// Disconnect the only client, which removes the channel, and publish while
+	// nobody is subscribed.
+	b.RemoveClient([]string{"test"}, "test")
+	assert.Len(t, b.Status().Channels, 0)
+
+	if _, err := b.Publish("test", "", broker.Message{ID: "2"}); err != nil {
+		assert.Fail(t, err.Error())
+		return
+	}
+
+	if _, err := b.NewClient([]string{"test"}, "test"); err != nil {
+		assert.Fail(t, err.Error())
+		return
+	}
+
+	expected := []broker.Message{
+		{ID: "2", Channel: "test"},
+	}
+
+	assert.Equal(t, expected, b.Replay([]string{"test"}, lastEventID))
+}
+
+func TestBroker_History(t *testing.T) {
+	t.Parallel()
+	logrus.SetLevel(logrus.PanicLevel)
+
+	tt := []struct {
+		Name             string
+		Channel          string
+		Config           broker.ChannelConfig
+		Message          broker.Message
+		Since            string
+		ExpectedMessages []broker.Message
+		ExpectationFunc  func(*mock.Mock)
+	}{
+		{
+			Name:    "It should write messages to and read history from the event store",
+			Channel: "test",
+			Message: broker.Message{ID: "2"},
+			Since:   "1",
+			ExpectedMessages: []broker.Message{
+				{ID: "2"},
+			},
+			ExpectationFunc: func(m *mock.Mock) {
+				m.On("Append", "test", broker.Message{ID: "2", Channel: "test"}).Return(nil)
+				m.On("Since", "test", "1", broker.DefaultReplayLimit).Return([]broker.Message{
+					{ID: "2"},
+				}, true, nil)
+			},
+		},
+		{
+			Name:    "It should read no more than a declared channel's history size from the event store",
+			Channel: "test",
+			Config:  broker.ChannelConfig{ID: "test", HistorySize: 5},
+			Message: broker.Message{ID: "2"},
+			Since:   "1",
+			ExpectedMessages: []broker.Message{
+				{ID: "2"},
+			},
+			ExpectationFunc: func(m *mock.Mock) {
+				m.On("Append", "test", broker.Message{ID: "2", Channel: "test"}).Return(nil)
+				m.On("Since", "test", "1", 5).Return([]broker.Message{
+					{ID: "2"},
+				}, true, nil)
+			},
+		},
+		{
+			Name:    "It should not read from the event store once a declared channel's retention has passed",
+			Channel: "test",
+			Config:  broker.ChannelConfig{ID: "test", Retention: 1000},
+			Message: broker.Message{ID: "0000000000000001-other"},
+			ExpectationFunc: func(m *mock.Mock) {
+				m.On("Append", "test", broker.Message{ID: "0000000000000001-other", Channel: "test"}).Return(nil)
+				m.On("Since", "test", "", broker.DefaultReplayLimit).Return([]broker.Message{
+					{ID: "0000000000000001-other"},
+				}, false, nil)
+			},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.Name, func(t *testing.T) {
+			m := &MockMemberlist{}
+			m.On("LocalNode").Return(&memberlist.Node{Name: "test"})
+			m.On("NumMembers").Return(1)
+
+			s := &MockEventStore{}
+			tc.ExpectationFunc(&s.Mock)
+
+			b := broker.New(m, http.DefaultClient, broker.WithEventStore(s))
+			defer b.Close()
+
+			if tc.Config.ID != "" {
+				if _, err := b.DeclareChannel(tc.Config); err != nil {
+					assert.Fail(t, err.Error())
+					return
+				}
+			}
+
+			if _, err := b.Publish(tc.Channel, "", tc.Message); err != nil {
+				assert.Fail(t, err.Error())
+				return
+			}
+
+			msgs, err := b.History(tc.Channel, tc.Since, 0)
+
+			if err != nil {
+				assert.Fail(t, err.Error())
+				return
+			}
+
+			assert.Equal(t, tc.ExpectedMessages, msgs)
+			s.AssertExpectations(t)
+		})
+	}
+}
+
+func TestBroker_PublishWildcard(t *testing.T) {
+	t.Parallel()
+	logrus.SetLevel(logrus.PanicLevel)
+
+	tt := []struct {
+		Name           string
+		Subscription   string
+		Channel        string
+		ExpectDelivery bool
+	}{
+		{
+			Name:           "It should deliver to single token wildcard subscriptions",
+			Subscription:   "orders.*.created",
+			Channel:        "orders.eu.created",
+			ExpectDelivery: true,
+		},
+		{
+			Name:           "It should deliver to trailing wildcard subscriptions",
+			Subscription:   "orders.>",
+			Channel:        "orders.eu.created",
+			ExpectDelivery: true,
+		},
+		{
+			Name:         "It should not deliver to subscriptions that don't match",
+			Subscription: "orders.*.deleted",
+			Channel:      "orders.eu.created",
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.Name, func(t *testing.T) {
+			m := &MockMemberlist{}
+			m.On("LocalNode").Return(&memberlist.Node{Name: "test"})
+			m.On("NumMembers").Return(1)
+
+			b := broker.New(m, http.DefaultClient)
+			defer b.Close()
+
+			cl, err := b.NewClient([]string{tc.Subscription}, "test")
+
+			if err != nil {
+				assert.Fail(t, err.Error())
+				return
+			}
+
+			msg := broker.Message{ID: "test"}
+			if _, err := b.Publish(tc.Channel, "", msg); err != nil {
+				assert.Fail(t, err.Error())
+				return
+			}
+
+			select {
+			case result := <-cl.Messages():
+				assert.True(t, tc.ExpectDelivery)
+				assert.Equal(t, tc.Channel, result.Channel)
+				assert.Equal(t, msg.ID, result.ID)
+			case <-time.After(time.Millisecond * 100):
+				assert.False(t, tc.ExpectDelivery)
+			}
+		})
+	}
+}
+
+func TestBroker_NewClientMultipleChannels(t *testing.T) {
+	t.Parallel()
+	logrus.SetLevel(logrus.PanicLevel)
+
+	tt := []struct {
+		Name     string
+		Channels []string
+		Client   string
+	}{
+		{
+			Name:     "It should subscribe a single client to many channels",
+			Channels: []string{"a", "b"},
+			Client:   "test",
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.Name, func(t *testing.T) {
+			m := &MockMemberlist{}
+			m.On("LocalNode").Return(&memberlist.Node{Name: "test"})
+			m.On("NumMembers").Return(1)
+			m.On("Members").Return([]*memberlist.Node{})
+
+			b := broker.New(m, http.DefaultClient)
+			defer b.Close()
+
+			cl, err := b.NewClient(tc.Channels, tc.Client)
+
+			if err != nil {
+				assert.Fail(t, err.Error())
+				return
+			}
+
+			for _, channel := range tc.Channels {
+				if _, err := b.Publish(channel, "", broker.Message{ID: channel}); err != nil {
+					assert.Fail(t, err.Error())
+					return
+				}
+
+				msg := <-cl.Messages()
+				assert.Equal(t, channel, msg.Channel)
+			}
+
+			assert.Len(t, b.Status().Channels, len(tc.Channels))
+
+			b.RemoveClient(tc.Channels, tc.Client)
+
+			assert.Len(t, b.Status().Channels, 0)
+		})
+	}
+}
+
+func TestBroker_PublishOverlappingChannels(t *testing.T) {
+	t.Parallel()
+	logrus.SetLevel(logrus.PanicLevel)
+
+	m := &MockMemberlist{}
+	m.On("LocalNode").Return(&memberlist.Node{Name: "test"})
+	m.On("NumMembers").Return(1)
+
+	b := broker.New(m, http.DefaultClient)
+	defer b.Close()
+
+	cl, err := b.NewClient([]string{"orders.>", "orders.created"}, "test", broker.WithBufferSize(2))
+
+	if err != nil {
+		assert.Fail(t, err.Error())
+		return
+	}
+
+	if _, err := b.Publish("orders.created", "", broker.Message{ID: "1"}); err != nil {
+		assert.Fail(t, err.Error())
+		return
+	}
+
+	if _, err := b.Publish("orders.created", "test", broker.Message{ID: "2"}); err != nil {
+		assert.Fail(t, err.Error())
+		return
+	}
+
+	// Messages are delivered asynchronously, so may arrive in any order.
+	var ids []string
+	for i := 0; i < 2; i++ {
+		select {
+		case msg := <-cl.Messages():
+			ids = append(ids, msg.ID)
+		case <-time.After(time.Millisecond * 100):
+			assert.Fail(t, "expected a message")
+		}
+	}
+
+	assert.ElementsMatch(t, []string{"1", "2"}, ids)
+
+	select {
+	case msg := <-cl.Messages():
+		assert.Fail(t, "received duplicate message "+msg.ID)
+	case <-time.After(time.Millisecond * 100):
+	}
+}
+
+func TestBroker_ReplayMultipleChannels(t *testing.T) {
+	t.Parallel()
+	logrus.SetLevel(logrus.PanicLevel)
+
+	tt := []struct {
+		Name        string
+		Channels    []string
+		Messages    []broker.Message
+		LastEventID int
+		ExpectedIDs []int
+	}{
+		{
+			Name:     "It should replay other channels from the time of the last event id",
+			Channels: []string{"a", "b"},
+			Messages: []broker.Message{
+				{Channel: "b"},
+				{Channel: "a"},
+				{Channel: "b"},
+				{Channel: "a"},
+			},
+			LastEventID: 1,
+			ExpectedIDs: []int{3, 2},
+		},
+		{
+			Name:     "It should not replay other channels for an unknown last event id",
+			Channels: []string{"a", "b"},
+			Messages: []broker.Message{
+				{ID: "1", Channel: "a"},
+				{ID: "2", Channel: "b"},
+				{ID: "3", Channel: "a"},
+			},
+			LastEventID: 0,
+			ExpectedIDs: []int{2},
+		},
+		{
+			Name:     "It should replay messages delivered through overlapping channels once",
+			Channels: []string{"a", "a.>"},
+			Messages: []broker.Message{
+				{Channel: "a.b"},
+				{Channel: "a.b"},
+			},
+			LastEventID: 0,
+			ExpectedIDs: []int{1},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.Name, func(t *testing.T) {
+			m := &MockMemberlist{}
+			m.On("LocalNode").Return(&memberlist.Node{Name: "test"})
+			m.On("NumMembers").Return(1)
+
+			b := broker.New(m, http.DefaultClient)
+			defer b.Close()
+
+			var ids []string
+			for _, msg := range tc.Messages {
+				id, err := b.Publish(msg.Channel, "", msg)
+
+				if err != nil {
+					assert.Fail(t, err.Error())
+					return
+				}
+
+				ids = append(ids, id)
+			}
+
+			var expected []string
+			for _, i := range tc.ExpectedIDs {
+				expected = append(expected, ids[i])
+			}
+
+			var actual []string
+			for _, msg := range b.Replay(tc.Channels, ids[tc.LastEventID]) {
+				actual = append(actual, msg.ID)
+			}
+
+			assert.Equal(t, expected, actual)
+		})
+	}
+}
+
+func TestBroker_PublishExpired(t *testing.T) {
+	t.Parallel()
+	logrus.SetLevel(logrus.PanicLevel)
+
+	past := time.Now().Add(-time.Minute)
+
+	tt := []struct {
+		Name            string
+		Channel         string
+		Message         broker.Message
+		Wait            time.Duration
+		ExpectDelivery  bool
+		ExpectedReplay  int
+		ExpectedExpired uint64
+	}{
+		{
+			Name:            "It should not deliver messages that have expired",
+			Channel:         "test",
+			Message:         broker.Message{ID: "1", ExpiresAt: &past},
+			ExpectedExpired: 1,
+		},
+		{
+			Name:           "It should deliver messages within their ttl",
+			Channel:        "test",
+			Message:        broker.Message{ID: "1", TTL: 60000},
+			ExpectDelivery: true,
+			ExpectedReplay: 1,
+		},
+		{
+			Name:            "It should not replay messages once their ttl elapses",
+			Channel:         "test",
+			Message:         broker.Message{ID: "1", TTL: 10},
+			Wait:            time.Millisecond * 50,
+			ExpectDelivery:  true,
+			ExpectedExpired: 1,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.Name, func(t *testing.T) {
+			m := &MockMemberlist{}
+			m.On("LocalNode").Return(&memberlist.Node{Name: "test"})
+			m.On("NumMembers").Return(1)
+			m.On("Members").Return([]*memberlist.Node{})
+
+			b := broker.New(m, http.DefaultClient)
+			defer b.Close()
+
+			cl, err := b.NewClient([]string{tc.Channel}, "test")
+
+			if err != nil {
+				assert.Fail(t, err.Error())
+				return
+			}
+
+			if _, err := b.Publish(tc.Channel, "", tc.Message); err != nil {
+				assert.Fail(t, err.Error())
+				return
+			}
+
+			select {
+			case result := <-cl.Messages():
+				assert.True(t, tc.ExpectDelivery)
+				assert.NotNil(t, result.ExpiresAt)
+			case <-time.After(time.Millisecond * 100):
+				assert.False(t, tc.ExpectDelivery)
+			}
+
+			<-time.After(tc.Wait)
+
+			assert.Len(t, b.Replay([]string{tc.Channel}, ""), tc.ExpectedReplay)
+			assert.Equal(t, tc.ExpectedExpired, b.Status().Expired[tc.Channel])
+		})
+	}
+}
+
+func TestBroker_PublishScheduled(t *testing.T) {
+	t.Parallel()
+	logrus.SetLevel(logrus.PanicLevel)
+
+	tt := []struct {
+		Name      string
+		Message   broker.Message
+		DeliverIn time.Duration
+	}{
+		{
+			Name:    "It should deliver messages after their delay",
+			Message: broker.Message{ID: "1", Delay: 100},
+		},
+		{
+			Name:      "It should deliver messages at their delivery time",
+			Message:   broker.Message{ID: "1"},
+			DeliverIn: time.Millisecond * 100,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.Name, func(t *testing.T) {
+			defer gock.Off()
+			gock.New("http://127.0.0.1:8080").
+				Post("/channel/test$").
+				Times(1).
+				Reply(200)
+
+			m := &MockMemberlist{}
+			m.On("LocalNode").Return(&memberlist.Node{Name: "test"})
+			m.On("NumMembers").Return(2)
+			m.On("Members").Return([]*memberlist.Node{
+				{
+					Name: "other",
+					Addr: net.ParseIP("127.0.0.1"),
+					Meta: []byte("8080"),
+				},
+			})
+
+			b := broker.New(m, http.DefaultClient)
+			defer b.Close()
+
+			cl, err := b.NewClient([]string{"test"}, "test")
+
+			if err != nil {
+				assert.Fail(t, err.Error())
+				return
+			}
+
+			if tc.DeliverIn > 0 {
+				deliverAt := time.Now().Add(tc.DeliverIn)
+				tc.Message.DeliverAt = &deliverAt
+			}
+
+			if _, err := b.Publish("test", "", tc.Message); err != nil {
+				assert.Fail(t, err.Error())
+				return
+			}
+
+			assert.Equal(t, 1, b.Status().Scheduled)
+
+			select {
+			case <-cl.Messages():
+				assert.Fail(t, "message delivered before it was due")
+				return
+			case <-time.After(time.Millisecond * 50):
+			}
+
+			// Other nodes are sent the message straight away, so they can deliver
+			// it if this node leaves.
+			assert.True(t, gock.IsDone())
+
+			select {
+			case msg := <-cl.Messages():
+				assert.Equal(t, tc.Message.ID, msg.ID)
+				assert.NotNil(t, msg.DeliverAt)
+			case <-time.After(time.Second):
+				assert.Fail(t, "scheduled message was not delivered")
+			}
+
+			assert.Equal(t, 0, b.Status().Scheduled)
+		})
+	}
+}
+
+func TestBroker_PublishAssignsIDs(t *testing.T) {
+	t.Parallel()
+	logrus.SetLevel(logrus.PanicLevel)
+
+	tt := []struct {
+		Name     string
+		Messages []broker.Message
+	}{
+		{
+			Name: "It should assign increasing identifiers",
+			Messages: []broker.Message{
+				{Event: "a"},
+				{Event: "b"},
+				{Event: "c"},
+			},
+		},
+		{
+			Name: "It should assign identifiers after those provided",
+			Messages: []broker.Message{
+				{ID: "7fffffffffff0000-other"},
+				{Event: "b"},
+			},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.Name, func(t *testing.T) {
+			m := &MockMemberlist{}
+			m.On("LocalNode").Return(&memberlist.Node{Name: "test"})
+			m.On("NumMembers").Return(1)
+
+			b := broker.New(m, http.DefaultClient)
+			defer b.Close()
+
+			var last string
+			for _, msg := range tc.Messages {
+				id, err := b.Publish("test", "", msg)
+
+				if err != nil {
+					assert.Fail(t, err.Error())
+					return
+				}
+
+				if msg.ID != "" {
+					assert.Equal(t, msg.ID, id)
+				}
+
+				assert.True(t, id > last, "expected %s to sort after %s", id, last)
+				last = id
+			}
+		})
+	}
+}
+
+func TestBroker_PublishDuplicate(t *testing.T) {
+	t.Parallel()
+	logrus.SetLevel(logrus.PanicLevel)
+
+	tt := []struct {
+		Name              string
+		Window            time.Duration
+		Messages          []broker.Message
+		ExpectedDuplicate []bool
+	}{
+		{
+			Name:   "It should discard messages with the same id",
+			Window: time.Minute,
+			Messages: []broker.Message{
+				{ID: "1"},
+				{ID: "1"},
+				{ID: "2"},
+			},
+			ExpectedDuplicate: []bool{false, true, false},
+		},
+		{
+			Name:   "It should discard messages with the same idempotency key",
+			Window: time.Minute,
+			Messages: []broker.Message{
+				{IdempotencyKey: "a"},
+				{IdempotencyKey: "a"},
+			},
+			ExpectedDuplicate: []bool{false, true},
+		},
+		{
+			Name: "It should not discard messages when disabled",
+			Messages: []broker.Message{
+				{ID: "1"},
+				{ID: "1"},
+			},
+			ExpectedDuplicate: []bool{false, false},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.Name, func(t *testing.T) {
+			m := &MockMemberlist{}
+			m.On("LocalNode").Return(&memberlist.Node{Name: "test"})
+			m.On("NumMembers").Return(1)
+
+			b := broker.New(m, http.DefaultClient, broker.WithDedupWindow(tc.Window))
+			defer b.Close()
+
+			var ids []string
+			for i, msg := range tc.Messages {
+				id, err := b.Publish("test", "", msg)
+
+				assert.Equal(t, tc.ExpectedDuplicate[i], err == broker.ErrDuplicate)
+
+				if err == broker.ErrDuplicate {
+					assert.Equal(t, ids[len(ids)-1], id)
+				}
+
+				ids = append(ids, id)
+			}
+		})
+	}
+}
+
+func TestBroker_PublishDuplicateStoreFailure(t *testing.T) {
+	t.Parallel()
+	logrus.SetLevel(logrus.PanicLevel)
+
+	m := &MockMemberlist{}
+	m.On("LocalNode").Return(&memberlist.Node{Name: "test"})
+	m.On("NumMembers").Return(1)
+
+	s := &MockEventStore{}
+	s.On("Append", "test", mock.Anything).Return(errors.New("error")).Once()
+	s.On("Append", "test", mock.Anything).Return(nil).Once()
+
+	b := broker.New(m, http.DefaultClient, broker.WithDedupWindow(time.Minute), broker.WithEventStore(s))
+	defer b.Close()
+
+	_, err := b.Publish("test", "", broker.Message{ID: "1"})
+	assert.Error(t, err)
+	assert.NotEqual(t, broker.ErrDuplicate, err)
+
+	// The first attempt wasn't published, so the retry must not be discarded
+	_, err = b.Publish("test", "", broker.Message{ID: "1"})
+	assert.NoError(t, err)
+
+	_, err = b.Publish("test", "", broker.Message{ID: "1"})
+	assert.Equal(t, broker.ErrDuplicate, err)
+
+	s.AssertExpectations(t)
+}
+
+func TestBroker_PublishBatchDuplicates(t *testing.T) {
+	t.Parallel()
+	logrus.SetLevel(logrus.PanicLevel)
+
+	var mux sync.Mutex
+	requests := make(map[string]int)
+
+	cl := &http.Client{
+		Transport: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+			var reqs []broker.DedupRequest
+			if err := json.NewDecoder(r.Body).Decode(&reqs); err != nil {
+				return nil, err
+			}
+
+			mux.Lock()
+			requests[r.URL.Host]++
+			mux.Unlock()
+
+			resps := make([]broker.DedupResponse, len(reqs))
+			for i, req := range reqs {
+				resps[i] = broker.DedupResponse{ID: "original-" + req.ID, Duplicate: true}
+			}
+
+			data, _ := json.Marshal(resps)
+
+			return &http.Response{
+				StatusCode: http.StatusOK,
+				Body:       ioutil.NopCloser(strings.NewReader(string(data))),
+			}, nil
+		}),
+	}
+
+	m := &MockMemberlist{}
+	m.On("LocalNode").Return(&memberlist.Node{Name: "test"})
+	m.On("NumMembers").Return(3)
+	m.On("Members").Return([]*memberlist.Node{
+		{Name: "a", Addr: net.ParseIP("127.0.0.1"), Meta: []byte("8080")},
+		{Name: "b", Addr: net.ParseIP("127.0.0.2"), Meta: []byte("8080")},
+	})
+
+	b := broker.New(m, cl, broker.WithDedupWindow(time.Minute))
+	defer b.Close()
+
+	// Keys are owned by either node depending on their hash, so use enough that
+	// both own at least one.
+	var msgs []broker.Message
+	for _, id := range []string{"1", "2", "3", "4", "5", "6"} {
+		msgs = append(msgs, broker.Message{ID: id, Channel: "test"})
+	}
+
+	for i, result := range b.PublishBatch(msgs) {
+		assert.Equal(t, broker.ErrDuplicate, result.Err)
+		assert.Equal(t, "original-"+msgs[i].ID, result.ID)
+	}
+
+	// Each owner is asked about all of its keys at once
+	assert.Equal(t, map[string]int{"127.0.0.1:8080": 1, "127.0.0.2:8080": 1}, requests)
+}
+
+func TestBroker_PublishDuplicateAcrossNodes(t *testing.T) {
+	t.Parallel()
+	logrus.SetLevel(logrus.PanicLevel)
+
+	// Gock intercepts the default transport, so the nodes talk to each other using
+	// their own.
+	cl := &http.Client{Transport: &http.Transport{}}
+
+	nodes := make([]*memberlist.Node, 2)
+	routers := make([]*mux.Router, 2)
+
+	for i := range nodes {
+		routers[i] = mux.NewRouter()
+
+		svr := httptest.NewServer(routers[i])
+		defer svr.Close()
+
+		u, err := url.Parse(svr.URL)
+
+		if err != nil {
+			assert.Fail(t, err.Error())
+			return
+		}
+
+		nodes[i] = &memberlist.Node{
+			Name: fmt.Sprintf("node-%d", i),
+			Addr: net.ParseIP("127.0.0.1"),
+			Meta: []byte(u.Port()),
+		}
+	}
+
+	brokers := make([]*broker.Broker, 2)
+
+	for i := range nodes {
+		m := &MockMemberlist{}
+		m.On("LocalNode").Return(nodes[i])
+		m.On("NumMembers").Return(len(nodes))
+		m.On("Members").Return(nodes)
+
+		brokers[i] = broker.New(m, cl, broker.WithDedupWindow(time.Minute))
+		defer brokers[i].Close()
+
+		h := handler.New(brokers[i])
+		routers[i].HandleFunc("/channel/{channel}", h.Publish).Methods("POST")
+		routers[i].HandleFunc("/dedup", h.Dedup).Methods("POST")
+	}
+
+	sub, err := brokers[1].NewClient([]string{"test"}, "test", broker.WithBufferSize(10))
+
+	if err != nil {
+		assert.Fail(t, err.Error())
+		return
+	}
+
+	// Keys are owned by either node depending on their hash, so use enough that
+	// both own at least one.
+	keys := []string{"a", "b", "c", "d", "e", "f"}
+
+	for _, key := range keys {
+		id, err := brokers[0].Publish("test", "", broker.Message{IdempotencyKey: key})
+
+		if err != nil {
+			assert.Fail(t, err.Error())
+			return
+		}
+
+		// Retry immediately on the other node, before the original has been
+		// propagated to it.
+		retryID, err := brokers[1].Publish("test", "", broker.Message{IdempotencyKey: key})
+
+		assert.Equal(t, broker.ErrDuplicate, err, key)
+		assert.Equal(t, id, retryID, key)
+	}
+
+	// Only the originals reach the subscriber on the second node, via propagation.
+	for range keys {
+		select {
+		case <-sub.Messages():
+		case <-time.After(time.Second):
+			assert.Fail(t, "expected a propagated message")
+			return
+		}
+	}
+
+	select {
+	case msg := <-sub.Messages():
+		assert.Fail(t, "received duplicate message "+msg.ID)
+	case <-time.After(time.Millisecond * 100):
+	}
+}
+
+func TestBroker_Clients(t *testing.T) {
+	t.Parallel()
+	logrus.SetLevel(logrus.PanicLevel)
+
+	defer gock.Off()
+	gock.New("http://127.0.0.1:8080").
+		Get("/channel/test/clients").
+		MatchParam("local", "true").
+		MatchHeader("Authorization", "Bearer secret").
+		Times(1).
+		Reply(200).
+		JSON(broker.ClientList{
+			Clients: []broker.Presence{
+				{ID: "remote", Node: "other", Channels: []string{"test"}},
+			},
+		})
+
+	// The node that has left cannot be reached
+	gock.New("http://127.0.0.2:8080").
+		Get("/channel/test/clients").
+		Times(1).
+		ReplyError(errors.New("connection refused"))
+
+	m := &MockMemberlist{}
+	m.On("LocalNode").Return(&memberlist.Node{Name: "test"})
+	m.On("NumMembers").Return(3)
+	m.On("Members").Return([]*memberlist.Node{
+		{Name: "test"},
+		{
+			Name: "other",
+			Addr: net.ParseIP("127.0.0.1"),
+			Meta: []byte("8080"),
+		},
+		{
+			Name: "gone",
+			Addr: net.ParseIP("127.0.0.2"),
+			Meta: []byte("8080"),
+		},
+	})
+
+	b := broker.New(m, http.DefaultClient)
+	defer b.Close()
+
+	metadata := map[string]string{"name": "alice"}
+	if _, err := b.NewClient([]string{"test", "test.>"}, "local", broker.WithMetadata(metadata)); err != nil {
+		assert.Fail(t, err.Error())
+		return
+	}
+
+	expected := []broker.Presence{
+		{ID: "remote", Node: "other", Channels: []string{"test"}},
+		{ID: "local", Node: "test", Channels: []string{"test"}, Metadata: metadata},
+	}
+
+	clients := b.Clients("test", "secret", 0)
+	assert.Equal(t, expected, clients.Clients)
+	assert.Contains(t, clients.Unreachable, "gone")
+	assert.True(t, gock.IsDone())
+
+	// The other node is only asked once, later lookups are served from the cache
+	assert.Equal(t, expected, b.Clients("test", "secret", time.Minute).Clients)
+}
+
+func TestBroker_ClientsTimeout(t *testing.T) {
+	t.Parallel()
+	logrus.SetLevel(logrus.PanicLevel)
+
+	done := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-done
+	}))
+	defer slow.Close()
+	defer close(done)
+
+	u, _ := url.Parse(slow.URL)
+
+	m := &MockMemberlist{}
+	m.On("LocalNode").Return(&memberlist.Node{Name: "test"})
+	m.On("NumMembers").Return(2)
+	m.On("Members").Return([]*memberlist.Node{
+		{Name: "test"},
+		{Name: "slow", Addr: net.ParseIP(u.Hostname()), Meta: []byte(u.Port())},
+	})
+
+	// Use a separate transport so requests aren't intercepted by gock
+	cl := &http.Client{Transport: &http.Transport{}}
+
+	b := broker.New(m, cl, broker.WithStatusTimeout(time.Millisecond*100))
+	defer b.Close()
+
+	start := time.Now()
+	clients := b.Clients("test", "", 0)
+
+	assert.True(t, time.Since(start) < time.Second, "slow node delayed the response")
+	assert.Empty(t, clients.Clients)
+	assert.Contains(t, clients.Unreachable, "slow")
+}
+
+func TestBroker_PresenceEvents(t *testing.T) {
+	t.Parallel()
+	logrus.SetLevel(logrus.PanicLevel)
+
+	// Each event is published by the node the client is connected to and sent to
+	// the other node once.
+	defer gock.Off()
+	gock.New("http://127.0.0.1:8080").
+		Post("/channel/rooms.1$").
+		Times(3).
+		Reply(200)
+
+	m := &MockMemberlist{}
+	m.On("LocalNode").Return(&memberlist.Node{Name: "test"})
+	m.On("NumMembers").Return(2)
+	m.On("Members").Return([]*memberlist.Node{
+		{
+			Name: "other",
+			Addr: net.ParseIP("127.0.0.1"),
+			Meta: []byte("8080"),
+		},
+	})
+
+	b := broker.New(m, http.DefaultClient, broker.WithPresenceEvents("rooms.>"))
+	defer b.Close()
+
+	watcher, err := b.NewClient([]string{"rooms.1", "lobby"}, "watcher")
+
+	if err != nil {
+		assert.Fail(t, err.Error())
+		return
+	}
+
+	expected := broker.Presence{
+		ID:       "alice",
+		Node:     "test",
+		Channels: []string{"rooms.1"},
+		Metadata: map[string]string{"name": "alice"},
+	}
+
+	alice, err := b.NewClient([]string{"rooms.1", "lobby"}, "alice", broker.WithMetadata(expected.Metadata))
+
+	if err != nil {
+		assert.Fail(t, err.Error())
+		return
+	}
+
+	assertPresence := func(event string) {
+		select {
+		case msg := <-watcher.Messages():
+			var actual broker.Presence
+			if err := json.Unmarshal(msg.Data, &actual); err != nil {
+				assert.Fail(t, err.Error())
+				return
+			}
+
+			assert.Equal(t, event, msg.Event)
+			assert.Equal(t, "rooms.1", msg.Channel)
+			assert.Equal(t, expected, actual)
+		case <-time.After(time.Second):
+			assert.Fail(t, "presence event was not delivered")
+		}
+	}
+
+	assertPresence(broker.EventPresenceJoin)
+
+	// The watcher's join may be dispatched after alice subscribed, but alice never
+	// receives its own.
+	timeout := time.After(time.Millisecond * 50)
+	for done := false; !done; {
+		select {
+		case msg := <-alice.Messages():
+			assert.NotContains(t, string(msg.Data), `"id":"alice"`)
+		case <-timeout:
+			done = true
+		}
+	}
+
+	b.RemoveClient([]string{"rooms.1", "lobby"}, "alice")
+	assertPresence(broker.EventPresenceLeave)
+
+	// Channels that don't publish presence events are unaffected.
+	select {
+	case msg := <-watcher.Messages():
+		assert.Fail(t, "unexpected presence event", msg.Event)
+	case <-time.After(time.Millisecond * 50):
+	}
+
+	assert.True(t, gock.IsDone())
+}
+
+func TestBroker_PublishToClientLocation(t *testing.T) {
+	t.Parallel()
+	logrus.SetLevel(logrus.PanicLevel)
+
+	tt := []struct {
+		Name          string
+		Client        string
+		BeenTo        []string
+		ExpectedError error
+		ExpectedSent  bool
+		ExpectedLocal bool
+		LeaveFunc     func(*broker.Locations)
+	}{
+		{
+			Name:         "It should send messages straight to the client's node",
+			Client:       "remote",
+			ExpectedSent: true,
+		},
+		{
+			Name:          "It should deliver messages to local clients without sending them",
+			Client:        "local",
+			ExpectedLocal: true,
+		},
+		{
+			Name:          "It should return an error if no node holds the client",
+			Client:        "missing",
+			ExpectedError: broker.ErrClientNotFound,
+		},
+		{
+			Name:   "It should not send messages from other nodes on to the client's node",
+			Client: "remote",
+			BeenTo: []string{"other"},
+		},
+		{
+			Name:          "It should deliver messages from other nodes to local clients",
+			Client:        "local",
+			BeenTo:        []string{"another"},
+			ExpectedLocal: true,
+		},
+		{
+			Name:          "It should forget the clients of nodes that leave",
+			Client:        "remote",
+			ExpectedError: broker.ErrClientNotFound,
+			LeaveFunc: func(l *broker.Locations) {
+				l.NotifyLeave(&memberlist.Node{Name: "another"})
+			},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.Name, func(t *testing.T) {
+			defer gock.Off()
+			// The client's node is sent the message instead of the next node
+			gock.New("http://127.0.0.2:8080").
+				Post("/channel/test/client/remote$").
+				Reply(200)
+
+			m := &MockMemberlist{}
+			m.On("LocalNode").Return(&memberlist.Node{Name: "test"})
+			m.On("NumMembers").Return(3)
+			m.On("Members").Return([]*memberlist.Node{
+				{Name: "test"},
+				{
+					Name: "other",
+					Addr: net.ParseIP("127.0.0.1"),
+					Meta: []byte("8080"),
+				},
+				{
+					Name: "another",
+					Addr: net.ParseIP("127.0.0.2"),
+					Meta: []byte("8080"),
+				},
+			})
+
+			locations := broker.NewLocations("test", nil)
+			locations.MergeRemoteState([]byte(`{"node":"another","clients":["remote"]}`), false)
+
+			if tc.LeaveFunc != nil {
+				tc.LeaveFunc(locations)
+			}
+
+			b := broker.New(m, http.DefaultClient, broker.WithLocations(locations))
+
+			cl, err := b.NewClient([]string{"test"}, "local")
+
+			if err != nil {
+				assert.Fail(t, err.Error())
+				return
+			}
+
+			_, err = b.Publish("test", tc.Client, broker.Message{ID: "1", BeenTo: tc.BeenTo})
+			b.Close()
+
+			assert.Equal(t, tc.ExpectedError, err)
+			assert.Equal(t, tc.ExpectedSent, gock.IsDone())
+
+			select {
+			case <-cl.Messages():
+				assert.True(t, tc.ExpectedLocal)
+			default:
+				assert.False(t, tc.ExpectedLocal)
+			}
+		})
+	}
+}
+
+func TestLocations_State(t *testing.T) {
+	t.Parallel()
+	logrus.SetLevel(logrus.PanicLevel)
+
+	m := &MockMemberlist{}
+	m.On("LocalNode").Return(&memberlist.Node{Name: "test"})
+
+	locations := broker.NewLocations("test", []byte("8080"))
+	b := broker.New(m, http.DefaultClient, broker.WithLocations(locations))
+	defer b.Close()
+
+	assert.Equal(t, []byte("8080"), locations.NodeMeta(512))
+
+	if _, err := b.NewClient([]string{"a"}, "client"); err != nil {
+		assert.Fail(t, err.Error())
+		return
+	}
+
+	messages := func() []string {
+		var out []string
+		for _, msg := range locations.GetBroadcasts(0, 1024) {
+			out = append(out, string(msg))
+		}
+
+		return out
+	}
+
+	// Connections and channels are broadcast to other nodes and included in the
+	// node's state
+	assert.ElementsMatch(t, []string{
+		`l{"node":"test","client":"client","connected":true}`,
+		`l{"node":"test","channel":"a","connected":true}`,
+	}, messages())
+
+	assert.JSONEq(t, `{"node":"test","clients":["client"],"channels":["a"]}`, string(locations.LocalState(false)))
+
+	b.RemoveClient([]string{"a"}, "client")
+
+	assert.ElementsMatch(t, []string{
+		`l{"node":"test","client":"client","connected":false}`,
+		`l{"node":"test","channel":"a","connected":false}`,
+	}, messages())
+
+	assert.JSONEq(t, `{"node":"test","clients":null,"channels":null}`, string(locations.LocalState(false)))
+}
+
+func TestBroker_PublishInterest(t *testing.T) {
+	t.Parallel()
+	logrus.SetLevel(logrus.PanicLevel)
+
+	tt := []struct {
+		Name         string
+		Channel      string
+		ExpectedHost string
+		Known        bool
+	}{
+		{
+			Name:         "It should send messages to nodes with matching wildcard subscriptions",
+			Channel:      "orders.created",
+			ExpectedHost: "127.0.0.1",
+		},
+		{
+			Name:         "It should skip nodes without subscribers",
+			Channel:      "chat",
+			ExpectedHost: "127.0.0.2",
+		},
+		{
+			Name:         "It should send messages to nodes whose channels are unknown",
+			Channel:      "sparse",
+			ExpectedHost: "127.0.0.3",
+		},
+		{
+			Name:    "It should not send messages if no node has subscribers",
+			Channel: "sparse",
+			Known:   true,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.Name, func(t *testing.T) {
+			var hosts []string
+			cl := &http.Client{
+				Transport: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+					hosts = append(hosts, r.URL.Hostname())
+
+					return &http.Response{
+						StatusCode: http.StatusOK,
+						Body:       ioutil.NopCloser(strings.NewReader("{}")),
+					}, nil
+				}),
+			}
+
+			m := &MockMemberlist{}
+			m.On("LocalNode").Return(&memberlist.Node{Name: "test"})
+			m.On("NumMembers").Return(4)
+			m.On("Members").Return([]*memberlist.Node{
+				{Name: "orders", Addr: net.ParseIP("127.0.0.1"), Meta: []byte("8080")},
+				{Name: "chat", Addr: net.ParseIP("127.0.0.2"), Meta: []byte("8080")},
+				{Name: "new", Addr: net.ParseIP("127.0.0.3"), Meta: []byte("8080")},
+			})
+
+			locations := broker.NewLocations("test", nil)
+			locations.MergeRemoteState([]byte(`{"node":"orders","channels":["orders.>"]}`), false)
+			locations.NotifyMsg([]byte(`l{"node":"chat","channel":"chat","connected":true}`))
+
+			if tc.Known {
+				locations.MergeRemoteState([]byte(`{"node":"new"}`), false)
+			}
+
+			b := broker.New(m, cl, broker.WithLocations(locations))
+
+			_, err := b.Publish(tc.Channel, "", broker.Message{ID: "1"})
+			b.Close()
+
+			assert.NoError(t, err)
+
+			if tc.ExpectedHost == "" {
+				assert.Empty(t, hosts)
+			} else {
+				assert.Equal(t, []string{tc.ExpectedHost}, hosts)
+			}
+		})
+	}
+}
+
+func TestBroker_PublishFanOut(t *testing.T) {
+	t.Parallel()
+	logrus.SetLevel(logrus.PanicLevel)
+
+	tt := []struct {
+		Name        string
+		PublishFunc func(*broker.Broker) error
+		ExpectedURL string
+	}{
+		{
+			Name: "It should send messages to every node",
+			PublishFunc: func(b *broker.Broker) error {
+				_, err := b.Publish("test", "", broker.Message{ID: "1"})
+				return err
+			},
+			ExpectedURL: "/channel/test",
+		},
+		{
+			Name: "It should send batches to every node",
+			PublishFunc: func(b *broker.Broker) error {
+				for _, res := range b.PublishBatch([]broker.Message{{ID: "1", Channel: "test"}}) {
+					if res.Err != nil {
+						return res.Err
+					}
+				}
+
+				return nil
+			},
+			ExpectedURL: "/batch",
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.Name, func(t *testing.T) {
+			var mux sync.Mutex
+			var beenTo [][]string
+			hosts := make(map[string]string)
+
+			cl := &http.Client{
+				Transport: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+					var msgs []broker.Message
+					if r.URL.Path == "/batch" {
+						json.NewDecoder(r.Body).Decode(&msgs)
+					} else {
+						var msg broker.Message
+						json.NewDecoder(r.Body).Decode(&msg)
+						msgs = append(msgs, msg)
+					}
+
+					mux.Lock()
+					hosts[r.URL.Hostname()] = r.URL.Path
+					for _, msg := range msgs {
+						beenTo = append(beenTo, msg.BeenTo)
+					}
+					mux.Unlock()
+
+					// The third node is unavailable
+					code := http.StatusOK
+					if r.URL.Hostname() == "127.0.0.3" {
+						code = http.StatusInternalServerError
+					}
+
+					return &http.Response{
+						StatusCode: code,
+						Body:       ioutil.NopCloser(strings.NewReader("{}")),
+					}, nil
+				}),
+			}
+
+			m := &MockMemberlist{}
+			m.On("LocalNode").Return(&memberlist.Node{Name: "test"})
+			m.On("NumMembers").Return(4)
+			m.On("Members").Return([]*memberlist.Node{
+				{Name: "a", Addr: net.ParseIP("127.0.0.1"), Meta: []byte("8080")},
+				{Name: "b", Addr: net.ParseIP("127.0.0.2"), Meta: []byte("8080")},
+				{Name: "c", Addr: net.ParseIP("127.0.0.3"), Meta: []byte("8080")},
+			})
+
+			b := broker.New(m, cl, broker.WithPropagation(broker.PropagationFanOut, 2))
+
+			err := tc.PublishFunc(b)
+			b.Close()
+
+			assert.NoError(t, err)
+			assert.Equal(t, map[string]string{
+				"127.0.0.1": tc.ExpectedURL,
+				"127.0.0.2": tc.ExpectedURL,
+				"127.0.0.3": tc.ExpectedURL,
+			}, hosts)
+
+			// Recipients know every node was sent the message, so they don't
+			// forward it again.
+			for _, nodes := range beenTo {
+				assert.ElementsMatch(t, []string{"test", "a", "b", "c"}, nodes)
+			}
+
+			status := b.Status()
+			assert.Equal(t, map[string]uint64{"a": 1, "b": 1}, status.Propagated)
+			assert.Equal(t, map[string]uint64{"c": 1}, status.PropagationFailures)
+		})
+	}
+}
+
+func TestBroker_PublishGossip(t *testing.T) {
+	t.Parallel()
+	logrus.SetLevel(logrus.PanicLevel)
+
+	tt := []struct {
+		Name        string
+		PublishFunc func(*broker.Broker) error
+	}{
+		{
+			Name: "It should send messages through the memberlist",
+			PublishFunc: func(b *broker.Broker) error {
+				_, err := b.Publish("test", "", broker.Message{ID: "1"})
+				return err
+			},
+		},
+		{
+			Name: "It should send batches through the memberlist",
+			PublishFunc: func(b *broker.Broker) error {
+				return b.PublishBatch([]broker.Message{{ID: "1", Channel: "test"}})[0].Err
+			},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.Name, func(t *testing.T) {
+			// Nodes shouldn't use HTTP to send messages to each other
+			cl := &http.Client{
+				Transport: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+					return nil, errors.New("unexpected http request")
+				}),
+			}
+
+			other := &memberlist.Node{Name: "other"}
+			otherLocations := broker.NewLocations("other", nil)
+
+			m := &MockMemberlist{}
+			m.On("LocalNode").Return(&memberlist.Node{Name: "test"})
+			m.On("NumMembers").Return(2)
+			m.On("Members").Return([]*memberlist.Node{other})
+			m.On("SendReliable", other, mock.Anything).Return(nil).Run(func(args mock.Arguments) {
+				otherLocations.NotifyMsg(args.Get(1).([]byte))
+			})
+
+			om := &MockMemberlist{}
+			om.On("LocalNode").Return(other)
+			om.On("NumMembers").Return(2)
+			om.On("Members").Return([]*memberlist.Node{{Name: "test"}})
+
+			b := broker.New(m, cl,
+				broker.WithLocations(broker.NewLocations("test", nil)),
+				broker.WithTransport(broker.TransportGossip),
+			)
+
+			ob := broker.New(om, cl,
+				broker.WithLocations(otherLocations),
+				broker.WithTransport(broker.TransportGossip),
+			)
+
+			sub, err := ob.NewClient([]string{"test"}, "test")
+
+			if err != nil {
+				assert.Fail(t, err.Error())
+				return
+			}
+
+			assert.NoError(t, tc.PublishFunc(b))
+			b.Close()
+			ob.Close()
+
+			select {
+			case msg := <-sub.Messages():
+				assert.Equal(t, "1", msg.ID)
+				assert.Equal(t, []string{"test"}, msg.BeenTo)
+			default:
+				assert.Fail(t, "message was not received by the other node")
+			}
+
+			m.AssertExpectations(t)
+		})
+	}
+}
+
+func TestBroker_PublishBatch(t *testing.T) {
+	t.Parallel()
+	logrus.SetLevel(logrus.PanicLevel)
+
+	tt := []struct {
+		Name            string
+		Messages        []broker.Message
+		ExpectedErrors  []bool
+		ExpectedMessage int
+	}{
+		{
+			Name: "It should publish each message and forward them as a batch",
+			Messages: []broker.Message{
+				{ID: "1", Channel: "a"},
+				{ID: "2", Channel: "b"},
+				{ID: "3", Channel: "a", Client: "test"},
+				{ID: "4", Channel: "a.*"},
+			},
+			ExpectedErrors:  []bool{false, false, false, true},
+			ExpectedMessage: 2,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.Name, func(t *testing.T) {
+			defer gock.Off()
+			gock.New("http://127.0.0.1:8080").
+				Post("/batch").
+				Times(1).
+				Reply(200)
+
+			m := &MockMemberlist{}
+			m.On("LocalNode").Return(&memberlist.Node{Name: "test"})
+			m.On("NumMembers").Return(2)
+			m.On("Members").Return([]*memberlist.Node{
+				{
+					Name: "other",
+					Addr: net.ParseIP("127.0.0.1"),
+					Meta: []byte("8080"),
+				},
+			})
+
+			b := broker.New(m, http.DefaultClient, broker.WithChannelOptions(
+				broker.WithClientOptions(broker.WithBufferSize(len(tc.Messages))),
+			))
+			defer b.Close()
+
+			cl, err := b.NewClient([]string{"a"}, "test")
+
+			if err != nil {
+				assert.Fail(t, err.Error())
+				return
+			}
+
+			results := b.PublishBatch(tc.Messages)
+
+			for i, result := range results {
+				assert.Equal(t, tc.ExpectedErrors[i], result.Err != nil)
+			}
+
+			<-time.After(time.Millisecond * 250)
+
+			assert.Len(t, cl.Messages(), tc.ExpectedMessage)
+			assert.True(t, gock.IsDone())
+		})
+	}
+}
+
+func TestBroker_PublishPeer(t *testing.T) {
+	t.Parallel()
+	logrus.SetLevel(logrus.PanicLevel)
+
+	tt := []struct {
+		Name          string
+		PeerPort      int
+		PeerErr       error
+		PublishFunc   func(*broker.Broker) error
+		ExpectedPeer  bool
+		ExpectedHosts []string
+	}{
+		{
+			Name:     "It should send messages over a peer connection",
+			PeerPort: 7947,
+			PublishFunc: func(b *broker.Broker) error {
+				_, err := b.Publish("test", "", broker.Message{ID: "1"})
+				return err
+			},
+			ExpectedPeer: true,
+		},
+		{
+			Name:     "It should send batches over a peer connection",
+			PeerPort: 7947,
+			PublishFunc: func(b *broker.Broker) error {
+				return b.PublishBatch([]broker.Message{{ID: "1", Channel: "test"}})[0].Err
+			},
+			ExpectedPeer: true,
+		},
+		{
+			Name:     "It should use http when the peer connection fails",
+			PeerPort: 7947,
+			PeerErr:  errors.New("timed out"),
+			PublishFunc: func(b *broker.Broker) error {
+				_, err := b.Publish("test", "", broker.Message{ID: "1"})
+				return err
+			},
+			ExpectedPeer:  true,
+			ExpectedHosts: []string{"10.0.0.2:8080"},
+		},
+		{
+			Name: "It should use http for nodes without a peer port",
+			PublishFunc: func(b *broker.Broker) error {
+				_, err := b.Publish("test", "", broker.Message{ID: "1"})
+				return err
+			},
+			ExpectedHosts: []string{"10.0.0.2:8080"},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.Name, func(t *testing.T) {
+			var mux sync.Mutex
+			var hosts []string
+
+			cl := &http.Client{
+				Transport: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+					mux.Lock()
+					hosts = append(hosts, r.URL.Host)
+					mux.Unlock()
+
+					return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(strings.NewReader(""))}, nil
+				}),
+			}
+
+			other := &memberlist.Node{Name: "other", Addr: net.ParseIP("10.0.0.2"), Meta: []byte("8080")}
+			otherLocations := broker.NewLocations("other", nil)
+
+			om := &MockMemberlist{}
+			om.On("LocalNode").Return(other)
+			om.On("NumMembers").Return(1)
+			om.On("Members").Return([]*memberlist.Node{})
+
+			// The other node advertises its peer port when created
+			ob := broker.New(om, cl,
+				broker.WithLocations(otherLocations),
+				broker.WithTransport(broker.TransportPeer),
+				broker.WithPeerTransport(&MockPeerTransport{}, tc.PeerPort),
+			)
+			defer ob.Close()
+
+			if _, err := ob.NewClient([]string{"test"}, "test"); err != nil {
+				assert.Fail(t, err.Error())
+				return
+			}
+
+			locations := broker.NewLocations("test", nil)
+			locations.MergeRemoteState(otherLocations.LocalState(false), false)
+
+			m := &MockMemberlist{}
+			m.On("LocalNode").Return(&memberlist.Node{Name: "test"})
+			m.On("NumMembers").Return(2)
+			m.On("Members").Return([]*memberlist.Node{other})
+
+			peers := &MockPeerTransport{}
+			peers.On("Send", "10.0.0.2:7947", mock.Anything).Return(tc.PeerErr)
+
+			b := broker.New(m, cl,
+				broker.WithLocations(locations),
+				broker.WithTransport(broker.TransportPeer),
+				broker.WithPeerTransport(peers, 7947),
+			)
+
+			assert.NoError(t, tc.PublishFunc(b))
+			b.Close()
+
+			if tc.ExpectedPeer {
+				peers.AssertExpectations(t)
+
+				msgs := peers.Calls[0].Arguments.Get(1).([]broker.Message)
+				assert.Len(t, msgs, 1)
+				assert.Equal(t, "1", msgs[0].ID)
+			} else {
+				peers.AssertNotCalled(t, "Send", mock.Anything, mock.Anything)
+			}
+
+			assert.Equal(t, tc.ExpectedHosts, hosts)
+		})
+	}
+}
+
+func TestBroker_Retry(t *testing.T) {
+	t.Parallel()
+	logrus.SetLevel(logrus.PanicLevel)
+
+	tt := []struct {
+		Name                string
+		Options             []broker.Option
+		Members             []string
+		Failures            int
+		Messages            []string
+		Wait                time.Duration
+		ExpectedRetried     map[string]uint64
+		ExpectedDropped     map[string]uint64
+		ExpectedReason      string
+		ExpectedID          string
+		ExpectedBeenTo      []string
+		ExpectedRetryPath   string
+		ExpectedDeadLetters int
+	}{
+		{
+			Name:              "It should retry a node until it succeeds",
+			Options:           []broker.Option{broker.WithRetryBackoff(time.Millisecond, time.Millisecond*5)},
+			Members:           []string{"a"},
+			Failures:          2,
+			Messages:          []string{"1"},
+			Wait:              time.Millisecond * 200,
+			ExpectedRetried:   map[string]uint64{"a": 1},
+			ExpectedDropped:   map[string]uint64{},
+			ExpectedBeenTo:    []string{"test", "a"},
+			ExpectedRetryPath: "/batch",
+		},
+		{
+			Name:              "It should retry each node once every node has failed",
+			Options:           []broker.Option{broker.WithRetryBackoff(time.Millisecond, time.Millisecond*5)},
+			Members:           []string{"a", "b"},
+			Failures:          2,
+			Messages:          []string{"1"},
+			Wait:              time.Millisecond * 200,
+			ExpectedRetried:   map[string]uint64{"a": 1, "b": 1},
+			ExpectedDropped:   map[string]uint64{},
+			ExpectedBeenTo:    []string{"test", "a", "b"},
+			ExpectedRetryPath: "/batch",
+		},
+		{
+			Name: "It should give up on messages older than the maximum age",
+			Options: []broker.Option{
+				broker.WithRetry(10, time.Millisecond*20),
+				broker.WithRetryBackoff(time.Millisecond*5, time.Millisecond*5),
+			},
+			Members:             []string{"a"},
+			Failures:            -1,
+			Messages:            []string{"1"},
+			Wait:                time.Millisecond * 200,
+			ExpectedRetried:     map[string]uint64{},
+			ExpectedDropped:     map[string]uint64{"a": 1},
+			ExpectedReason:      "exceeded maximum retry age",
+			ExpectedID:          "1",
+			ExpectedDeadLetters: 1,
+		},
+		{
+			Name: "It should give up on the oldest messages when the queue is full",
+			Options: []broker.Option{
+				broker.WithRetry(1, time.Minute),
+				broker.WithRetryBackoff(time.Minute, time.Minute),
+			},
+			Members:             []string{"a"},
+			Failures:            -1,
+			Messages:            []string{"1", "2"},
+			ExpectedRetried:     map[string]uint64{},
+			ExpectedDropped:     map[string]uint64{"a": 1},
+			ExpectedReason:      "retry queue is full",
+			ExpectedDeadLetters: 1,
+		},
+		{
+			Name:                "It should give up on messages straight away if retrying is disabled",
+			Options:             []broker.Option{broker.WithRetry(0, 0)},
+			Members:             []string{"a"},
+			Failures:            -1,
+			Messages:            []string{"1"},
+			ExpectedRetried:     map[string]uint64{},
+			ExpectedDropped:     map[string]uint64{"a": 1},
+			ExpectedReason:      "retrying is disabled",
+			ExpectedID:          "1",
+			ExpectedDeadLetters: 1,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.Name, func(t *testing.T) {
+			var mux sync.Mutex
+			attempts := make(map[string]int)
+			var retries []*http.Request
+			var bodies [][]byte
+
+			cl := &http.Client{
+				Transport: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+					mux.Lock()
+					defer mux.Unlock()
+
+					attempts[r.URL.Host]++
+					if tc.Failures < 0 || attempts[r.URL.Host] <= tc.Failures {
+						return nil, errors.New("node is unreachable")
+					}
+
+					body, _ := ioutil.ReadAll(r.Body)
+					retries = append(retries, r)
+					bodies = append(bodies, body)
+
+					return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(strings.NewReader(""))}, nil
+				}),
+			}
+
+			var members []*memberlist.Node
+			for i, name := range tc.Members {
+				members = append(members, &memberlist.Node{Name: name, Addr: net.ParseIP("10.0.0.1"), Meta: []byte(fmt.Sprint(8080 + i))})
+			}
+
+			m := &MockMemberlist{}
+			m.On("LocalNode").Return(&memberlist.Node{Name: "test"})
+			m.On("NumMembers").Return(len(members) + 1)
+			m.On("Members").Return(members)
+
+			b := broker.New(m, cl, tc.Options...)
+
+			for _, id := range tc.Messages {
+				_, err := b.Publish("test", "", broker.Message{ID: id})
+				assert.NoError(t, err)
+			}
+
+			// Wait for the messages to be propagated and retried
+			<-time.After(time.Millisecond * 50)
+			<-time.After(tc.Wait)
+
+			status := b.Status()
+			letters := b.DeadLetters()
+			b.Close()
+
+			assert.Equal(t, tc.ExpectedRetried, status.Retried)
+			assert.Equal(t, tc.ExpectedDropped, status.RetryDropped)
+
+			if assert.Len(t, letters, tc.ExpectedDeadLetters) && tc.ExpectedDeadLetters > 0 {
+				assert.Equal(t, tc.ExpectedReason, letters[0].Reason)
+				assert.Len(t, letters[0].Messages, 1)
+			}
+
+			if tc.ExpectedID != "" && len(letters) > 0 {
+				assert.Equal(t, tc.ExpectedID, letters[0].Messages[0].ID)
+			}
+
+			mux.Lock()
+			defer mux.Unlock()
+
+			for i, r := range retries {
+				assert.Equal(t, tc.ExpectedRetryPath, r.URL.Path)
+
+				var msgs []broker.Message
+				assert.NoError(t, json.Unmarshal(bodies[i], &msgs))
+
+				if assert.Len(t, msgs, 1) {
+					assert.Equal(t, tc.ExpectedBeenTo, msgs[0].BeenTo)
+				}
+			}
+		})
+	}
+}
+
+func TestBroker_RetryBatches(t *testing.T) {
+	t.Parallel()
+	logrus.SetLevel(logrus.PanicLevel)
+
+	var mux sync.Mutex
+	var batches [][]broker.Message
+
+	cl := &http.Client{
+		Transport: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+			// Propagation fails, so every message is retried
+			if r.URL.Path != "/batch" {
+				return nil, errors.New("node is unreachable")
+			}
+
+			var msgs []broker.Message
+			if err := json.NewDecoder(r.Body).Decode(&msgs); err != nil {
+				return nil, err
+			}
+
+			mux.Lock()
+			defer mux.Unlock()
+
+			batches = append(batches, msgs)
+
+			// The node rejects the second batch, which shouldn't affect the others
+			if len(batches) == 2 {
+				return &http.Response{StatusCode: http.StatusBadRequest, Body: ioutil.NopCloser(strings.NewReader("invalid batch"))}, nil
+			}
+
+			return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(strings.NewReader(""))}, nil
+		}),
+	}
+
+	m := &MockMemberlist{}
+	m.On("LocalNode").Return(&memberlist.Node{Name: "test"})
+	m.On("NumMembers").Return(2)
+	m.On("Members").Return([]*memberlist.Node{
+		{Name: "a", Addr: net.ParseIP("10.0.0.1"), Meta: []byte("8080")},
+	})
+
+	b := broker.New(m, cl,
+		broker.WithRetryBackoff(time.Millisecond*50, time.Millisecond*50),
+		broker.WithRetryBatch(2, 0),
+	)
+
+	for _, id := range []string{"1", "2", "3", "4", "5"} {
+		_, err := b.Publish("test", "", broker.Message{ID: id})
+		assert.NoError(t, err)
+	}
+
+	// Wait for the messages to be propagated and retried
+	<-time.After(time.Millisecond * 200)
+
+	status := b.Status()
+	letters := b.DeadLetters()
+	b.Close()
+
+	mux.Lock()
+	defer mux.Unlock()
+
+	if assert.Len(t, batches, 3) {
+		assert.Len(t, batches[0], 2)
+		assert.Len(t, batches[1], 2)
+		assert.Len(t, batches[2], 1)
+	}
+
+	assert.Equal(t, map[string]uint64{"a": 3}, status.Retried)
+	assert.Equal(t, map[string]uint64{"a": 2}, status.RetryDropped)
+
+	if assert.Len(t, letters, 1) {
+		assert.Contains(t, letters[0].Reason, "invalid batch")
+		assert.Equal(t, batches[1], letters[0].Messages)
+	}
+}
+
+func TestBroker_Acks(t *testing.T) {
+	t.Parallel()
+	logrus.SetLevel(logrus.PanicLevel)
+
+	tt := []struct {
+		Name      string
+		Window    int
+		Retention time.Duration
+		TestFunc  func(*testing.T, *broker.Broker)
+	}{
+		{
+			Name:      "It should redeliver unacknowledged messages on reconnect",
+			Window:    10,
+			Retention: time.Minute,
+			TestFunc: func(t *testing.T, b *broker.Broker) {
+				cl, err := b.NewClient([]string{"test"}, "client", broker.WithAcks(), broker.WithBufferSize(10))
+				if !assert.NoError(t, err) {
+					return
+				}
+
+				// Messages still in the buffer are redelivered too
+				for _, id := range []string{"1", "2", "3"} {
+					cl.Write(broker.Message{ID: id, Channel: "test"})
+				}
+
+				<-cl.Messages()
+
+				n, err := b.Ack("test", "client", []string{"1"})
+				assert.NoError(t, err)
+				assert.Equal(t, 1, n)
+
+				b.RemoveClient([]string{"test"}, "client")
+				assert.Equal(t, map[string]int{"client": 2}, b.Status().Unacked)
+
+				cl, err = b.NewClient([]string{"test"}, "client", broker.WithAcks())
+				if !assert.NoError(t, err) {
+					return
+				}
+
+				unacked := cl.Unacked()
+				if assert.Len(t, unacked, 2) {
+					assert.Equal(t, "2", unacked[0].ID)
+					assert.Equal(t, "3", unacked[1].ID)
+				}
+			},
+		},
+		{
+			Name:      "It should only acknowledge messages from the given channel",
+			Window:    10,
+			Retention: time.Minute,
+			TestFunc: func(t *testing.T, b *broker.Broker) {
+				cl, err := b.NewClient([]string{"a", "b"}, "client", broker.WithAcks())
+				if !assert.NoError(t, err) {
+					return
+				}
+
+				cl.Track(broker.Message{ID: "1", Channel: "a"})
+				cl.Track(broker.Message{ID: "1", Channel: "b"})
+
+				n, err := b.Ack("b", "client", []string{"1"})
+				assert.NoError(t, err)
+				assert.Equal(t, 1, n)
+				assert.Equal(t, []broker.Message{{ID: "1", Channel: "a"}}, cl.Unacked())
+			},
+		},
+		{
+			Name:      "It should hold messages beyond the window until some are acknowledged",
+			Window:    1,
+			Retention: time.Minute,
+			TestFunc: func(t *testing.T, b *broker.Broker) {
+				cl, err := b.NewClient([]string{"test"}, "client", broker.WithAcks(), broker.WithBufferSize(10))
+				if !assert.NoError(t, err) {
+					return
+				}
+
+				for _, id := range []string{"1", "2"} {
+					cl.Write(broker.Message{ID: id, Channel: "test"})
+				}
+
+				assert.Len(t, cl.Messages(), 1)
+				assert.Equal(t, map[string]int{"client": 2}, b.Status().Unacked)
+
+				_, err = b.Ack("test", "client", []string{"1"})
+				assert.NoError(t, err)
+				assert.Len(t, cl.Messages(), 2)
+			},
+		},
+		{
+			Name:      "It should disconnect clients holding too many messages instead of waiting",
+			Window:    1,
+			Retention: time.Minute,
+			TestFunc: func(t *testing.T, b *broker.Broker) {
+				cl, err := b.NewClient([]string{"test"}, "client",
+					broker.WithAcks(),
+					broker.WithBufferSize(1),
+					broker.WithOverflowPolicy(broker.OverflowBlock),
+				)
+
+				if !assert.NoError(t, err) {
+					return
+				}
+
+				for _, id := range []string{"1", "2", "3"} {
+					cl.Write(broker.Message{ID: id, Channel: "test"})
+				}
+
+				select {
+				case <-cl.Done():
+				case <-time.After(time.Second):
+					assert.Fail(t, "client was not disconnected")
+				}
+			},
+		},
+		{
+			Name:      "It should stop waiting for messages that won't be written",
+			Window:    1,
+			Retention: time.Minute,
+			TestFunc: func(t *testing.T, b *broker.Broker) {
+				cl, err := b.NewClient([]string{"test"}, "client", broker.WithAcks(), broker.WithBufferSize(10))
+				if !assert.NoError(t, err) {
+					return
+				}
+
+				for _, id := range []string{"1", "2"} {
+					cl.Write(broker.Message{ID: id, Channel: "test"})
+				}
+
+				cl.Untrack(<-cl.Messages())
+
+				unacked := cl.Unacked()
+				if assert.Len(t, unacked, 1) {
+					assert.Equal(t, "2", unacked[0].ID)
+				}
+			},
+		},
+		{
+			Name:      "It should forget unacknowledged messages after the retention",
+			Window:    10,
+			Retention: time.Millisecond * 10,
+			TestFunc: func(t *testing.T, b *broker.Broker) {
+				cl, err := b.NewClient([]string{"test"}, "client", broker.WithAcks())
+				if !assert.NoError(t, err) {
+					return
+				}
+
+				cl.Track(broker.Message{ID: "1", Channel: "test"})
+				b.RemoveClient([]string{"test"}, "client")
+
+				<-time.After(time.Millisecond * 50)
+
+				_, err = b.Ack("test", "client", []string{"1"})
+				assert.Equal(t, broker.ErrClientNotFound, err)
+			},
+		},
+		{
+			Name:   "It should not hold messages for clients without acknowledgements",
+			Window: 10,
+			TestFunc: func(t *testing.T, b *broker.Broker) {
+				cl, err := b.NewClient([]string{"test"}, "client")
+				if !assert.NoError(t, err) {
+					return
+				}
+
+				cl.Track(broker.Message{ID: "1", Channel: "test"})
+				assert.Empty(t, cl.Unacked())
+
+				_, err = b.Ack("test", "client", []string{"1"})
+				assert.Equal(t, broker.ErrClientNotFound, err)
+			},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.Name, func(t *testing.T) {
+			m := &MockMemberlist{}
+			m.On("LocalNode").Return(&memberlist.Node{Name: "test"})
+			m.On("NumMembers").Return(1)
+			m.On("Members").Return([]*memberlist.Node{})
+
+			b := broker.New(m, http.DefaultClient, broker.WithAckWindow(tc.Window, tc.Retention))
+			defer b.Close()
+
+			tc.TestFunc(t, b)
+		})
+	}
+}
+
+func TestBroker_AckForwarding(t *testing.T) {
+	t.Parallel()
+	logrus.SetLevel(logrus.PanicLevel)
+
+	var body broker.AckRequest
+	var path string
+
+	cl := &http.Client{
+		Transport: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+			path = r.URL.Path
+			json.NewDecoder(r.Body).Decode(&body)
+
+			return &http.Response{
+				StatusCode: http.StatusOK,
+				Body:       ioutil.NopCloser(strings.NewReader(`{"acknowledged":2}`)),
+			}, nil
+		}),
+	}
+
+	other := &memberlist.Node{Name: "other", Addr: net.ParseIP("10.0.0.2"), Meta: []byte("8080")}
+	otherLocations := broker.NewLocations("other", nil)
+
+	om := &MockMemberlist{}
+	om.On("LocalNode").Return(other)
+	om.On("NumMembers").Return(1)
+	om.On("Members").Return([]*memberlist.Node{})
+
+	ob := broker.New(om, cl, broker.WithLocations(otherLocations))
+	defer ob.Close()
+
+	if _, err := ob.NewClient([]string{"test"}, "client", broker.WithAcks()); err != nil {
+		assert.Fail(t, err.Error())
+		return
+	}
+
+	locations := broker.NewLocations("test", nil)
+	locations.MergeRemoteState(otherLocations.LocalState(false), false)
+
+	m := &MockMemberlist{}
+	m.On("LocalNode").Return(&memberlist.Node{Name: "test"})
+	m.On("NumMembers").Return(2)
+	m.On("Members").Return([]*memberlist.Node{other})
+
+	b := broker.New(m, cl, broker.WithLocations(locations))
+	defer b.Close()
+
+	n, err := b.Ack("test", "client", []string{"1", "2"})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+	assert.Equal(t, "/channel/test/client/client/ack", path)
+	assert.Equal(t, []string{"1", "2"}, body.IDs)
+}
+
+func TestBroker_Handover(t *testing.T) {
+	t.Parallel()
+	logrus.SetLevel(logrus.PanicLevel)
+
+	m := &MockMemberlist{}
+	m.On("LocalNode").Return(&memberlist.Node{Name: "test"})
+	m.On("NumMembers").Return(1)
+	m.On("Members").Return([]*memberlist.Node{})
+
+	b := broker.New(m, http.DefaultClient)
+	defer b.Close()
+
+	cl, err := b.NewClient([]string{"test"}, "client", broker.WithAcks(), broker.WithBufferSize(10))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	cl.Write(broker.Message{ID: "1", Channel: "test"})
+
+	// Messages are kept while the client is connected
+	assert.Empty(t, b.Handover("client"))
+
+	b.RemoveClient([]string{"test"}, "client")
+
+	msgs := b.Handover("client")
+	if assert.Len(t, msgs, 1) {
+		assert.Equal(t, "1", msgs[0].ID)
+	}
+
+	_, err = b.Ack("test", "client", []string{"1"})
+	assert.Equal(t, broker.ErrClientNotFound, err)
+}
+
+func TestBroker_Takeover(t *testing.T) {
+	t.Parallel()
+	logrus.SetLevel(logrus.PanicLevel)
+
+	var path string
+
+	cl := &http.Client{
+		Transport: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+			path = r.URL.Path
+
+			return &http.Response{
+				StatusCode: http.StatusOK,
+				Body:       ioutil.NopCloser(strings.NewReader(`{"messages":[{"id":"1","channel":"test"}]}`)),
+			}, nil
+		}),
+	}
+
+	other := &memberlist.Node{Name: "other", Addr: net.ParseIP("10.0.0.2"), Meta: []byte("8080")}
+
+	m := &MockMemberlist{}
+	m.On("LocalNode").Return(&memberlist.Node{Name: "test"})
+	m.On("NumMembers").Return(2)
+	m.On("Members").Return([]*memberlist.Node{other})
+
+	b := broker.New(m, cl)
+	defer b.Close()
+
+	c, err := b.NewClient([]string{"test"}, "client", broker.WithAcks())
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	assert.Equal(t, "/client/client/handover", path)
+
+	unacked := c.Unacked()
+	if assert.Len(t, unacked, 1) {
+		assert.Equal(t, "1", unacked[0].ID)
+	}
+
+	n, err := b.Ack("test", "client", []string{"1"})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+}
+
+func TestBroker_PublishQueue(t *testing.T) {
+	t.Parallel()
+	logrus.SetLevel(logrus.PanicLevel)
+
+	tt := []struct {
+		Name            string
+		Selection       broker.Selection
+		Members         []*memberlist.Node
+		Clients         []string
+		Busy            string
+		Messages        []broker.Message
+		ExpectedClients map[string]int
+		ExpectedNodes   map[string]int
+		ExpectedFailed  map[string]uint64
+	}{
+		{
+			Name:            "It should give each message to a single client in turn",
+			Selection:       broker.SelectRoundRobin,
+			Clients:         []string{"a", "b"},
+			Messages:        []broker.Message{{ID: "1"}, {ID: "2"}, {ID: "3"}, {ID: "4"}},
+			ExpectedClients: map[string]int{"a": 2, "b": 2},
+			ExpectedNodes:   map[string]int{},
+		},
+		{
+			Name:            "It should give messages to the least loaded client",
+			Selection:       broker.SelectLeastLoaded,
+			Clients:         []string{"a", "b"},
+			Busy:            "a",
+			Messages:        []broker.Message{{ID: "1"}},
+			ExpectedClients: map[string]int{"a": 0, "b": 1},
+			ExpectedNodes:   map[string]int{},
+		},
+		{
+			Name:      "It should give each message to a single node in turn",
+			Selection: broker.SelectRoundRobin,
+			Members: []*memberlist.Node{
+				{Name: "x", Addr: net.ParseIP("127.0.0.1"), Meta: []byte("8080")},
+				{Name: "y", Addr: net.ParseIP("127.0.0.2"), Meta: []byte("8080")},
+			},
+			Messages:        []broker.Message{{ID: "1"}, {ID: "2"}},
+			ExpectedClients: map[string]int{},
+			ExpectedNodes:   map[string]int{"127.0.0.1": 1, "127.0.0.2": 1},
+		},
+		{
+			Name:      "It should give messages to another node if sending fails",
+			Selection: broker.SelectRoundRobin,
+			Members: []*memberlist.Node{
+				{Name: "x", Addr: net.ParseIP("127.0.0.3"), Meta: []byte("8080")},
+				{Name: "y", Addr: net.ParseIP("127.0.0.2"), Meta: []byte("8080")},
+			},
+			Messages:        []broker.Message{{ID: "1"}},
+			ExpectedClients: map[string]int{},
+			ExpectedNodes:   map[string]int{"127.0.0.3": 1, "127.0.0.2": 1},
+			ExpectedFailed:  map[string]uint64{"x": 1},
+		},
+		{
+			Name:      "It should give messages sent by other nodes to a local client",
+			Selection: broker.SelectRoundRobin,
+			Members: []*memberlist.Node{
+				{Name: "x", Addr: net.ParseIP("127.0.0.1"), Meta: []byte("8080")},
+			},
+			Clients:         []string{"a"},
+			Messages:        []broker.Message{{ID: "1", BeenTo: []string{"x"}}},
+			ExpectedClients: map[string]int{"a": 1},
+			ExpectedNodes:   map[string]int{},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.Name, func(t *testing.T) {
+			var mux sync.Mutex
+			nodes := make(map[string]int)
+
+			cl := &http.Client{
+				Transport: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+					// Clients that use acknowledgements ask other nodes for the
+					// messages they didn't acknowledge when they connect.
+					if strings.HasSuffix(r.URL.Path, "/handover") {
+						return &http.Response{
+							StatusCode: http.StatusOK,
+							Body:       ioutil.NopCloser(strings.NewReader("{}")),
+						}, nil
+					}
+
+					var msg broker.Message
+					json.NewDecoder(r.Body).Decode(&msg)
+
+					assert.Equal(t, "/channel/jobs", r.URL.Path)
+					assert.Equal(t, []string{"test"}, msg.BeenTo)
+
+					mux.Lock()
+					nodes[r.URL.Hostname()]++
+					mux.Unlock()
+
+					// The third address is unavailable
+					code := http.StatusOK
+					if r.URL.Hostname() == "127.0.0.3" {
+						code = http.StatusInternalServerError
+					}
+
+					return &http.Response{
+						StatusCode: code,
+						Body:       ioutil.NopCloser(strings.NewReader("{}")),
+					}, nil
+				}),
+			}
+
+			m := &MockMemberlist{}
+			m.On("LocalNode").Return(&memberlist.Node{Name: "test"})
+			m.On("NumMembers").Return(len(tc.Members) + 1)
+			m.On("Members").Return(tc.Members)
+
+			b := broker.New(m, cl,
+				broker.WithQueueChannels(tc.Selection, "jobs"),
+				broker.WithRetry(0, 0),
+			)
+
+			clients := make(map[string]*broker.Client)
+			for _, id := range tc.Clients {
+				c, err := b.NewClient([]string{"jobs"}, id, broker.WithAcks(), broker.WithBufferSize(10))
+				if !assert.NoError(t, err) {
+					return
+				}
+
+				clients[id] = c
+			}
+
+			if tc.Busy != "" {
+				clients[tc.Busy].Track(broker.Message{ID: "0", Channel: "jobs"})
+			}
+
+			for _, msg := range tc.Messages {
+				_, err := b.Publish("jobs", "", msg)
+				assert.NoError(t, err)
+			}
+
+			b.Close()
+
+			received := make(map[string]int)
+			for id, c := range clients {
+				received[id] = len(c.Messages())
+			}
+
+			assert.Equal(t, tc.ExpectedClients, received)
+			assert.Equal(t, tc.ExpectedNodes, nodes)
+
+			if tc.ExpectedFailed != nil {
+				assert.Equal(t, tc.ExpectedFailed, b.Status().PropagationFailures)
+			}
+
+			// Queued messages are not kept for replaying
+			assert.Empty(t, b.Replay([]string{"jobs"}, "0"))
+		})
+	}
+}
+
+func TestBroker_PublishQueueRotation(t *testing.T) {
+	t.Parallel()
+	logrus.SetLevel(logrus.PanicLevel)
+
+	m := &MockMemberlist{}
+	m.On("LocalNode").Return(&memberlist.Node{Name: "test"})
+	m.On("NumMembers").Return(1)
+	m.On("Members").Return([]*memberlist.Node{})
+
+	b := broker.New(m, http.DefaultClient, broker.WithQueueChannels(broker.SelectRoundRobin, "jobs.>"))
+	defer b.Close()
+
+	for round := 0; round < 2; round++ {
+		var clients []*broker.Client
+		for _, id := range []string{"a", "b"} {
+			cl, err := b.NewClient([]string{"jobs.>"}, id, broker.WithBufferSize(10))
+			if !assert.NoError(t, err) {
+				return
+			}
+
+			clients = append(clients, cl)
+		}
+
+		_, err := b.Publish("jobs.build", "", broker.Message{ID: "1"})
+		assert.NoError(t, err)
+
+		// Once the channel has no subscribers, the rotation starts again
+		select {
+		case <-clients[0].Messages():
+		case <-time.After(time.Second):
+			assert.Fail(t, "message was not given to the first client")
+		}
+
+		b.RemoveClient([]string{"jobs.>"}, "a")
+		b.RemoveClient([]string{"jobs.>"}, "b")
+	}
+}
+
+func TestBroker_DeclareChannel(t *testing.T) {
+	t.Parallel()
+	logrus.SetLevel(logrus.PanicLevel)
+
+	tt := []struct {
+		Name     string
+		Config   broker.ChannelConfig
+		TestFunc func(*testing.T, *broker.Broker)
+	}{
+		{
+			Name:   "It should limit the number of clients",
+			Config: broker.ChannelConfig{ID: "test", MaxClients: 1},
+			TestFunc: func(t *testing.T, b *broker.Broker) {
+				_, err := b.NewClient([]string{"test"}, "a")
+				assert.NoError(t, err)
+
+				_, err = b.NewClient([]string{"test"}, "b")
+				assert.Equal(t, broker.ErrChannelFull, err)
+			},
+		},
+		{
+			Name:   "It should limit the size of the history",
+			Config: broker.ChannelConfig{ID: "test", HistorySize: 1},
+			TestFunc: func(t *testing.T, b *broker.Broker) {
+				for _, id := range []string{"1", "2"} {
+					_, err := b.Publish("test", "", broker.Message{ID: id})
+					assert.NoError(t, err)
+				}
+
+				msgs, err := b.History("test", "", 0)
+				assert.NoError(t, err)
+
+				if assert.Len(t, msgs, 1) {
+					assert.Equal(t, "2", msgs[0].ID)
+				}
+			},
+		},
+		{
+			Name:   "It should give messages the default reconnection time",
+			Config: broker.ChannelConfig{ID: "test", Retry: 5000},
+			TestFunc: func(t *testing.T, b *broker.Broker) {
+				_, err := b.Publish("test", "", broker.Message{ID: "1"})
+				assert.NoError(t, err)
+
+				_, err = b.Publish("test", "", broker.Message{ID: "2", Retry: 10})
+				assert.NoError(t, err)
+
+				msgs, err := b.History("test", "", 0)
+				assert.NoError(t, err)
+
+				if assert.Len(t, msgs, 2) {
+					assert.Equal(t, 5000, msgs[0].Retry)
+					assert.Equal(t, 10, msgs[1].Retry)
+				}
+			},
+		},
+		{
+			Name:   "It should deliver messages to a single client",
+			Config: broker.ChannelConfig{ID: "test", Delivery: broker.DeliveryQueue},
+			TestFunc: func(t *testing.T, b *broker.Broker) {
+				var clients []*broker.Client
+				for _, id := range []string{"a", "b"} {
+					cl, err := b.NewClient([]string{"test"}, id, broker.WithBufferSize(10))
+					if !assert.NoError(t, err) {
+						return
+					}
+
+					clients = append(clients, cl)
+				}
+
+				_, err := b.Publish("test", "", broker.Message{ID: "1"})
+				assert.NoError(t, err)
+
+				b.Close()
+				assert.Equal(t, 1, len(clients[0].Messages())+len(clients[1].Messages()))
+			},
+		},
+		{
+			Name:   "It should require a token to subscribe",
+			Config: broker.ChannelConfig{ID: "orders.secret", Token: "token"},
+			TestFunc: func(t *testing.T, b *broker.Broker) {
+				assert.Equal(t, broker.ErrUnauthorized, b.Authorize([]string{"orders.secret"}, ""))
+				assert.Equal(t, broker.ErrUnauthorized, b.Authorize([]string{"orders.>"}, "wrong"))
+				assert.NoError(t, b.Authorize([]string{"orders.>"}, "token"))
+				assert.NoError(t, b.Authorize([]string{"orders.public"}, ""))
+
+				// Tokens are never returned
+				cfg, ok := b.DescribeChannel("orders.secret")
+				assert.True(t, ok)
+				assert.True(t, cfg.AuthRequired)
+				assert.Empty(t, cfg.Token)
+			},
+		},
+		{
+			Name:   "It should use the defaults once deleted",
+			Config: broker.ChannelConfig{ID: "test", MaxClients: 1, Token: "token"},
+			TestFunc: func(t *testing.T, b *broker.Broker) {
+				assert.NoError(t, b.DeleteChannel("test"))
+				assert.Equal(t, broker.ErrChannelNotFound, b.DeleteChannel("test"))
+
+				_, ok := b.DescribeChannel("test")
+				assert.False(t, ok)
+				assert.NoError(t, b.Authorize([]string{"test"}, ""))
+
+				for _, id := range []string{"a", "b"} {
+					_, err := b.NewClient([]string{"test"}, id)
+					assert.NoError(t, err)
+				}
+			},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.Name, func(t *testing.T) {
+			m := &MockMemberlist{}
+			m.On("LocalNode").Return(&memberlist.Node{Name: "test"})
+			m.On("NumMembers").Return(1)
+
+			b := broker.New(m, http.DefaultClient)
+			defer b.Close()
+
+			_, err := b.DeclareChannel(tc.Config)
+			if !assert.NoError(t, err) {
+				return
+			}
+
+			tc.TestFunc(t, b)
+		})
+	}
+
+	t.Run("It should reject invalid settings", func(t *testing.T) {
+		m := &MockMemberlist{}
+		m.On("LocalNode").Return(&memberlist.Node{Name: "test"})
+
+		b := broker.New(m, http.DefaultClient)
+		defer b.Close()
+
+		for _, cfg := range []broker.ChannelConfig{
+			{},
+			{ID: "orders.>"},
+			{ID: "test", MaxClients: -1},
+			{ID: "test", Delivery: "unknown"},
+			{ID: "test", Selection: "unknown"},
+		} {
+			_, err := b.DeclareChannel(cfg)
+			assert.Error(t, err)
+		}
+	})
+}
+
+func TestLocations_ChannelConfigs(t *testing.T) {
+	t.Parallel()
+	logrus.SetLevel(logrus.PanicLevel)
+
+	newBroker := func(name string) (*broker.Broker, *broker.Locations) {
+		m := &MockMemberlist{}
+		m.On("LocalNode").Return(&memberlist.Node{Name: name})
+
+		locations := broker.NewLocations(name, []byte("8080"))
+		return broker.New(m, http.DefaultClient, broker.WithLocations(locations)), locations
+	}
+
+	a, al := newBroker("a")
+	defer a.Close()
+
+	b, bl := newBroker("b")
+	defer b.Close()
+
+	c, cl := newBroker("c")
+	defer c.Close()
+
+	_, err := a.DeclareChannel(broker.ChannelConfig{ID: "test", MaxClients: 5, Token: "token"})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	// Declarations are broadcast to other nodes
+	for _, msg := range al.GetBroadcasts(0, 4096) {
+		bl.NotifyMsg(msg)
+	}
+
+	cfg, ok := b.DescribeChannel("test")
+	assert.True(t, ok)
+	assert.Equal(t, 5, cfg.MaxClients)
+	assert.Equal(t, broker.ErrUnauthorized, b.Authorize([]string{"test"}, ""))
+
+	// Deletions replace older declarations during state synchronisation, and
+	// nodes that missed both learn of the deletion
+	assert.NoError(t, b.DeleteChannel("test"))
+
+	al.MergeRemoteState(bl.LocalState(false), false)
+	cl.MergeRemoteState(bl.LocalState(false), false)
+	bl.MergeRemoteState(al.LocalState(false), false)
+
+	for _, br := range []*broker.Broker{a, b, c} {
+		_, ok := br.DescribeChannel("test")
+		assert.False(t, ok)
+	}
+
+	// Declaring the channel again replaces the deletion
+	_, err = c.DeclareChannel(broker.ChannelConfig{ID: "test", HistorySize: 1})
+	assert.NoError(t, err)
+
+	al.MergeRemoteState(cl.LocalState(false), false)
+
+	cfg, ok = a.DescribeChannel("test")
+	assert.True(t, ok)
+	assert.Equal(t, 1, cfg.HistorySize)
+}
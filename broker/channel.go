@@ -3,6 +3,7 @@ package broker
 import (
 	"fmt"
 	"sync"
+	"sync/atomic"
 
 	"github.com/sirupsen/logrus"
 )
@@ -10,26 +11,56 @@ import (
 type (
 	// The Channel type represents a channel within the broker. Each channel
 	// has a unique identifier and can have one or more clients. When events
-	// are published to a channel, a client is chosen at random
+	// are published to a channel, they are written to every client. Channels
+	// configured as queues on the broker write each event to a single client.
 	Channel struct {
 		id      string
 		clients map[string]*Client
 		mux     sync.Mutex
 		log     *logrus.Entry
+		dropped uint64
+
+		clientOpts []ClientOption
 	}
+
+	// The ChannelOption type is a function that modifies the configuration of
+	// a channel on creation.
+	ChannelOption func(*Channel)
 )
 
+// WithClientOptions sets the options applied to each client added to the
+// channel.
+func WithClientOptions(opts ...ClientOption) ChannelOption {
+	return func(c *Channel) {
+		c.clientOpts = append(c.clientOpts, opts...)
+	}
+}
+
 // NewChannel creates a new instance of the Channel type using the given identifier
-func NewChannel(id string) *Channel {
-	return &Channel{
+func NewChannel(id string, opts ...ChannelOption) *Channel {
+	ch := &Channel{
 		id:      id,
 		clients: make(map[string]*Client),
 		log:     logrus.WithField("channel", id),
 	}
+
+	for _, opt := range opts {
+		opt(ch)
+	}
+
+	return ch
 }
 
-// WriteTo writes a message directly to a given client
+// WriteTo writes a message directly to a given client, if it is accepted by the
+// client's event filter.
 func (c *Channel) WriteTo(clientID string, msg Message) {
+	c.writeTo(clientID, msg, nil)
+}
+
+// writeTo writes a message directly to a given client. If the given set of clients
+// is not nil, the message is not written to clients in the set and is added to it
+// once written, so that clients shared across many channels receive it once.
+func (c *Channel) writeTo(clientID string, msg Message, seen map[*Client]bool) {
 	c.log.WithFields(logrus.Fields{
 		"clientId": clientID,
 		"eventId":  msg.ID,
@@ -37,21 +68,41 @@ func (c *Channel) WriteTo(clientID string, msg Message) {
 	}).Info("writing message to client")
 
 	c.mux.Lock()
-	defer c.mux.Unlock()
+	cl, ok := c.clients[clientID]
+	c.mux.Unlock()
 
-	if cl, ok := c.clients[clientID]; ok {
-		cl.Write(msg)
+	// The lock isn't held while writing, as writes can block until the client
+	// reads or is removed from the channel.
+	if !ok || !cl.Accepts(msg) || seen[cl] {
+		return
+	}
 
-		c.log.WithFields(logrus.Fields{
-			"client":  cl.ID(),
-			"eventId": msg.ID,
-			"event":   msg.Event,
-		}).Info("wrote message to client")
+	if seen != nil {
+		seen[cl] = true
+	}
+
+	if !cl.Write(msg) {
+		c.drop(cl, msg)
+		return
 	}
+
+	c.log.WithFields(logrus.Fields{
+		"client":  cl.ID(),
+		"eventId": msg.ID,
+		"event":   msg.Event,
+	}).Info("wrote message to client")
 }
 
-// Write writes a given message to all clients in the channel
+// Write writes a given message to all clients in the channel whose event filters
+// accept it.
 func (c *Channel) Write(msg Message) {
+	c.write(msg, nil)
+}
+
+// write writes a given message to all clients in the channel. If the given set of
+// clients is not nil, the message is not written to clients in the set and each
+// client written to is added to it.
+func (c *Channel) write(msg Message, seen map[*Client]bool) {
 	c.log.WithFields(logrus.Fields{
 		"eventId": msg.ID,
 		"event":   msg.Event,
@@ -61,12 +112,25 @@ func (c *Channel) Write(msg Message) {
 	defer c.mux.Unlock()
 
 	for _, cl := range c.clients {
+		if !cl.Accepts(msg) || seen[cl] {
+			continue
+		}
+
+		if seen != nil {
+			seen[cl] = true
+		}
+
 		c.mux.Unlock()
 
-		cl.Write(msg)
+		ok := cl.Write(msg)
 
 		c.mux.Lock()
 
+		if !ok {
+			c.drop(cl, msg)
+			continue
+		}
+
 		c.log.WithFields(logrus.Fields{
 			"client":  cl.ID(),
 			"eventId": msg.ID,
@@ -75,6 +139,44 @@ func (c *Channel) Write(msg Message) {
 	}
 }
 
+func (c *Channel) drop(cl *Client, msg Message) {
+	atomic.AddUint64(&c.dropped, 1)
+
+	c.log.WithFields(logrus.Fields{
+		"client":  cl.ID(),
+		"eventId": msg.ID,
+		"event":   msg.Event,
+	}).Warn("dropped message for slow client")
+}
+
+// Dropped returns the total number of messages that could not be written to
+// clients in this channel because their buffers were full.
+func (c *Channel) Dropped() uint64 {
+	return atomic.LoadUint64(&c.dropped)
+}
+
+// members returns all clients in this channel.
+func (c *Channel) members() []*Client {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	out := make([]*Client, 0, len(c.clients))
+	for _, cl := range c.clients {
+		out = append(out, cl)
+	}
+
+	return out
+}
+
+// client returns the client in this channel with the given identifier.
+func (c *Channel) client(id string) (*Client, bool) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	cl, ok := c.clients[id]
+	return cl, ok
+}
+
 // ClientIDs returns an array of all client identifiers in this
 // channel.
 func (c *Channel) ClientIDs() []string {
@@ -90,19 +192,31 @@ func (c *Channel) ClientIDs() []string {
 	return out
 }
 
-// NewClient adds a new client to the channel
-func (c *Channel) NewClient(id string) (*Client, error) {
+// NewClient adds a new client to the channel. The given options are applied after
+// those the channel was configured with.
+func (c *Channel) NewClient(id string, opts ...ClientOption) (*Client, error) {
+	cl := NewClient(id, append(c.clientOpts[:len(c.clientOpts):len(c.clientOpts)], opts...)...)
+
+	if err := c.AddClient(cl); err != nil {
+		return nil, err
+	}
+
+	return cl, nil
+}
+
+// AddClient adds an existing client to the channel, allowing a single client to
+// receive messages from many channels.
+func (c *Channel) AddClient(cl *Client) error {
 	c.mux.Lock()
 	defer c.mux.Unlock()
 
-	if _, ok := c.clients[id]; ok {
-		return nil, fmt.Errorf("failed to add client to channel %s, client with id %s already exists", c.id, id)
+	if _, ok := c.clients[cl.ID()]; ok {
+		return fmt.Errorf("failed to add client to channel %s, client with id %s already exists", c.id, cl.ID())
 	}
 
-	cl := NewClient(id)
-	c.clients[id] = cl
+	c.clients[cl.ID()] = cl
 
-	return cl, nil
+	return nil
 }
 
 // NumClients returns the total number of clients for a
@@ -114,10 +228,14 @@ func (c *Channel) NumClients() int {
 	return len(c.clients)
 }
 
-// RemoveClient removes a client from the channel
+// RemoveClient removes a client from the channel. The client is closed so that
+// any writes blocked on its buffer are released.
 func (c *Channel) RemoveClient(id string) {
 	c.mux.Lock()
 	defer c.mux.Unlock()
 
-	delete(c.clients, id)
+	if cl, ok := c.clients[id]; ok {
+		cl.Close()
+		delete(c.clients, id)
+	}
 }
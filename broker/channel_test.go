@@ -2,6 +2,7 @@ package broker_test
 
 import (
 	"testing"
+	"time"
 
 	"github.com/davidsbond/sse-cluster/broker"
 	"github.com/sirupsen/logrus"
@@ -74,6 +75,40 @@ func TestChannel_WriteTo(t *testing.T) {
 	}
 }
 
+func TestChannel_WriteToBlocked(t *testing.T) {
+	t.Parallel()
+	logrus.SetLevel(logrus.PanicLevel)
+
+	ch := broker.NewChannel("test")
+	cl, _ := ch.NewClient("test")
+
+	// Fill the client's buffer so the next write blocks until it is removed.
+	ch.WriteTo(cl.ID(), broker.Message{ID: "1"})
+
+	done := make(chan struct{})
+	go func() {
+		ch.WriteTo(cl.ID(), broker.Message{ID: "2"})
+		close(done)
+	}()
+
+	removed := make(chan struct{})
+	go func() {
+		time.Sleep(time.Millisecond * 50)
+		ch.RemoveClient(cl.ID())
+		close(removed)
+	}()
+
+	select {
+	case <-removed:
+	case <-time.After(time.Second):
+		assert.Fail(t, "removing the client blocked on a pending write")
+		return
+	}
+
+	<-done
+	assert.Equal(t, uint64(1), ch.Dropped())
+}
+
 func TestChannel_NewClient(t *testing.T) {
 	t.Parallel()
 	logrus.SetLevel(logrus.PanicLevel)
@@ -190,3 +225,96 @@ func TestChannel_RemoveClient(t *testing.T) {
 		})
 	}
 }
+
+func TestChannel_Dropped(t *testing.T) {
+	t.Parallel()
+	logrus.SetLevel(logrus.PanicLevel)
+
+	tt := []struct {
+		Name            string
+		Messages        []broker.Message
+		ExpectedDropped uint64
+	}{
+		{
+			Name:            "It should count messages dropped for slow clients",
+			Messages:        []broker.Message{{ID: "1"}, {ID: "2"}, {ID: "3"}},
+			ExpectedDropped: 2,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.Name, func(t *testing.T) {
+			ch := broker.NewChannel("test", broker.WithClientOptions(
+				broker.WithOverflowPolicy(broker.OverflowDropNewest),
+			))
+
+			if _, err := ch.NewClient("test"); err != nil {
+				assert.Fail(t, err.Error())
+				return
+			}
+
+			for _, msg := range tc.Messages {
+				ch.Write(msg)
+			}
+
+			assert.Equal(t, tc.ExpectedDropped, ch.Dropped())
+		})
+	}
+}
+
+func TestChannel_WriteFiltered(t *testing.T) {
+	t.Parallel()
+	logrus.SetLevel(logrus.PanicLevel)
+
+	tt := []struct {
+		Name           string
+		Filter         string
+		Messages       []broker.Message
+		ExpectedEvents []string
+	}{
+		{
+			Name:   "It should only write included events",
+			Filter: "a,b",
+			Messages: []broker.Message{
+				{Event: "a"},
+				{Event: "c"},
+				{Event: "b"},
+			},
+			ExpectedEvents: []string{"a", "b"},
+		},
+		{
+			Name:   "It should not write excluded events",
+			Filter: "!c",
+			Messages: []broker.Message{
+				{Event: "a"},
+				{Event: "c"},
+			},
+			ExpectedEvents: []string{"a"},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.Name, func(t *testing.T) {
+			ch := broker.NewChannel("test", broker.WithClientOptions(broker.WithBufferSize(len(tc.Messages))))
+			cl, err := ch.NewClient("test", broker.WithEventFilter(broker.ParseEventFilter(tc.Filter)))
+
+			if err != nil {
+				assert.Fail(t, err.Error())
+				return
+			}
+
+			for _, msg := range tc.Messages {
+				ch.Write(msg)
+			}
+
+			var events []string
+			for len(cl.Messages()) > 0 {
+				msg := <-cl.Messages()
+				events = append(events, msg.Event)
+			}
+
+			assert.Equal(t, tc.ExpectedEvents, events)
+			assert.Equal(t, uint64(0), ch.Dropped())
+		})
+	}
+}
@@ -1,21 +1,121 @@
 package broker
 
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
 type (
 	// The Client type represents a single client connected to the
 	// broker
 	Client struct {
 		id       string
 		messages chan Message
+		policy   OverflowPolicy
+		timeout  time.Duration
+		done     chan struct{}
+		once     sync.Once
+		filter   EventFilter
+		metadata map[string]string
+		acks     bool
+		inflight *inflight
 	}
+
+	// The ClientOption type is a function that modifies the configuration of
+	// a client on creation.
+	ClientOption func(*Client)
+
+	// The OverflowPolicy type determines what happens when a message is written
+	// to a client whose buffer is full.
+	OverflowPolicy string
+)
+
+const (
+	// OverflowBlock waits for space in the client's buffer. If a timeout is set
+	// and the buffer is still full once it elapses, the message is dropped.
+	OverflowBlock OverflowPolicy = "block"
+
+	// OverflowDropOldest discards the oldest message in the client's buffer to
+	// make space for the new one.
+	OverflowDropOldest OverflowPolicy = "drop-oldest"
+
+	// OverflowDropNewest discards the message being written.
+	OverflowDropNewest OverflowPolicy = "drop-newest"
+
+	// OverflowDisconnect discards the message being written and disconnects
+	// the client.
+	OverflowDisconnect OverflowPolicy = "disconnect"
 )
 
+// ParseOverflowPolicy converts a string into an OverflowPolicy, returning an
+// error if it is not a known policy.
+func ParseOverflowPolicy(s string) (OverflowPolicy, error) {
+	switch p := OverflowPolicy(s); p {
+	case OverflowBlock, OverflowDropOldest, OverflowDropNewest, OverflowDisconnect:
+		return p, nil
+	default:
+		return "", fmt.Errorf("unknown overflow policy %s", s)
+	}
+}
+
+// WithBufferSize sets the number of messages that can be queued for a client
+// before its overflow policy applies.
+func WithBufferSize(size int) ClientOption {
+	return func(c *Client) {
+		if size > 0 {
+			c.messages = make(chan Message, size)
+		}
+	}
+}
+
+// WithOverflowPolicy sets what happens when a message is written to the client
+// while its buffer is full.
+func WithOverflowPolicy(policy OverflowPolicy) ClientOption {
+	return func(c *Client) {
+		c.policy = policy
+	}
+}
+
+// WithBlockTimeout sets how long writes wait for space in the client's buffer
+// when using the OverflowBlock policy. A timeout of zero waits indefinitely.
+func WithBlockTimeout(timeout time.Duration) ClientOption {
+	return func(c *Client) {
+		c.timeout = timeout
+	}
+}
+
+// WithEventFilter sets the event types that are written to the client, messages
+// rejected by the filter are never queued.
+func WithEventFilter(filter EventFilter) ClientOption {
+	return func(c *Client) {
+		c.filter = filter
+	}
+}
+
+// WithMetadata sets information describing the client, such as a user's name,
+// that is reported alongside it by the presence API.
+func WithMetadata(metadata map[string]string) ClientOption {
+	return func(c *Client) {
+		c.metadata = metadata
+	}
+}
+
 // NewClient creates a new instance of the Client type with the given
 // identifier.
-func NewClient(id string) *Client {
-	return &Client{
+func NewClient(id string, opts ...ClientOption) *Client {
+	cl := &Client{
 		id:       id,
 		messages: make(chan Message, 1),
+		policy:   OverflowBlock,
+		done:     make(chan struct{}),
+	}
+
+	for _, opt := range opts {
+		opt(cl)
 	}
+
+	return cl
 }
 
 // ID returns this client's identifier.
@@ -23,12 +123,135 @@ func (c *Client) ID() string {
 	return c.id
 }
 
-// Write writes a given array of bytes to a client
-func (c *Client) Write(msg Message) {
-	c.messages <- msg
+// Metadata returns the information describing this client. The returned map must
+// not be modified.
+func (c *Client) Metadata() map[string]string {
+	return c.metadata
+}
+
+// Write writes a given message to a client, applying the client's overflow policy
+// if its buffer is full. Messages written to a client that uses acknowledgements
+// are held for it until they are acknowledged, and writes to it never wait. Returns
+// false if a message was dropped as a result.
+func (c *Client) Write(msg Message) bool {
+	if c.inflight != nil {
+		select {
+		case <-c.done:
+			return false
+		default:
+			return c.inflight.write(c, msg)
+		}
+	}
+
+	select {
+	case <-c.done:
+		return false
+	case c.messages <- msg:
+		return true
+	default:
+	}
+
+	switch c.policy {
+	case OverflowDropNewest:
+		return false
+	case OverflowDisconnect:
+		c.Close()
+		return false
+	case OverflowDropOldest:
+		dropped := false
+
+		for {
+			select {
+			case <-c.messages:
+				dropped = true
+			default:
+			}
+
+			select {
+			case c.messages <- msg:
+				return !dropped
+			default:
+			}
+		}
+	default:
+		return c.block(msg)
+	}
+}
+
+func (c *Client) block(msg Message) bool {
+	var timeout <-chan time.Time
+
+	if c.timeout > 0 {
+		timer := time.NewTimer(c.timeout)
+		defer timer.Stop()
+
+		timeout = timer.C
+	}
+
+	select {
+	case c.messages <- msg:
+		return true
+	case <-c.done:
+		return false
+	case <-timeout:
+		return false
+	}
+}
+
+// Accepts returns true if the message passes the client's event filter and should
+// be written to it. Clients never receive presence events about themselves.
+func (c *Client) Accepts(msg Message) bool {
+	if msg.exclude != "" && msg.exclude == c.id {
+		return false
+	}
+
+	return c.filter.Accepts(msg)
 }
 
 // Messages returns a read-only channel for this client's messages.
 func (c *Client) Messages() <-chan Message {
 	return c.messages
 }
+
+// Track records a message written to a client that uses acknowledgements other
+// than through its buffer, such as when replaying history, so that it is
+// redelivered if the client reconnects before acknowledging it. Messages written
+// through its buffer are already recorded.
+func (c *Client) Track(msg Message) {
+	if c.inflight != nil {
+		c.inflight.track(msg)
+	}
+}
+
+// Untrack stops waiting for a client that uses acknowledgements to acknowledge a
+// message that will never be written to it, such as one that expired while in its
+// buffer.
+func (c *Client) Untrack(msg Message) {
+	if c.inflight != nil {
+		c.inflight.untrack(msg)
+	}
+}
+
+// Unacked returns the messages written to a client that uses acknowledgements,
+// during this or a previous connection, that it hasn't acknowledged.
+func (c *Client) Unacked() []Message {
+	if c.inflight == nil {
+		return nil
+	}
+
+	return c.inflight.messages()
+}
+
+// Close marks the client as disconnected, any subsequent messages written to it
+// are dropped.
+func (c *Client) Close() {
+	c.once.Do(func() {
+		close(c.done)
+	})
+}
+
+// Done returns a channel that is closed when the client has been disconnected
+// by the broker.
+func (c *Client) Done() <-chan struct{} {
+	return c.done
+}
@@ -1 +1,130 @@
 package broker_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/davidsbond/sse-cluster/broker"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClient_Write(t *testing.T) {
+	t.Parallel()
+
+	tt := []struct {
+		Name             string
+		Options          []broker.ClientOption
+		Messages         []broker.Message
+		ExpectedResults  []bool
+		ExpectedMessages []broker.Message
+		ExpectClosed     bool
+	}{
+		{
+			Name: "It should write messages while the buffer has space",
+			Options: []broker.ClientOption{
+				broker.WithBufferSize(2),
+			},
+			Messages:         []broker.Message{{ID: "1"}, {ID: "2"}},
+			ExpectedResults:  []bool{true, true},
+			ExpectedMessages: []broker.Message{{ID: "1"}, {ID: "2"}},
+		},
+		{
+			Name: "It should drop the message after the block timeout",
+			Options: []broker.ClientOption{
+				broker.WithOverflowPolicy(broker.OverflowBlock),
+				broker.WithBlockTimeout(time.Millisecond * 10),
+			},
+			Messages:         []broker.Message{{ID: "1"}, {ID: "2"}},
+			ExpectedResults:  []bool{true, false},
+			ExpectedMessages: []broker.Message{{ID: "1"}},
+		},
+		{
+			Name: "It should drop the oldest message",
+			Options: []broker.ClientOption{
+				broker.WithBufferSize(2),
+				broker.WithOverflowPolicy(broker.OverflowDropOldest),
+			},
+			Messages:         []broker.Message{{ID: "1"}, {ID: "2"}, {ID: "3"}},
+			ExpectedResults:  []bool{true, true, false},
+			ExpectedMessages: []broker.Message{{ID: "2"}, {ID: "3"}},
+		},
+		{
+			Name: "It should drop the newest message",
+			Options: []broker.ClientOption{
+				broker.WithBufferSize(2),
+				broker.WithOverflowPolicy(broker.OverflowDropNewest),
+			},
+			Messages:         []broker.Message{{ID: "1"}, {ID: "2"}, {ID: "3"}},
+			ExpectedResults:  []bool{true, true, false},
+			ExpectedMessages: []broker.Message{{ID: "1"}, {ID: "2"}},
+		},
+		{
+			Name: "It should disconnect the client",
+			Options: []broker.ClientOption{
+				broker.WithOverflowPolicy(broker.OverflowDisconnect),
+			},
+			Messages:         []broker.Message{{ID: "1"}, {ID: "2"}, {ID: "3"}},
+			ExpectedResults:  []bool{true, false, false},
+			ExpectedMessages: []broker.Message{{ID: "1"}},
+			ExpectClosed:     true,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.Name, func(t *testing.T) {
+			cl := broker.NewClient("test", tc.Options...)
+
+			var results []bool
+			for _, msg := range tc.Messages {
+				results = append(results, cl.Write(msg))
+			}
+
+			assert.Equal(t, tc.ExpectedResults, results)
+
+			var msgs []broker.Message
+			for len(cl.Messages()) > 0 {
+				msgs = append(msgs, <-cl.Messages())
+			}
+
+			assert.Equal(t, tc.ExpectedMessages, msgs)
+
+			select {
+			case <-cl.Done():
+				assert.True(t, tc.ExpectClosed)
+			default:
+				assert.False(t, tc.ExpectClosed)
+			}
+		})
+	}
+}
+
+func TestParseOverflowPolicy(t *testing.T) {
+	t.Parallel()
+
+	tt := []struct {
+		Name           string
+		Policy         string
+		ExpectedPolicy broker.OverflowPolicy
+		ExpectError    bool
+	}{
+		{
+			Name:           "It should parse a known policy",
+			Policy:         "drop-oldest",
+			ExpectedPolicy: broker.OverflowDropOldest,
+		},
+		{
+			Name:        "It should return an error for an unknown policy",
+			Policy:      "unknown",
+			ExpectError: true,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.Name, func(t *testing.T) {
+			policy, err := broker.ParseOverflowPolicy(tc.Policy)
+
+			assert.Equal(t, tc.ExpectError, err != nil)
+			assert.Equal(t, tc.ExpectedPolicy, policy)
+		})
+	}
+}
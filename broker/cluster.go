@@ -0,0 +1,172 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+	"github.com/sirupsen/logrus"
+)
+
+type (
+	// The ClusterStatus type represents the merged status of every node in the
+	// cluster. It contains the status of each node that responded, the errors of
+	// those that didn't and totals across the cluster.
+	ClusterStatus struct {
+		Nodes       map[string]*NodeStatus `json:"nodes"`
+		Unreachable map[string]string      `json:"unreachable"`
+		Totals      struct {
+			Nodes       int `json:"nodes"`
+			Unreachable int `json:"unreachable"`
+			Goroutines  int `json:"num_goroutines"`
+			Channels    int `json:"channels"`
+			Clients     int `json:"clients"`
+		} `json:"totals"`
+	}
+
+	// The NodeStatus type represents the status of a single node within the
+	// cluster status. It contains the number of clients in each of the node's
+	// channels.
+	NodeStatus struct {
+		Goroutines int            `json:"num_goroutines"`
+		Channels   map[string]int `json:"channels"`
+		Clients    int            `json:"clients"`
+	}
+)
+
+// DefaultStatusTimeout is how long each node is given to report its status for
+// the cluster status when no timeout is specified.
+const DefaultStatusTimeout = time.Second * 2
+
+// WithStatusTimeout sets how long each node is given to report its status for the
+// cluster status, or its clients for presence lookups. Nodes that take longer are
+// reported as unreachable.
+func WithStatusTimeout(timeout time.Duration) Option {
+	return func(b *Broker) {
+		b.statusTimeout = timeout
+	}
+}
+
+// ClusterStatus returns the status of every node in the cluster. Other nodes are
+// asked for their status in parallel, each within the broker's status timeout so
+// that a node that has left doesn't delay the response.
+func (b *Broker) ClusterStatus() *ClusterStatus {
+	status := &ClusterStatus{
+		Nodes:       make(map[string]*NodeStatus),
+		Unreachable: make(map[string]string),
+	}
+
+	local := b.memberlist.LocalNode().Name
+	status.Nodes[local] = newNodeStatus(b.Status())
+
+	var mux sync.Mutex
+	var wg sync.WaitGroup
+
+	for _, member := range b.memberlist.Members() {
+		if member.Name == local {
+			continue
+		}
+
+		wg.Add(1)
+		go func(member *memberlist.Node) {
+			defer wg.Done()
+
+			node, err := b.nodeStatus(member)
+
+			mux.Lock()
+			defer mux.Unlock()
+
+			if err != nil {
+				b.log.WithFields(logrus.Fields{
+					"targetNodeId": member.Name,
+				}).WithError(err).Error("failed to get status from node")
+
+				status.Unreachable[member.Name] = err.Error()
+				return
+			}
+
+			status.Nodes[member.Name] = newNodeStatus(node)
+		}(member)
+	}
+
+	wg.Wait()
+
+	channels := make(map[string]bool)
+	for _, node := range status.Nodes {
+		status.Totals.Goroutines += node.Goroutines
+		status.Totals.Clients += node.Clients
+
+		for id := range node.Channels {
+			channels[id] = true
+		}
+	}
+
+	status.Totals.Nodes = len(status.Nodes)
+	status.Totals.Unreachable = len(status.Unreachable)
+	status.Totals.Channels = len(channels)
+
+	return status
+}
+
+func (b *Broker) nodeStatus(member *memberlist.Node) (*Status, error) {
+	ctx := context.Background()
+	if b.statusTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, b.statusTimeout)
+		defer cancel()
+	}
+
+	u := fmt.Sprintf("http://%s:%s/status", member.Addr.String(), string(member.Meta))
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := b.http.Do(req.WithContext(ctx))
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		data, _ := ioutil.ReadAll(resp.Body)
+		return nil, fmt.Errorf(string(data))
+	}
+
+	var status Status
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return nil, err
+	}
+
+	return &status, nil
+}
+
+// newNodeStatus summarises the status of a node. Clients subscribed to many of the
+// node's channels are counted once.
+func newNodeStatus(status *Status) *NodeStatus {
+	node := &NodeStatus{
+		Goroutines: status.Goroutines,
+		Channels:   make(map[string]int),
+	}
+
+	clients := make(map[string]bool)
+	for id, ids := range status.Channels {
+		node.Channels[id] = len(ids)
+
+		for _, clientID := range ids {
+			clients[clientID] = true
+		}
+	}
+
+	node.Clients = len(clients)
+
+	return node
+}
@@ -0,0 +1,292 @@
+package broker
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+type (
+	// The ChannelConfig type contains the settings of a declared channel. Declared
+	// channels are shared with every node in the cluster and keep their settings
+	// while they have no subscribers. Settings left as their zero value use the
+	// broker's defaults.
+	ChannelConfig struct {
+		ID string `json:"id"`
+
+		// The number of messages kept in the channel's history, and the number of
+		// milliseconds the history is kept for after the last message was published.
+		HistorySize int `json:"history_size,omitempty"`
+		Retention   int `json:"retention,omitempty"`
+
+		// The number of clients that can subscribe to the channel on each node.
+		MaxClients int `json:"max_clients,omitempty"`
+
+		// Whether messages are written to every subscriber or a single one, and
+		// how the subscriber is chosen when using DeliveryQueue.
+		Delivery  Delivery  `json:"delivery,omitempty"`
+		Selection Selection `json:"selection,omitempty"`
+
+		// The token clients must provide to subscribe to the channel or read its
+		// history. It is never returned once declared, AuthRequired indicates
+		// whether one is set.
+		Token        string `json:"token,omitempty"`
+		AuthRequired bool   `json:"auth_required"`
+
+		// The reconnection time in milliseconds given to messages published to the
+		// channel without one.
+		Retry int `json:"retry,omitempty"`
+
+		// The time the channel was last declared. When nodes disagree on a
+		// channel's settings, the most recent declaration wins.
+		Updated time.Time `json:"updated"`
+	}
+
+	// The channelConfigs type holds the settings of every declared channel,
+	// along with channels that were deleted, so that a deletion isn't undone by
+	// a node that hasn't heard about it yet.
+	channelConfigs struct {
+		mux     sync.Mutex
+		entries map[string]channelConfigEntry
+	}
+
+	// The channelConfigEntry type is the settings of a channel as shared with other
+	// nodes.
+	channelConfigEntry struct {
+		Config  ChannelConfig `json:"config"`
+		Deleted bool          `json:"deleted,omitempty"`
+	}
+)
+
+func newChannelConfigs() *channelConfigs {
+	return &channelConfigs{
+		entries: make(map[string]channelConfigEntry),
+	}
+}
+
+// DeclareChannel sets the settings of a channel, replacing any it had before, and
+// shares them with other nodes. It returns the settings as declared. The channel
+// doesn't need to have any subscribers.
+func (b *Broker) DeclareChannel(cfg ChannelConfig) (ChannelConfig, error) {
+	if err := cfg.validate(); err != nil {
+		return ChannelConfig{}, err
+	}
+
+	cfg.AuthRequired = cfg.Token != ""
+	cfg.Updated = b.configs.next(cfg.ID)
+
+	b.declare(channelConfigEntry{Config: cfg})
+
+	b.log.WithField("channel", cfg.ID).Info("declared channel")
+
+	return cfg.redacted(), nil
+}
+
+// DescribeChannel returns the settings of a declared channel. It returns false if
+// the channel hasn't been declared.
+func (b *Broker) DescribeChannel(channelID string) (ChannelConfig, bool) {
+	cfg, ok := b.configs.get(channelID)
+
+	return cfg.redacted(), ok
+}
+
+// DeleteChannel removes the settings of a declared channel from every node, so it
+// uses the broker's defaults. Its subscribers are not disconnected. Returns
+// ErrChannelNotFound if the channel hasn't been declared.
+func (b *Broker) DeleteChannel(channelID string) error {
+	if _, ok := b.configs.get(channelID); !ok {
+		return ErrChannelNotFound
+	}
+
+	b.declare(channelConfigEntry{
+		Config:  ChannelConfig{ID: channelID, Updated: b.configs.next(channelID)},
+		Deleted: true,
+	})
+
+	b.log.WithField("channel", channelID).Info("deleted channel")
+
+	return nil
+}
+
+// Authorize checks that the given token allows subscribing to the given channels.
+// Subscriptions using wildcards need the token of every declared channel they
+// match. Returns ErrUnauthorized if the token is missing or wrong for any channel.
+func (b *Broker) Authorize(channelIDs []string, token string) error {
+	for _, cfg := range b.configs.all() {
+		if cfg.Token == "" {
+			continue
+		}
+
+		for _, channelID := range channelIDs {
+			if !Match(channelID, cfg.ID) {
+				continue
+			}
+
+			if subtle.ConstantTimeCompare([]byte(cfg.Token), []byte(token)) != 1 {
+				return ErrUnauthorized
+			}
+		}
+	}
+
+	return nil
+}
+
+// declare records the settings of a channel, sharing them with other nodes if the
+// broker tracks locations.
+func (b *Broker) declare(entry channelConfigEntry) {
+	if b.locations != nil {
+		b.locations.declare(entry)
+		return
+	}
+
+	b.configs.merge(entry)
+}
+
+// channelHistorySize returns the number of messages kept in the history of a channel.
+func (b *Broker) channelHistorySize(channelID string) int {
+	if cfg, ok := b.configs.get(channelID); ok && cfg.HistorySize > 0 {
+		return cfg.HistorySize
+	}
+
+	return b.historySize
+}
+
+// channelRetention returns how long the history of a channel is kept for after the
+// last message was published to it.
+func (b *Broker) channelRetention(channelID string) time.Duration {
+	if cfg, ok := b.configs.get(channelID); ok && cfg.Retention > 0 {
+		return time.Duration(cfg.Retention) * time.Millisecond
+	}
+
+	return b.historyRetention
+}
+
+// full returns true if a declared channel has as many clients on this node as it
+// allows.
+func (b *Broker) full(ch *Channel) bool {
+	cfg, ok := b.configs.get(ch.id)
+
+	return ok && cfg.MaxClients > 0 && ch.NumClients() >= cfg.MaxClients
+}
+
+// validate returns an error if the settings cannot be used.
+func (cfg ChannelConfig) validate() error {
+	if cfg.ID == "" {
+		return errors.New("a channel identifier must be provided")
+	}
+
+	if IsWildcard(cfg.ID) {
+		return fmt.Errorf("cannot declare wildcard channel %s", cfg.ID)
+	}
+
+	if cfg.HistorySize < 0 || cfg.Retention < 0 || cfg.MaxClients < 0 || cfg.Retry < 0 {
+		return errors.New("channel settings cannot be negative")
+	}
+
+	if cfg.Delivery != "" {
+		if _, err := ParseDelivery(string(cfg.Delivery)); err != nil {
+			return err
+		}
+	}
+
+	if cfg.Selection != "" {
+		if _, err := ParseSelection(string(cfg.Selection)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// redacted returns the settings without the channel's token.
+func (cfg ChannelConfig) redacted() ChannelConfig {
+	cfg.Token = ""
+	return cfg
+}
+
+// merge records the settings of a channel if they are newer than those already
+// known. When two declarations were made at the same time, deletions win. It
+// returns true if the settings were recorded.
+func (c *channelConfigs) merge(entry channelConfigEntry) bool {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	current, ok := c.entries[entry.Config.ID]
+
+	if ok {
+		switch {
+		case entry.Config.Updated.Before(current.Config.Updated):
+			return false
+		case entry.Config.Updated.Equal(current.Config.Updated) && (current.Deleted || !entry.Deleted):
+			return false
+		}
+	}
+
+	c.entries[entry.Config.ID] = entry
+	return true
+}
+
+// next returns the time to record a change to a channel's settings at. It is
+// normally the current time, but is always later than the last change so that the
+// change isn't ignored if another node's clock is ahead.
+func (c *channelConfigs) next(channelID string) time.Time {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	now := time.Now().Round(0)
+	if entry, ok := c.entries[channelID]; ok && !now.After(entry.Config.Updated) {
+		return entry.Config.Updated.Add(time.Nanosecond)
+	}
+
+	return now
+}
+
+// get returns the settings of a declared channel.
+func (c *channelConfigs) get(channelID string) (ChannelConfig, bool) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	entry, ok := c.entries[channelID]
+
+	if !ok || entry.Deleted {
+		return ChannelConfig{}, false
+	}
+
+	return entry.Config, true
+}
+
+// all returns the settings of every declared channel.
+func (c *channelConfigs) all() []ChannelConfig {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	var out []ChannelConfig
+	for _, entry := range c.entries {
+		if !entry.Deleted {
+			out = append(out, entry.Config)
+		}
+	}
+
+	return out
+}
+
+// state returns the settings of every channel, including deleted ones, ordered by
+// channel identifier.
+func (c *channelConfigs) state() []channelConfigEntry {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	out := make([]channelConfigEntry, 0, len(c.entries))
+	for _, entry := range c.entries {
+		out = append(out, entry)
+	}
+
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Config.ID < out[j].Config.ID
+	})
+
+	return out
+}
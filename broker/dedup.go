@@ -0,0 +1,74 @@
+package broker
+
+import (
+	"sync"
+	"time"
+)
+
+type (
+	// The deduplicator type remembers the keys of recently published messages so
+	// that retried publishes within a window of time can be detected.
+	deduplicator struct {
+		mux    sync.Mutex
+		window time.Duration
+		seen   map[string]seenKey
+		order  []seenKey
+	}
+
+	seenKey struct {
+		key string
+		id  string
+		at  time.Time
+	}
+)
+
+func newDeduplicator(window time.Duration) *deduplicator {
+	return &deduplicator{
+		window: window,
+		seen:   make(map[string]seenKey),
+	}
+}
+
+// check records the key of a published message along with its identifier. If the
+// key was already seen within the window, the identifier of the original message
+// is returned along with true.
+func (d *deduplicator) check(key, id string) (string, bool) {
+	if d.window <= 0 || key == "" {
+		return id, false
+	}
+
+	d.mux.Lock()
+	defer d.mux.Unlock()
+
+	now := time.Now()
+
+	// Keys are recorded in order, so forget everything older than the window
+	// from the front of the queue. Keys that were released and seen again have
+	// a newer entry further back that must be kept.
+	for len(d.order) > 0 && now.Sub(d.order[0].at) > d.window {
+		if oldest := d.order[0]; d.seen[oldest.key].at.Equal(oldest.at) {
+			delete(d.seen, oldest.key)
+		}
+
+		d.order = d.order[1:]
+	}
+
+	if original, ok := d.seen[key]; ok {
+		return original.id, true
+	}
+
+	seen := seenKey{key: key, id: id, at: now}
+	d.seen[key] = seen
+	d.order = append(d.order, seen)
+
+	return id, false
+}
+
+// release forgets a key recorded by check, so that a message that could not be
+// published can be retried.
+func (d *deduplicator) release(key string) {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+
+	delete(d.seen, key)
+}
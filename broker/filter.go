@@ -0,0 +1,59 @@
+package broker
+
+import "strings"
+
+type (
+	// The EventFilter type determines which event types are written to a client.
+	// Events are accepted if they match one of the included types, or if no types
+	// are included, and do not match any of the excluded types.
+	EventFilter struct {
+		include map[string]bool
+		exclude map[string]bool
+	}
+)
+
+// The event type browsers dispatch messages as when no event is specified.
+const defaultEventType = "message"
+
+// ParseEventFilter creates an EventFilter from comma-separated lists of event types.
+// Types prefixed with '!' are excluded, all others are included. For example,
+// 'a,b' accepts only 'a' and 'b' events, while '!c' accepts everything except
+// 'c' events.
+func ParseEventFilter(values ...string) EventFilter {
+	f := EventFilter{
+		include: make(map[string]bool),
+		exclude: make(map[string]bool),
+	}
+
+	for _, value := range values {
+		for _, event := range strings.Split(value, ",") {
+			event = strings.TrimSpace(event)
+
+			switch {
+			case event == "", event == "!":
+				continue
+			case strings.HasPrefix(event, "!"):
+				f.exclude[event[1:]] = true
+			default:
+				f.include[event] = true
+			}
+		}
+	}
+
+	return f
+}
+
+// Accepts returns true if a message passes the filter. Messages without an event
+// type are treated as 'message' events.
+func (f EventFilter) Accepts(msg Message) bool {
+	event := msg.Event
+	if event == "" {
+		event = defaultEventType
+	}
+
+	if f.exclude[event] {
+		return false
+	}
+
+	return len(f.include) == 0 || f.include[event]
+}
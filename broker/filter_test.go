@@ -0,0 +1,66 @@
+package broker_test
+
+import (
+	"testing"
+
+	"github.com/davidsbond/sse-cluster/broker"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEventFilter_Accepts(t *testing.T) {
+	t.Parallel()
+
+	tt := []struct {
+		Name     string
+		Filters  []string
+		Event    string
+		Expected bool
+	}{
+		{
+			Name:     "It should accept everything without filters",
+			Event:    "a",
+			Expected: true,
+		},
+		{
+			Name:     "It should accept included events",
+			Filters:  []string{"a,b"},
+			Event:    "b",
+			Expected: true,
+		},
+		{
+			Name:    "It should reject events that aren't included",
+			Filters: []string{"a,b"},
+			Event:   "c",
+		},
+		{
+			Name:    "It should reject excluded events",
+			Filters: []string{"!c"},
+			Event:   "c",
+		},
+		{
+			Name:     "It should accept events that aren't excluded",
+			Filters:  []string{"!c"},
+			Event:    "a",
+			Expected: true,
+		},
+		{
+			Name:     "It should treat events without a type as messages",
+			Filters:  []string{"message"},
+			Expected: true,
+		},
+		{
+			Name:     "It should combine many filters",
+			Filters:  []string{"a", "b", "!b"},
+			Event:    "a",
+			Expected: true,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.Name, func(t *testing.T) {
+			f := broker.ParseEventFilter(tc.Filters...)
+
+			assert.Equal(t, tc.Expected, f.Accepts(broker.Message{Event: tc.Event}))
+		})
+	}
+}
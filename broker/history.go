@@ -0,0 +1,79 @@
+package broker
+
+import (
+	"sort"
+	"time"
+)
+
+type (
+	// The history type is a bounded buffer of the most recent messages published
+	// to a channel. Once the buffer is full, the oldest message is discarded
+	// for each new message written.
+	history struct {
+		size    int
+		entries []historyEntry
+		written time.Time
+	}
+
+	// The historyEntry type is a message in a history along with its position in
+	// the order messages were published to the broker, so that the histories of
+	// many channels can be merged.
+	historyEntry struct {
+		seq uint64
+		msg Message
+	}
+)
+
+func newHistory(size int) *history {
+	return &history{
+		size: size,
+	}
+}
+
+// write appends a message to the history, discarding the oldest message if the
+// buffer is full.
+func (h *history) write(seq uint64, msg Message) {
+	h.written = time.Now()
+
+	if h.size <= 0 {
+		return
+	}
+
+	if len(h.entries) >= h.size {
+		h.entries = append(h.entries[:0], h.entries[len(h.entries)-h.size+1:]...)
+	}
+
+	h.entries = append(h.entries, historyEntry{seq: seq, msg: msg})
+}
+
+// since returns all messages in the given entries written after the message with
+// the given identifier, oldest first. If the identifier is empty or no longer in
+// the entries, all of them are returned as the caller has missed at least that many.
+// If a limit is given, only that many of the most recent messages are returned.
+// It also returns whether the identifier was found.
+func since(entries []historyEntry, id string, limit int) ([]Message, bool) {
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].seq < entries[j].seq
+	})
+
+	start := 0
+	found := false
+	for i := len(entries) - 1; i >= 0 && id != ""; i-- {
+		if entries[i].msg.ID == id {
+			start = i + 1
+			found = true
+			break
+		}
+	}
+
+	if limit > 0 && len(entries)-start > limit {
+		start = len(entries) - limit
+	}
+
+	out := make([]Message, 0, len(entries)-start)
+	for _, entry := range entries[start:] {
+		out = append(out, entry.msg)
+	}
+
+	return out, found
+}
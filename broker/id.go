@@ -0,0 +1,110 @@
+package broker
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type (
+	// The idGenerator type assigns identifiers to messages published without one.
+	// Identifiers are made up of a fixed-width hexadecimal timestamp followed by the
+	// name of the node that assigned them, so they sort in publish order and are
+	// unique across the cluster. Timestamps increase for each channel, even if the
+	// clock goes backwards or identifiers assigned by other nodes are ahead.
+	idGenerator struct {
+		mux   sync.Mutex
+		node  string
+		last  map[string]int64
+		swept int64
+	}
+)
+
+const (
+	// The number of hexadecimal digits used for the timestamp of an identifier.
+	idTimestampWidth = 16
+
+	// How far behind the clock the last timestamp of a channel must be before it
+	// is forgotten. Timestamps generated after that are later anyway, unless the
+	// clock goes backwards by more than this.
+	idSkewMargin = time.Minute
+)
+
+func newIDGenerator(node string) *idGenerator {
+	return &idGenerator{
+		node: node,
+		last: make(map[string]int64),
+	}
+}
+
+// next returns a new identifier for a message published to the given channel.
+func (g *idGenerator) next(channelID string) string {
+	g.mux.Lock()
+	defer g.mux.Unlock()
+
+	now := time.Now().UnixNano()
+	g.sweep(now)
+
+	ts := now
+	if last := g.last[channelID]; ts <= last {
+		ts = last + 1
+	}
+
+	g.last[channelID] = ts
+
+	return fmt.Sprintf("%0*x-%s", idTimestampWidth, ts, g.node)
+}
+
+// observe records an identifier assigned elsewhere for the given channel, so that
+// the next identifier generated for the channel sorts after it. Identifiers that
+// were not assigned by a broker are ignored.
+func (g *idGenerator) observe(channelID, id string) {
+	ts, ok := idTimestamp(id)
+
+	if !ok {
+		return
+	}
+
+	g.mux.Lock()
+	defer g.mux.Unlock()
+
+	g.sweep(time.Now().UnixNano())
+
+	if ts > g.last[channelID] {
+		g.last[channelID] = ts
+	}
+}
+
+// sweep forgets the last timestamps of channels that are older than the skew
+// margin, so that channels no longer published to don't accumulate. Channels are
+// swept at most once per margin.
+func (g *idGenerator) sweep(now int64) {
+	margin := int64(idSkewMargin)
+	if now-g.swept < margin {
+		return
+	}
+
+	g.swept = now
+	for channelID, last := range g.last {
+		if now-last > margin {
+			delete(g.last, channelID)
+		}
+	}
+}
+
+// idTimestamp returns the timestamp of an identifier assigned by a broker. It
+// returns false if the identifier was not assigned by a broker.
+func idTimestamp(id string) (int64, bool) {
+	if len(id) <= idTimestampWidth || id[idTimestampWidth] != '-' {
+		return 0, false
+	}
+
+	ts, err := strconv.ParseInt(id[:idTimestampWidth], 16, 64)
+
+	if err != nil {
+		return 0, false
+	}
+
+	return ts, true
+}
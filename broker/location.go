@@ -0,0 +1,480 @@
+package broker
+
+import (
+	"encoding/json"
+	"sort"
+	"sync"
+
+	"github.com/hashicorp/memberlist"
+	"github.com/sirupsen/logrus"
+)
+
+type (
+	// The Locations type tracks the node each client in the cluster is connected
+	// to and the channels each node has subscribers for. It implements the
+	// memberlist Delegate and EventDelegate interfaces, so that both are shared
+	// through gossip. Messages for a single client can then be sent straight to
+	// its node, and messages for a channel only to nodes with subscribers. The
+	// settings of declared channels are shared in the same way.
+	Locations struct {
+		node       string
+		meta       []byte
+		mux        sync.Mutex
+		local      map[string]int
+		channels   map[string]bool
+		port       int
+		remote     map[string]*nodeLocations
+		configs    *channelConfigs
+		broadcasts *memberlist.TransmitLimitedQueue
+		log        *logrus.Entry
+
+		// Handles messages other than location updates sent by other nodes, such
+		// as events propagated through the memberlist.
+		handler func(byte, []byte)
+	}
+
+	// The nodeLocations type contains the clients connected to another node and
+	// the channels it has subscribers for.
+	nodeLocations struct {
+		clients  map[string]bool
+		channels map[string]bool
+		port     int
+	}
+
+	// The locationUpdate type is broadcast to other nodes when a client connects
+	// to or disconnects from a node, a node gains or loses all subscribers for a
+	// channel, a node starts accepting peer connections, or a channel is declared
+	// or deleted. Connected is true for clients that connected and channels that
+	// gained subscribers.
+	locationUpdate struct {
+		Node      string              `json:"node"`
+		Client    string              `json:"client,omitempty"`
+		Channel   string              `json:"channel,omitempty"`
+		Connected bool                `json:"connected"`
+		PeerPort  int                 `json:"peer_port,omitempty"`
+		Config    *channelConfigEntry `json:"config,omitempty"`
+	}
+
+	// The locationState type contains every client connected to a node and every
+	// channel it has subscribers for, along with the settings of every channel the
+	// node knows of. It is exchanged during memberlist's periodic state
+	// synchronisation, so that nodes that missed an update eventually agree.
+	locationState struct {
+		Node     string               `json:"node"`
+		Clients  []string             `json:"clients"`
+		Channels []string             `json:"channels"`
+		PeerPort int                  `json:"peer_port,omitempty"`
+		Configs  []channelConfigEntry `json:"configs,omitempty"`
+	}
+
+	// The locationBroadcast type is a locationUpdate queued for broadcasting. A
+	// newer update for the same client or channel replaces any that haven't been
+	// sent.
+	locationBroadcast struct {
+		key string
+		msg []byte
+	}
+)
+
+// NewLocations creates a new instance of the Locations type for the node with the
+// given name. The given metadata is advertised to other nodes as the node's gossip
+// metadata.
+func NewLocations(node string, meta []byte) *Locations {
+	l := &Locations{
+		node:     node,
+		meta:     meta,
+		local:    make(map[string]int),
+		channels: make(map[string]bool),
+		remote:   make(map[string]*nodeLocations),
+		configs:  newChannelConfigs(),
+		log:      logrus.WithField("node", node),
+	}
+
+	l.broadcasts = &memberlist.TransmitLimitedQueue{
+		NumNodes:       l.numNodes,
+		RetransmitMult: 3,
+	}
+
+	return l
+}
+
+// WithLocations sets the locations used to track the node each client in the
+// cluster is connected to and the channels each node has subscribers for. When
+// set, messages for a single client are sent straight to the node it is connected
+// to, and ErrClientNotFound is returned if no node holds the client. Messages for
+// a channel are only propagated to nodes with subscribers for it.
+func WithLocations(locations *Locations) Option {
+	return func(b *Broker) {
+		b.locations = locations
+	}
+}
+
+// handle sets the function that handles messages other than location updates.
+func (l *Locations) handle(handler func(byte, []byte)) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	l.handler = handler
+}
+
+// NodeMeta returns the metadata advertised to other nodes through gossip.
+func (l *Locations) NodeMeta(limit int) []byte {
+	return l.meta
+}
+
+// NotifyMsg handles an update broadcast by another node when one of its clients
+// connects or disconnects, its subscribed channels change, or a channel is declared.
+// Other messages, such as events sent by other nodes, are passed to the broker.
+func (l *Locations) NotifyMsg(msg []byte) {
+	if len(msg) == 0 {
+		return
+	}
+
+	kind, data := msg[0], msg[1:]
+
+	if kind != messageLocation {
+		l.mux.Lock()
+		handler := l.handler
+		l.mux.Unlock()
+
+		if handler == nil {
+			l.log.Warn("discarded message received before the broker started")
+			return
+		}
+
+		handler(kind, data)
+		return
+	}
+
+	var update locationUpdate
+	if err := json.Unmarshal(data, &update); err != nil {
+		l.log.WithError(err).Error("failed to decode client location update")
+		return
+	}
+
+	if update.Node == l.node {
+		return
+	}
+
+	// Declarations say nothing about the clients and channels of the node that
+	// made them.
+	if update.Config != nil {
+		l.configs.merge(*update.Config)
+		return
+	}
+
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	node, ok := l.remote[update.Node]
+
+	if !ok {
+		node = newNodeLocations()
+		l.remote[update.Node] = node
+	}
+
+	if update.Client != "" {
+		setMember(node.clients, update.Client, update.Connected)
+	}
+
+	if update.Channel != "" {
+		setMember(node.channels, update.Channel, update.Connected)
+	}
+
+	if update.PeerPort != 0 {
+		node.port = update.PeerPort
+	}
+}
+
+// GetBroadcasts returns the pending updates for this node's clients and channels
+// to send to other nodes.
+func (l *Locations) GetBroadcasts(overhead, limit int) [][]byte {
+	return l.broadcasts.GetBroadcasts(overhead, limit)
+}
+
+// LocalState returns every client connected to this node and every channel it has
+// subscribers for, so that they can be sent to another node during state
+// synchronisation.
+func (l *Locations) LocalState(join bool) []byte {
+	l.mux.Lock()
+
+	state := locationState{Node: l.node, PeerPort: l.port}
+	for id := range l.local {
+		state.Clients = append(state.Clients, id)
+	}
+
+	for id := range l.channels {
+		state.Channels = append(state.Channels, id)
+	}
+
+	l.mux.Unlock()
+
+	sort.Strings(state.Clients)
+	sort.Strings(state.Channels)
+	state.Configs = l.configs.state()
+
+	data, err := json.Marshal(state)
+
+	if err != nil {
+		l.log.WithError(err).Error("failed to encode client locations")
+		return nil
+	}
+
+	return data
+}
+
+// MergeRemoteState replaces the known clients and channels of another node with
+// those it sent during state synchronisation, and records any channel settings
+// newer than those known.
+func (l *Locations) MergeRemoteState(data []byte, join bool) {
+	var state locationState
+	if err := json.Unmarshal(data, &state); err != nil {
+		l.log.WithError(err).Error("failed to decode client locations")
+		return
+	}
+
+	if state.Node == "" || state.Node == l.node {
+		return
+	}
+
+	for _, entry := range state.Configs {
+		l.configs.merge(entry)
+	}
+
+	node := newNodeLocations()
+	node.port = state.PeerPort
+
+	for _, id := range state.Clients {
+		node.clients[id] = true
+	}
+
+	for _, id := range state.Channels {
+		node.channels[id] = true
+	}
+
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	l.remote[state.Node] = node
+}
+
+// NotifyJoin is called when a node joins the cluster. Its clients and channels
+// are learned through its broadcasts and state synchronisation.
+func (l *Locations) NotifyJoin(node *memberlist.Node) {}
+
+// NotifyLeave forgets the clients and channels of a node that has left the
+// cluster.
+func (l *Locations) NotifyLeave(node *memberlist.Node) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	delete(l.remote, node.Name)
+}
+
+// NotifyUpdate is called when a node's metadata changes.
+func (l *Locations) NotifyUpdate(node *memberlist.Node) {}
+
+// lookup returns the name of the node the given client is connected to. Clients
+// connected to this node are preferred. It returns false if no node holds the
+// client.
+func (l *Locations) lookup(clientID string) (string, bool) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	if l.local[clientID] > 0 {
+		return l.node, true
+	}
+
+	// Search nodes in a stable order, in case a client that reconnected is briefly
+	// known to be connected to two nodes.
+	nodes := make([]string, 0, len(l.remote))
+	for node := range l.remote {
+		nodes = append(nodes, node)
+	}
+
+	sort.Strings(nodes)
+
+	for _, node := range nodes {
+		if l.remote[node].clients[clientID] {
+			return node, true
+		}
+	}
+
+	return "", false
+}
+
+// interested returns true if the given node has subscribers for a channel,
+// including wildcard subscriptions. Messages for all channels interest every node.
+// Nodes whose channels aren't known yet, such as those that have just joined, are
+// assumed to be interested so that no messages are lost.
+func (l *Locations) interested(nodeID, channelID string) bool {
+	if channelID == "" {
+		return true
+	}
+
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	node, ok := l.remote[nodeID]
+
+	if !ok {
+		return true
+	}
+
+	for pattern := range node.channels {
+		if Match(pattern, channelID) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// add records that a client connected to this node, broadcasting it to other
+// nodes if it wasn't already connected.
+func (l *Locations) add(clientID string) {
+	l.mux.Lock()
+	l.local[clientID]++
+	connected := l.local[clientID] == 1
+	l.mux.Unlock()
+
+	if connected {
+		l.broadcast(locationUpdate{Node: l.node, Client: clientID, Connected: true})
+	}
+}
+
+// remove records that a client disconnected from this node, broadcasting it to
+// other nodes once it has no remaining connections.
+func (l *Locations) remove(clientID string) {
+	l.mux.Lock()
+
+	if l.local[clientID] == 0 {
+		l.mux.Unlock()
+		return
+	}
+
+	l.local[clientID]--
+	disconnected := l.local[clientID] == 0
+
+	if disconnected {
+		delete(l.local, clientID)
+	}
+
+	l.mux.Unlock()
+
+	if disconnected {
+		l.broadcast(locationUpdate{Node: l.node, Client: clientID})
+	}
+}
+
+// peerPort returns the port the given node accepts peer connections on, if it has
+// advertised one.
+func (l *Locations) peerPort(nodeID string) (int, bool) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	node, ok := l.remote[nodeID]
+
+	if !ok || node.port == 0 {
+		return 0, false
+	}
+
+	return node.port, true
+}
+
+// advertise records the port this node accepts peer connections on, broadcasting
+// it to other nodes.
+func (l *Locations) advertise(port int) {
+	l.mux.Lock()
+	l.port = port
+	l.mux.Unlock()
+
+	l.broadcast(locationUpdate{Node: l.node, PeerPort: port})
+}
+
+// subscribe records that this node has subscribers for a channel, broadcasting it
+// to other nodes.
+func (l *Locations) subscribe(channelID string) {
+	l.mux.Lock()
+	l.channels[channelID] = true
+	l.mux.Unlock()
+
+	l.broadcast(locationUpdate{Node: l.node, Channel: channelID, Connected: true})
+}
+
+// unsubscribe records that this node no longer has subscribers for a channel,
+// broadcasting it to other nodes.
+func (l *Locations) unsubscribe(channelID string) {
+	l.mux.Lock()
+	delete(l.channels, channelID)
+	l.mux.Unlock()
+
+	l.broadcast(locationUpdate{Node: l.node, Channel: channelID})
+}
+
+// declare records the settings of a channel, broadcasting them to other nodes.
+func (l *Locations) declare(entry channelConfigEntry) {
+	l.configs.merge(entry)
+	l.broadcast(locationUpdate{Node: l.node, Config: &entry})
+}
+
+func (l *Locations) broadcast(update locationUpdate) {
+	data, err := json.Marshal(update)
+
+	if err != nil {
+		l.log.WithError(err).Error("failed to encode location update")
+		return
+	}
+
+	data = append([]byte{messageLocation}, data...)
+
+	key := "client/" + update.Client
+	switch {
+	case update.Config != nil:
+		key = "config/" + update.Config.Config.ID
+	case update.Channel != "":
+		key = "channel/" + update.Channel
+	case update.PeerPort != 0:
+		key = "peer"
+	}
+
+	l.broadcasts.QueueBroadcast(&locationBroadcast{key: key, msg: data})
+}
+
+func (l *Locations) numNodes() int {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	return len(l.remote) + 1
+}
+
+// Invalidates returns true if the given broadcast is an older update for the same
+// client or channel.
+func (b *locationBroadcast) Invalidates(other memberlist.Broadcast) bool {
+	o, ok := other.(*locationBroadcast)
+
+	return ok && o.key == b.key
+}
+
+// Message returns the encoded update.
+func (b *locationBroadcast) Message() []byte {
+	return b.msg
+}
+
+// Finished is called once the update is no longer broadcast.
+func (b *locationBroadcast) Finished() {}
+
+func newNodeLocations() *nodeLocations {
+	return &nodeLocations{
+		clients:  make(map[string]bool),
+		channels: make(map[string]bool),
+	}
+}
+
+func setMember(set map[string]bool, id string, member bool) {
+	if member {
+		set[id] = true
+	} else {
+		delete(set, id)
+	}
+}
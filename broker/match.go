@@ -0,0 +1,71 @@
+package broker
+
+import "strings"
+
+const (
+	// The separator between the tokens of a hierarchical channel name,
+	// such as 'orders.eu.created'.
+	tokenSeparator = "."
+
+	// A subscription token that matches exactly one token of a channel name.
+	singleWildcard = "*"
+
+	// A subscription token that matches one or more trailing tokens of a
+	// channel name. It may only be used as the final token.
+	trailingWildcard = ">"
+)
+
+// IsWildcard returns true if the given channel name contains wildcard tokens and
+// therefore describes a subscription to many channels.
+func IsWildcard(channelID string) bool {
+	for _, token := range strings.Split(channelID, tokenSeparator) {
+		if token == singleWildcard || token == trailingWildcard {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ValidPattern returns false if the given subscription uses the trailing wildcard
+// anywhere other than as its final token.
+func ValidPattern(pattern string) bool {
+	tokens := strings.Split(pattern, tokenSeparator)
+
+	for i, token := range tokens {
+		if token == trailingWildcard && i != len(tokens)-1 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Match returns true if the given channel name matches a subscription. Names are
+// split into tokens on '.', a '*' token matches any single token and a '>' token
+// matches one or more trailing tokens, so 'orders.*.created' matches
+// 'orders.eu.created' and 'orders.>' matches both.
+func Match(pattern, channelID string) bool {
+	if pattern == channelID {
+		return true
+	}
+
+	patternTokens := strings.Split(pattern, tokenSeparator)
+	channelTokens := strings.Split(channelID, tokenSeparator)
+
+	for i, token := range patternTokens {
+		if token == trailingWildcard {
+			return i == len(patternTokens)-1 && len(channelTokens) > i
+		}
+
+		if i >= len(channelTokens) {
+			return false
+		}
+
+		if token != singleWildcard && token != channelTokens[i] {
+			return false
+		}
+	}
+
+	return len(patternTokens) == len(channelTokens)
+}
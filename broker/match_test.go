@@ -0,0 +1,99 @@
+package broker_test
+
+import (
+	"testing"
+
+	"github.com/davidsbond/sse-cluster/broker"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMatch(t *testing.T) {
+	t.Parallel()
+
+	tt := []struct {
+		Name     string
+		Pattern  string
+		Channel  string
+		Expected bool
+	}{
+		{
+			Name:     "It should match identical names",
+			Pattern:  "orders.eu.created",
+			Channel:  "orders.eu.created",
+			Expected: true,
+		},
+		{
+			Name:    "It should not match different names",
+			Pattern: "orders.eu.created",
+			Channel: "orders.us.created",
+		},
+		{
+			Name:     "It should match a single token wildcard",
+			Pattern:  "orders.*.created",
+			Channel:  "orders.eu.created",
+			Expected: true,
+		},
+		{
+			Name:    "It should not match a single token wildcard against many tokens",
+			Pattern: "orders.*",
+			Channel: "orders.eu.created",
+		},
+		{
+			Name:     "It should match a trailing wildcard",
+			Pattern:  "orders.>",
+			Channel:  "orders.eu.created",
+			Expected: true,
+		},
+		{
+			Name:    "It should not match a trailing wildcard without trailing tokens",
+			Pattern: "orders.>",
+			Channel: "orders",
+		},
+		{
+			Name:    "It should not match a trailing wildcard that isn't last",
+			Pattern: "orders.>.created",
+			Channel: "orders.eu.created",
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.Name, func(t *testing.T) {
+			assert.Equal(t, tc.Expected, broker.Match(tc.Pattern, tc.Channel))
+		})
+	}
+}
+
+func TestIsWildcard(t *testing.T) {
+	t.Parallel()
+
+	tt := []struct {
+		Name     string
+		Channel  string
+		Expected bool
+	}{
+		{
+			Name:    "It should not detect wildcards in plain names",
+			Channel: "orders.eu.created",
+		},
+		{
+			Name:     "It should detect single token wildcards",
+			Channel:  "orders.*.created",
+			Expected: true,
+		},
+		{
+			Name:     "It should detect trailing wildcards",
+			Channel:  "orders.>",
+			Expected: true,
+		},
+		{
+			Name:    "It should not detect wildcards within tokens",
+			Channel: "orders.eu*",
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.Name, func(t *testing.T) {
+			assert.Equal(t, tc.Expected, broker.IsWildcard(tc.Channel))
+		})
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"time"
 )
 
 type (
@@ -21,15 +22,47 @@ type (
 		// The data field for the message. When the EventSource receives multiple consecutive lines that begin with data:,
 		// it will concatenate them, inserting a newline character between each one.
 		// Trailing newlines are removed.
-		Data json.RawMessage `json:"data"`
+		Data json.RawMessage `json:"data,omitempty"`
 
 		// The reconnection time to use when attempting to send the event. This must be an integer,
 		// specifying the reconnection time in milliseconds.
 		// If a non-integer value is specified, the field is ignored.
 		Retry int `json:"retry"`
 
+		// The number of milliseconds the event is relevant for after it has been published. Once
+		// elapsed, the event is no longer delivered, replayed or forwarded to other nodes.
+		TTL int `json:"ttl,omitempty"`
+
+		// The time after which the event is no longer delivered, replayed or forwarded to other
+		// nodes. If a TTL is specified instead, this is set by the broker when the event is published.
+		ExpiresAt *time.Time `json:"expires_at,omitempty"`
+
+		// The number of milliseconds to wait after the event is published before it is
+		// delivered to clients.
+		Delay int `json:"delay,omitempty"`
+
+		// The time the event should be delivered to clients. If a delay is specified instead,
+		// this is set by the broker when the event is published.
+		DeliverAt *time.Time `json:"deliver_at,omitempty"`
+
+		// The channel the event was published to. This is set by the broker and allows
+		// clients subscribed to many channels to tell where an event came from.
+		Channel string `json:"channel,omitempty"`
+
+		// The client the event was published to, if it targeted a single client within
+		// the channel.
+		Client string `json:"client,omitempty"`
+
+		// An optional key used to detect retried publishes of the same event. If not provided,
+		// the event ID is used instead.
+		IdempotencyKey string `json:"idempotency_key,omitempty"`
+
 		// Contains identifiers of previous nodes this event has been through
 		BeenTo []string `json:"been_to"`
+
+		// The client the event is not written to, such as the subject of a presence
+		// event. This is only known to the node the client is connected to.
+		exclude string
 	}
 )
 
@@ -66,6 +99,11 @@ func (m *Message) Bytes() []byte {
 	return out.Bytes()
 }
 
+// Expired returns true if the message has an expiry that has passed.
+func (m *Message) Expired() bool {
+	return m.ExpiresAt != nil && time.Now().After(*m.ExpiresAt)
+}
+
 // JSON returns the Message instance in JSON encoding
 func (m *Message) JSON() []byte {
 	data, _ := json.Marshal(m)
@@ -4,6 +4,7 @@ import (
 	"github.com/davidsbond/sse-cluster/broker"
 	"github.com/stretchr/testify/assert"
 	"testing"
+	"time"
 )
 
 func TestMessage_Bytes(t *testing.T) {
@@ -62,3 +63,40 @@ func TestMessage_Bytes(t *testing.T) {
 		})
 	}
 }
+
+func TestMessage_Expired(t *testing.T) {
+	t.Parallel()
+
+	past := time.Now().Add(-time.Minute)
+	future := time.Now().Add(time.Minute)
+
+	tt := []struct {
+		Name     string
+		Message  broker.Message
+		Expected bool
+	}{
+		{
+			Name:    "It should not expire without an expiry",
+			Message: broker.Message{},
+		},
+		{
+			Name: "It should not expire before the expiry",
+			Message: broker.Message{
+				ExpiresAt: &future,
+			},
+		},
+		{
+			Name: "It should expire after the expiry",
+			Message: broker.Message{
+				ExpiresAt: &past,
+			},
+			Expected: true,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.Name, func(t *testing.T) {
+			assert.Equal(t, tc.Expected, tc.Message.Expired())
+		})
+	}
+}
@@ -1,6 +1,9 @@
 package broker_test
 
 import (
+	"net/http"
+
+	"github.com/davidsbond/sse-cluster/broker"
 	"github.com/hashicorp/memberlist"
 	"github.com/stretchr/testify/mock"
 )
@@ -9,8 +12,14 @@ type (
 	MockMemberlist struct {
 		mock.Mock
 	}
+
+	roundTripperFunc func(*http.Request) (*http.Response, error)
 )
 
+func (f roundTripperFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
 func (m *MockMemberlist) NumMembers() int {
 	return m.Called().Int(0)
 }
@@ -34,3 +43,37 @@ func (m *MockMemberlist) Members() []*memberlist.Node {
 
 	return nil
 }
+
+func (m *MockMemberlist) SendReliable(node *memberlist.Node, msg []byte) error {
+	return m.Called(node, msg).Error(0)
+}
+
+type (
+	MockPeerTransport struct {
+		mock.Mock
+	}
+)
+
+func (m *MockPeerTransport) Send(addr string, msgs []broker.Message) error {
+	return m.Called(addr, msgs).Error(0)
+}
+
+type (
+	MockEventStore struct {
+		mock.Mock
+	}
+)
+
+func (m *MockEventStore) Append(channel string, msg broker.Message) error {
+	return m.Called(channel, msg).Error(0)
+}
+
+func (m *MockEventStore) Since(channel, id string, limit int) ([]broker.Message, bool, error) {
+	args := m.Called(channel, id, limit)
+
+	if args.Get(0) != nil {
+		return args.Get(0).([]broker.Message), args.Bool(1), args.Error(2)
+	}
+
+	return nil, args.Bool(1), args.Error(2)
+}
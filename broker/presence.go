@@ -0,0 +1,281 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+	"github.com/sirupsen/logrus"
+)
+
+type (
+	// The Presence type describes a client subscribed to a channel somewhere in
+	// the cluster.
+	Presence struct {
+		ID       string            `json:"id"`
+		Node     string            `json:"node"`
+		Channels []string          `json:"channels"`
+		Metadata map[string]string `json:"metadata,omitempty"`
+	}
+
+	// The ClientList type is the result of a presence lookup for a channel. It
+	// contains the clients of each node that responded and the errors of those
+	// that didn't.
+	ClientList struct {
+		Clients     []Presence        `json:"clients"`
+		Unreachable map[string]string `json:"unreachable"`
+	}
+
+	// The presenceCache type is the result of a cluster-wide presence lookup for
+	// a channel, along with when it was made.
+	presenceCache struct {
+		at      time.Time
+		clients *ClientList
+	}
+)
+
+const (
+	// DefaultPresenceMaxAge is the oldest cached presence lookup that can be served
+	// when no maximum is specified.
+	DefaultPresenceMaxAge = time.Second * 10
+
+	// EventPresenceJoin is the type of event published to a channel when a client
+	// subscribes to it, if the channel publishes presence events.
+	EventPresenceJoin = "presence.join"
+
+	// EventPresenceLeave is the type of event published to a channel when a client
+	// unsubscribes from it, if the channel publishes presence events.
+	EventPresenceLeave = "presence.leave"
+)
+
+// WithPresenceMaxAge sets the oldest cached presence lookup that can be served to
+// requests that accept stale results. Lookups older than this are discarded.
+func WithPresenceMaxAge(age time.Duration) Option {
+	return func(b *Broker) {
+		b.presenceMaxAge = age
+	}
+}
+
+// WithPresenceEvents sets the channels that publish presence events to their
+// subscribers when clients join or leave them. Channels may be wildcard patterns
+// such as 'rooms.>'.
+func WithPresenceEvents(channelIDs ...string) Option {
+	return func(b *Broker) {
+		b.presenceEvents = append(b.presenceEvents, channelIDs...)
+	}
+}
+
+// presenceEnabled returns true if the given channel publishes presence events.
+// Wildcard subscriptions cannot be published to, so never publish them.
+func (b *Broker) presenceEnabled(channelID string) bool {
+	if IsWildcard(channelID) {
+		return false
+	}
+
+	for _, pattern := range b.presenceEvents {
+		if Match(pattern, channelID) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// publishPresence publishes a presence event for a client to the other subscribers
+// of a channel. The event is only published by the node the client is connected
+// to and is propagated like any other, so it is delivered once across the cluster.
+func (b *Broker) publishPresence(channelID, event string, cl *Client) {
+	data, err := json.Marshal(Presence{
+		ID:       cl.ID(),
+		Node:     b.memberlist.LocalNode().Name,
+		Channels: []string{channelID},
+		Metadata: cl.Metadata(),
+	})
+
+	if err != nil {
+		b.log.WithError(err).Error("failed to encode presence event")
+		return
+	}
+
+	msg := Message{
+		Event:   event,
+		Data:    data,
+		exclude: cl.ID(),
+	}
+
+	if _, err := b.Publish(channelID, "", msg); err != nil {
+		b.log.WithFields(logrus.Fields{
+			"channel": channelID,
+			"client":  cl.ID(),
+			"event":   event,
+		}).WithError(err).Error("failed to publish presence event")
+	}
+}
+
+// LocalClients returns the clients connected to this node whose subscriptions
+// match the given channel, including wildcard subscriptions.
+func (b *Broker) LocalClients(channelID string) []Presence {
+	node := b.memberlist.LocalNode().Name
+	clients := make(map[*Client]*Presence)
+
+	var out []*Presence
+	for _, ch := range b.matching(channelID) {
+		for _, cl := range ch.members() {
+			p, ok := clients[cl]
+
+			if !ok {
+				p = &Presence{
+					ID:       cl.ID(),
+					Node:     node,
+					Metadata: cl.Metadata(),
+				}
+
+				clients[cl] = p
+				out = append(out, p)
+			}
+
+			p.Channels = append(p.Channels, ch.id)
+		}
+	}
+
+	presence := make([]Presence, 0, len(out))
+	for _, p := range out {
+		sort.Strings(p.Channels)
+		presence = append(presence, *p)
+	}
+
+	return presence
+}
+
+// Clients returns the clients connected to every node in the cluster whose
+// subscriptions match the given channel. If a lookup for the channel was made
+// within the given age, capped by the broker's maximum, its result is returned
+// instead of asking every node again. Other nodes are asked in parallel, each
+// within the broker's status timeout, and those that cannot be reached are listed
+// as unreachable. The given token is passed on to the other nodes, which require it
+// for channels declared with one.
+func (b *Broker) Clients(channelID, token string, maxAge time.Duration) *ClientList {
+	if maxAge > b.presenceMaxAge {
+		maxAge = b.presenceMaxAge
+	}
+
+	if maxAge > 0 {
+		b.mux.Lock()
+		cached, ok := b.presence[channelID]
+		b.mux.Unlock()
+
+		if ok && time.Since(cached.at) <= maxAge {
+			return cached.clients
+		}
+	}
+
+	out := &ClientList{
+		Clients:     b.LocalClients(channelID),
+		Unreachable: make(map[string]string),
+	}
+
+	var mux sync.Mutex
+	var wg sync.WaitGroup
+
+	for _, member := range b.memberlist.Members() {
+		if member.Name == b.memberlist.LocalNode().Name {
+			continue
+		}
+
+		wg.Add(1)
+		go func(member *memberlist.Node) {
+			defer wg.Done()
+
+			clients, err := b.remoteClients(member, channelID, token)
+
+			mux.Lock()
+			defer mux.Unlock()
+
+			if err != nil {
+				b.log.WithFields(logrus.Fields{
+					"targetNodeId": member.Name,
+					"channel":      channelID,
+				}).WithError(err).Error("failed to get clients from node")
+
+				out.Unreachable[member.Name] = err.Error()
+				return
+			}
+
+			out.Clients = append(out.Clients, clients...)
+		}(member)
+	}
+
+	wg.Wait()
+
+	sort.Slice(out.Clients, func(i, j int) bool {
+		if out.Clients[i].Node != out.Clients[j].Node {
+			return out.Clients[i].Node < out.Clients[j].Node
+		}
+
+		return out.Clients[i].ID < out.Clients[j].ID
+	})
+
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	// Discard lookups too old to be served, so that the cache only holds channels
+	// that are being looked up.
+	for id, cached := range b.presence {
+		if time.Since(cached.at) > b.presenceMaxAge {
+			delete(b.presence, id)
+		}
+	}
+
+	if b.presenceMaxAge > 0 {
+		b.presence[channelID] = presenceCache{at: time.Now(), clients: out}
+	}
+
+	return out
+}
+
+func (b *Broker) remoteClients(member *memberlist.Node, channelID, token string) ([]Presence, error) {
+	ctx := context.Background()
+	if b.statusTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, b.statusTimeout)
+		defer cancel()
+	}
+
+	u := fmt.Sprintf("http://%s:%s/channel/%s/clients?local=true", member.Addr, member.Meta, url.PathEscape(channelID))
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := b.http.Do(req.WithContext(ctx))
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		data, _ := ioutil.ReadAll(resp.Body)
+		return nil, fmt.Errorf(string(data))
+	}
+
+	var clients ClientList
+	if err := json.NewDecoder(resp.Body).Decode(&clients); err != nil {
+		return nil, err
+	}
+
+	return clients.Clients, nil
+}
@@ -0,0 +1,231 @@
+package broker
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/hashicorp/memberlist"
+	"github.com/sirupsen/logrus"
+)
+
+// The Propagation type determines how messages published to a node reach the
+// other nodes in the cluster.
+type Propagation string
+
+const (
+	// PropagationChain relays each message from node to node, each forwarding it
+	// to the next node it hasn't been through.
+	PropagationChain Propagation = "chain"
+
+	// PropagationFanOut sends each message from the node it was published to
+	// straight to every other node concurrently.
+	PropagationFanOut Propagation = "fan-out"
+
+	// DefaultFanOutParallelism is the number of nodes a message is sent to at
+	// once when using PropagationFanOut and no parallelism is specified.
+	DefaultFanOutParallelism = 8
+)
+
+// ParsePropagation converts a string into a Propagation, returning an error if it
+// is not a known mode.
+func ParsePropagation(s string) (Propagation, error) {
+	switch p := Propagation(s); p {
+	case PropagationChain, PropagationFanOut:
+		return p, nil
+	default:
+		return "", fmt.Errorf("unknown propagation mode %s", s)
+	}
+}
+
+// WithPropagation sets how messages are propagated to other nodes. When using
+// PropagationFanOut, parallelism limits the number of nodes a message is sent to
+// at once, if it is greater than zero.
+func WithPropagation(mode Propagation, parallelism int) Option {
+	return func(b *Broker) {
+		b.propagation = mode
+		b.parallelism = parallelism
+	}
+}
+
+// propagate sends a published message to other nodes using the broker's
+// propagation mode.
+func (b *Broker) propagate(channelID, clientID string, msg Message) {
+	b.wg.Add(1)
+
+	if b.propagation == PropagationFanOut {
+		go b.sendToAllNodes(channelID, clientID, msg)
+	} else {
+		go b.sendToNextNode(channelID, clientID, msg)
+	}
+}
+
+// propagateBatch sends published messages to other nodes as a single batch using
+// the broker's propagation mode.
+func (b *Broker) propagateBatch(msgs []Message) {
+	b.wg.Add(1)
+
+	if b.propagation == PropagationFanOut {
+		go b.sendBatchToAllNodes(msgs)
+	} else {
+		go b.sendBatchToNextNode(msgs)
+	}
+}
+
+// sendToAllNodes sends a message to every node with subscribers for its channel
+// that it hasn't already been through. Every recipient is added to the nodes the
+// message has been through, so that recipients don't forward it again.
+func (b *Broker) sendToAllNodes(channelID, clientID string, msg Message) {
+	defer b.wg.Done()
+
+	if msg.Expired() {
+		b.Expire(msg)
+		return
+	}
+
+	targets := b.targets(msg.BeenTo, func(member *memberlist.Node) bool {
+		return b.interested(member, channelID)
+	})
+
+	msg.BeenTo = append(msg.BeenTo, b.memberlist.LocalNode().Name)
+	for _, member := range targets {
+		msg.BeenTo = append(msg.BeenTo, member.Name)
+	}
+
+	b.fanOut(targets, func(member *memberlist.Node) (logrus.Fields, error) {
+		fields := logrus.Fields{
+			"targetNodeId": member.Name,
+			"eventId":      msg.ID,
+			"event":        msg.Event,
+			"channel":      channelID,
+		}
+
+		err := b.send(member, channelID, clientID, msg)
+		if err != nil {
+			b.retry(member.Name, []Message{msg})
+		}
+
+		return fields, err
+	})
+}
+
+// sendBatchToAllNodes sends a batch of messages to every node with subscribers
+// for any of their channels that the batch hasn't already been through.
+func (b *Broker) sendBatchToAllNodes(msgs []Message) {
+	defer b.wg.Done()
+
+	var beenTo []string
+	for _, msg := range msgs {
+		beenTo = append(beenTo, msg.BeenTo...)
+	}
+
+	targets := b.targets(beenTo, func(member *memberlist.Node) bool {
+		return b.interestedInAny(member, msgs)
+	})
+
+	unexpired := msgs[:0]
+	for _, msg := range msgs {
+		if msg.Expired() {
+			b.Expire(msg)
+			continue
+		}
+
+		msg.BeenTo = append(msg.BeenTo, b.memberlist.LocalNode().Name)
+		for _, member := range targets {
+			msg.BeenTo = append(msg.BeenTo, member.Name)
+		}
+
+		unexpired = append(unexpired, msg)
+	}
+
+	if len(unexpired) == 0 {
+		return
+	}
+
+	b.fanOut(targets, func(member *memberlist.Node) (logrus.Fields, error) {
+		fields := logrus.Fields{
+			"targetNodeId": member.Name,
+			"batchSize":    len(unexpired),
+		}
+
+		err := b.sendBatch(member, unexpired)
+		if err != nil {
+			b.retry(member.Name, unexpired)
+		}
+
+		return fields, err
+	})
+}
+
+// targets returns the members other than this node that aren't in the given list
+// of nodes and are accepted by the given function.
+func (b *Broker) targets(beenTo []string, accept func(*memberlist.Node) bool) []*memberlist.Node {
+	ids := make(map[string]bool)
+	for _, nodeID := range beenTo {
+		ids[nodeID] = true
+	}
+
+	var out []*memberlist.Node
+	for _, member := range b.memberlist.Members() {
+		if ids[member.Name] || member == b.memberlist.LocalNode() || !accept(member) {
+			continue
+		}
+
+		out = append(out, member)
+	}
+
+	return out
+}
+
+// fanOut calls the given function for each member concurrently, limited by the
+// broker's parallelism, and waits for them to finish. The outcome for each member
+// is logged and counted.
+func (b *Broker) fanOut(members []*memberlist.Node, fn func(*memberlist.Node) (logrus.Fields, error)) {
+	parallelism := b.parallelism
+	if parallelism <= 0 || parallelism > len(members) {
+		parallelism = len(members)
+	}
+
+	sem := make(chan struct{}, parallelism)
+
+	var wg sync.WaitGroup
+	for _, member := range members {
+		sem <- struct{}{}
+		wg.Add(1)
+
+		go func(member *memberlist.Node) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			fields, err := fn(member)
+			b.recordPropagation(member.Name, err)
+
+			if err != nil {
+				b.log.
+					WithFields(fields).
+					WithError(err).
+					Error("failed to propagate to node")
+
+				return
+			}
+
+			b.log.
+				WithFields(fields).
+				Info("propagated to node")
+		}(member)
+	}
+
+	wg.Wait()
+}
+
+// recordPropagation counts the outcome of sending messages to a node.
+func (b *Broker) recordPropagation(nodeID string, err error) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	if err != nil {
+		b.propagationFailures[nodeID]++
+		return
+	}
+
+	b.propagated[nodeID]++
+}
@@ -0,0 +1,39 @@
+package broker_test
+
+import (
+	"testing"
+
+	"github.com/davidsbond/sse-cluster/broker"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParsePropagation(t *testing.T) {
+	t.Parallel()
+
+	tt := []struct {
+		Name         string
+		Mode         string
+		ExpectedMode broker.Propagation
+		ExpectError  bool
+	}{
+		{
+			Name:         "It should parse a known mode",
+			Mode:         "fan-out",
+			ExpectedMode: broker.PropagationFanOut,
+		},
+		{
+			Name:        "It should return an error for an unknown mode",
+			Mode:        "unknown",
+			ExpectError: true,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.Name, func(t *testing.T) {
+			mode, err := broker.ParsePropagation(tc.Mode)
+
+			assert.Equal(t, tc.ExpectError, err != nil)
+			assert.Equal(t, tc.ExpectedMode, mode)
+		})
+	}
+}
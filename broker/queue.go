@@ -0,0 +1,313 @@
+package broker
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/memberlist"
+	"github.com/sirupsen/logrus"
+)
+
+type (
+	// The Delivery type determines whether messages published to a channel are
+	// written to every subscriber or to a single one.
+	Delivery string
+
+	// The Selection type determines which subscriber of a queue channel receives
+	// each message.
+	Selection string
+
+	// The queueChannels type is a set of channel patterns that deliver each message
+	// to a single subscriber, using the given selection.
+	queueChannels struct {
+		patterns  []string
+		selection Selection
+	}
+
+	// The candidate type is a client that can receive a message published to a
+	// queue channel, along with the channel it subscribed to.
+	candidate struct {
+		channel *Channel
+		client  *Client
+	}
+)
+
+const (
+	// DeliveryBroadcast writes each message to every subscriber of the channel.
+	DeliveryBroadcast Delivery = "broadcast"
+
+	// DeliveryQueue writes each message to a single subscriber of the channel
+	// across the cluster.
+	DeliveryQueue Delivery = "queue"
+
+	// SelectRoundRobin gives each message to the next subscriber in turn.
+	SelectRoundRobin Selection = "round-robin"
+
+	// SelectLeastLoaded gives each message to the subscriber with the fewest
+	// messages waiting in its buffer or waiting to be acknowledged.
+	SelectLeastLoaded Selection = "least-loaded"
+)
+
+// ParseDelivery converts a string into a Delivery, returning an error if it is not
+// a known delivery mode.
+func ParseDelivery(s string) (Delivery, error) {
+	switch d := Delivery(s); d {
+	case DeliveryBroadcast, DeliveryQueue:
+		return d, nil
+	default:
+		return "", fmt.Errorf("unknown delivery mode %s", s)
+	}
+}
+
+// ParseSelection converts a string into a Selection, returning an error if it is
+// not a known selection.
+func ParseSelection(s string) (Selection, error) {
+	switch sel := Selection(s); sel {
+	case SelectRoundRobin, SelectLeastLoaded:
+		return sel, nil
+	default:
+		return "", fmt.Errorf("unknown selection %s", s)
+	}
+}
+
+// WithQueueChannels sets the channels that deliver each message to a single
+// subscriber across the cluster, rather than to every subscriber. Channels may be
+// given as wildcard patterns. The node a message is published to sends it to one
+// node with subscribers, which chooses one of its subscribers using the selection.
+// Every node must be configured with the same queue channels.
+func WithQueueChannels(selection Selection, channelIDs ...string) Option {
+	return func(b *Broker) {
+		b.queueChannels = append(b.queueChannels, queueChannels{
+			patterns:  channelIDs,
+			selection: selection,
+		})
+	}
+}
+
+// queued returns true if messages published to the channel are delivered to a
+// single subscriber, along with how the subscriber is chosen. The delivery mode of
+// a declared channel takes precedence over the broker's queue channels.
+func (b *Broker) queued(channelID string) (Selection, bool) {
+	if channelID == "" || IsWildcard(channelID) {
+		return "", false
+	}
+
+	if cfg, ok := b.configs.get(channelID); ok && cfg.Delivery != "" {
+		if cfg.Delivery != DeliveryQueue {
+			return "", false
+		}
+
+		if cfg.Selection == "" {
+			return SelectRoundRobin, true
+		}
+
+		return cfg.Selection, true
+	}
+
+	for _, qc := range b.queueChannels {
+		for _, pattern := range qc.patterns {
+			if Match(pattern, channelID) {
+				return qc.selection, true
+			}
+		}
+	}
+
+	return "", false
+}
+
+// publishQueue delivers a message published to a queue channel to a single
+// subscriber. A message published to this node is given to one of the nodes with
+// subscribers in turn, preferring this node if one of its subscribers is idle when
+// using SelectLeastLoaded. A message sent by another node is given to one of this
+// node's subscribers, or passed on to a node it hasn't been through if this node
+// has none.
+func (b *Broker) publishQueue(channelID string, selection Selection, msg Message) {
+	defer b.wg.Done()
+
+	local := b.candidates(channelID, msg)
+
+	var remote []*memberlist.Node
+	if b.memberlist.NumMembers() > 1 {
+		remote = b.targets(msg.BeenTo, func(member *memberlist.Node) bool {
+			return b.interested(member, channelID)
+		})
+	}
+
+	// Messages sent by other nodes were already given to this one
+	if len(local) > 0 && (len(msg.BeenTo) > 0 || len(remote) == 0) {
+		b.writeQueue(channelID, selection, local, msg)
+		return
+	}
+
+	if selection == SelectLeastLoaded && idle(local) {
+		b.writeQueue(channelID, selection, local, msg)
+		return
+	}
+
+	// Nodes are offered the message in turn, starting from the next node in the
+	// rotation. This node takes its turn at position zero, followed by the other
+	// nodes in the order of the cluster's members.
+	nodes := make([]*memberlist.Node, 0, len(remote)+1)
+	if len(local) > 0 {
+		nodes = append(nodes, nil)
+	}
+
+	nodes = append(nodes, remote...)
+
+	if len(nodes) == 0 {
+		b.mux.Lock()
+		delete(b.turns, "node/"+channelID)
+		b.mux.Unlock()
+
+		b.log.WithFields(logrus.Fields{
+			"channel": channelID,
+			"eventId": msg.ID,
+		}).Warn("discarded queued message, channel has no subscribers")
+
+		return
+	}
+
+	start := b.turn("node/" + channelID)
+	msg.BeenTo = append(msg.BeenTo, b.memberlist.LocalNode().Name)
+
+	var failed []*memberlist.Node
+	for i := range nodes {
+		member := nodes[(start+i)%len(nodes)]
+
+		if member == nil {
+			b.writeQueue(channelID, selection, local, msg)
+			return
+		}
+
+		evtInfo := logrus.Fields{
+			"targetNodeId": member.Name,
+			"eventId":      msg.ID,
+			"channel":      channelID,
+		}
+
+		err := b.send(member, channelID, "", msg)
+		b.recordPropagation(member.Name, err)
+
+		if err != nil {
+			b.log.
+				WithFields(evtInfo).
+				WithError(err).
+				Error("failed to send queued message to node")
+
+			failed = append(failed, member)
+			continue
+		}
+
+		b.log.
+			WithFields(evtInfo).
+			Info("sent queued message to node")
+
+		return
+	}
+
+	// Only a single node is retried, so the message is still delivered once
+	b.retry(failed[0].Name, []Message{msg})
+}
+
+// candidates returns this node's clients that can receive a message published to
+// a queue channel, ordered by identifier. Clients subscribed to many matching
+// channels are only included once.
+func (b *Broker) candidates(channelID string, msg Message) []candidate {
+	seen := make(map[*Client]bool)
+
+	var out []candidate
+	for _, ch := range b.matching(channelID) {
+		for _, cl := range ch.members() {
+			if seen[cl] || !cl.Accepts(msg) {
+				continue
+			}
+
+			seen[cl] = true
+			out = append(out, candidate{channel: ch, client: cl})
+		}
+	}
+
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].client.ID() < out[j].client.ID()
+	})
+
+	return out
+}
+
+// writeQueue writes a message published to a queue channel to one of the given
+// clients, chosen using the selection.
+func (b *Broker) writeQueue(channelID string, selection Selection, local []candidate, msg Message) {
+	start := b.turn("client/" + channelID)
+	chosen := local[start%len(local)]
+
+	if selection == SelectLeastLoaded {
+		for i := range local {
+			c := local[(start+i)%len(local)]
+
+			if load(c.client) < load(chosen.client) {
+				chosen = c
+			}
+		}
+	}
+
+	chosen.channel.writeTo(chosen.client.ID(), msg, nil)
+}
+
+// turn returns the position of the next turn in a rotation, advancing it.
+func (b *Broker) turn(key string) int {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	n := b.turns[key]
+	b.turns[key]++
+
+	return n
+}
+
+// forgetTurns removes the rotations of the queue channels matching a subscription
+// that was removed, once no subscription on this node matches them. Must be called
+// with the broker's lock held.
+func (b *Broker) forgetTurns(pattern string) {
+	for key := range b.turns {
+		channelID := key[strings.Index(key, "/")+1:]
+
+		if !Match(pattern, channelID) {
+			continue
+		}
+
+		subscribed := false
+		for id := range b.channels {
+			if Match(id, channelID) {
+				subscribed = true
+				break
+			}
+		}
+
+		if !subscribed {
+			delete(b.turns, key)
+		}
+	}
+}
+
+// load returns the number of messages a client has waiting in its buffer or
+// waiting to be acknowledged. Messages in the buffer of a client that uses
+// acknowledgements are already waiting to be acknowledged.
+func load(cl *Client) int {
+	if cl.inflight != nil {
+		return cl.inflight.len()
+	}
+
+	return len(cl.messages)
+}
+
+// idle returns true if any of the clients has no messages waiting.
+func idle(local []candidate) bool {
+	for _, c := range local {
+		if load(c.client) == 0 {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,39 @@
+package broker_test
+
+import (
+	"testing"
+
+	"github.com/davidsbond/sse-cluster/broker"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseSelection(t *testing.T) {
+	t.Parallel()
+
+	tt := []struct {
+		Name              string
+		Selection         string
+		ExpectedSelection broker.Selection
+		ExpectError       bool
+	}{
+		{
+			Name:              "It should parse a known selection",
+			Selection:         "least-loaded",
+			ExpectedSelection: broker.SelectLeastLoaded,
+		},
+		{
+			Name:        "It should return an error for an unknown selection",
+			Selection:   "unknown",
+			ExpectError: true,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.Name, func(t *testing.T) {
+			selection, err := broker.ParseSelection(tc.Selection)
+
+			assert.Equal(t, tc.ExpectError, err != nil)
+			assert.Equal(t, tc.ExpectedSelection, selection)
+		})
+	}
+}
@@ -0,0 +1,455 @@
+package broker
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+	"github.com/sirupsen/logrus"
+)
+
+type (
+	// The DeadLetter type describes messages that could not be propagated to a
+	// node and were given up on.
+	DeadLetter struct {
+		Node     string    `json:"node"`
+		Messages []Message `json:"messages"`
+		Reason   string    `json:"reason"`
+		Attempts int       `json:"attempts"`
+		At       time.Time `json:"at"`
+	}
+
+	// The retrier type holds messages that could not be propagated to a node,
+	// retrying them with an exponential backoff until they are sent or become too
+	// old. Each node has its own bounded queue.
+	retrier struct {
+		mux         sync.Mutex
+		size        int
+		maxAge      time.Duration
+		minBackoff  time.Duration
+		maxBackoff  time.Duration
+		batchSize   int
+		batchBytes  int64
+		queues      map[string]*retryQueue
+		deadLetters []DeadLetter
+		retried     map[string]uint64
+		dropped     map[string]uint64
+		stopped     bool
+	}
+
+	// The retryQueue type holds the messages waiting to be retried for a single
+	// node. Messages queued at different times are retried together, in batches
+	// no larger than the node accepts.
+	retryQueue struct {
+		entries  []retryEntry
+		attempts int
+		timer    *time.Timer
+	}
+
+	retryEntry struct {
+		msg      Message
+		queuedAt time.Time
+	}
+
+	// The rejectedBatch type is a batch of messages a node refused to publish.
+	rejectedBatch struct {
+		msgs []Message
+		err  error
+	}
+
+	// The rejectedError type is returned when a node responds to messages sent to
+	// it with a client error, such as a batch that is too large. Sending the same
+	// messages again would fail in the same way.
+	rejectedError struct {
+		status int
+		msg    string
+	}
+)
+
+func (e *rejectedError) Error() string {
+	return fmt.Sprintf("node rejected messages with status %d: %s", e.status, e.msg)
+}
+
+const (
+	// DefaultRetryQueueSize is the number of messages held for retrying to each
+	// node when no size is specified.
+	DefaultRetryQueueSize = 1000
+
+	// DefaultRetryMaxAge is how long messages are retried for when no maximum age
+	// is specified.
+	DefaultRetryMaxAge = time.Minute
+
+	// DefaultRetryMinBackoff is how long to wait before the first retry when no
+	// backoff is specified.
+	DefaultRetryMinBackoff = time.Millisecond * 100
+
+	// DefaultRetryMaxBackoff is the longest time to wait between retries when no
+	// backoff is specified.
+	DefaultRetryMaxBackoff = time.Second * 10
+
+	// DefaultRetryBatchSize is the largest number of messages retried to a node
+	// in a single batch when no size is specified. It matches the largest batch
+	// nodes accept by default.
+	DefaultRetryBatchSize = 1000
+
+	// DefaultRetryBatchBytes is the largest batch in bytes retried to a node when
+	// no size is specified. It matches the largest batch nodes accept by default.
+	DefaultRetryBatchBytes = 10 * 1024 * 1024
+
+	// DefaultDeadLetterSize is the number of dead letters kept for inspection.
+	DefaultDeadLetterSize = 100
+)
+
+// WithRetry sets the number of messages held for retrying to each node, and how
+// long they are retried for before becoming dead letters. A size of zero disables
+// retrying, messages that fail to propagate become dead letters straight away.
+func WithRetry(size int, maxAge time.Duration) Option {
+	return func(b *Broker) {
+		b.retries.size = size
+		b.retries.maxAge = maxAge
+	}
+}
+
+// WithRetryBackoff sets how long to wait before retrying messages to a node. The
+// wait doubles after each failed attempt, up to the maximum, and is randomised so
+// that nodes don't retry in step with one another.
+func WithRetryBackoff(min, max time.Duration) Option {
+	return func(b *Broker) {
+		b.retries.minBackoff = min
+		b.retries.maxBackoff = max
+	}
+}
+
+// WithRetryBatch sets the largest number of messages, and the largest size in
+// bytes, of each batch retried to a node. Messages waiting to be retried are split
+// into as many batches as needed, so they should match the largest batch other
+// nodes accept. A limit of zero allows batches of any size.
+func WithRetryBatch(size int, bytes int64) Option {
+	return func(b *Broker) {
+		b.retries.batchSize = size
+		b.retries.batchBytes = bytes
+	}
+}
+
+func newRetrier() *retrier {
+	return &retrier{
+		size:       DefaultRetryQueueSize,
+		maxAge:     DefaultRetryMaxAge,
+		minBackoff: DefaultRetryMinBackoff,
+		maxBackoff: DefaultRetryMaxBackoff,
+		batchSize:  DefaultRetryBatchSize,
+		batchBytes: DefaultRetryBatchBytes,
+		queues:     make(map[string]*retryQueue),
+		retried:    make(map[string]uint64),
+		dropped:    make(map[string]uint64),
+	}
+}
+
+// DeadLetters returns the most recent messages that could not be propagated to
+// other nodes, oldest first.
+func (b *Broker) DeadLetters() []DeadLetter {
+	r := b.retries
+
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	out := make([]DeadLetter, len(r.deadLetters))
+	copy(out, r.deadLetters)
+
+	return out
+}
+
+// retry queues messages that could not be propagated to a node. The oldest
+// messages become dead letters if the node's queue is full.
+func (b *Broker) retry(nodeID string, msgs []Message) {
+	r := b.retries
+
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	if r.stopped {
+		return
+	}
+
+	if r.size <= 0 {
+		r.deadLetter(nodeID, msgs, "retrying is disabled", 0)
+		return
+	}
+
+	q, ok := r.queues[nodeID]
+	if !ok {
+		q = &retryQueue{}
+		r.queues[nodeID] = q
+	}
+
+	now := time.Now()
+	for _, msg := range msgs {
+		q.entries = append(q.entries, retryEntry{msg: msg, queuedAt: now})
+	}
+
+	if over := len(q.entries) - r.size; over > 0 {
+		r.deadLetter(nodeID, entryMessages(q.entries[:over]), "retry queue is full", q.attempts)
+		q.entries = q.entries[over:]
+	}
+
+	if q.timer == nil {
+		q.timer = time.AfterFunc(r.backoff(q.attempts), func() {
+			b.retryNode(nodeID)
+		})
+	}
+}
+
+// retryNode sends the messages queued for a node, split into batches within the
+// retrier's limits. Messages that are too old become dead letters, as do batches
+// the node rejects as invalid. If a batch can't be sent, it and the batches after
+// it are retried after a longer wait.
+func (b *Broker) retryNode(nodeID string) {
+	r := b.retries
+
+	r.mux.Lock()
+	q, ok := r.queues[nodeID]
+	if !ok || r.stopped {
+		r.mux.Unlock()
+		return
+	}
+
+	attempts := q.attempts
+
+	var pending []retryEntry
+	var expired, aged []Message
+	for _, entry := range q.entries {
+		switch {
+		case entry.msg.Expired():
+			expired = append(expired, entry.msg)
+		case r.maxAge > 0 && time.Since(entry.queuedAt) > r.maxAge:
+			aged = append(aged, entry.msg)
+		default:
+			pending = append(pending, entry)
+		}
+	}
+
+	r.deadLetter(nodeID, aged, "exceeded maximum retry age", attempts)
+
+	q.entries = nil
+	r.mux.Unlock()
+
+	for _, msg := range expired {
+		b.Expire(msg)
+	}
+
+	member := b.member(nodeID)
+
+	var err error
+	var sent int
+	var failed []retryEntry
+	var rejected []rejectedBatch
+
+	if member != nil {
+		batches := r.batches(pending)
+
+		for i, batch := range batches {
+			msgs := entryMessages(batch)
+			err = b.sendBatch(member, msgs)
+
+			if rerr, ok := err.(*rejectedError); ok {
+				// Sending the same batch again would fail in the same way
+				rejected = append(rejected, rejectedBatch{msgs: msgs, err: rerr})
+				err = nil
+
+				continue
+			}
+
+			b.recordPropagation(nodeID, err)
+
+			if err != nil {
+				for _, batch := range batches[i:] {
+					failed = append(failed, batch...)
+				}
+
+				break
+			}
+
+			sent += len(msgs)
+		}
+	}
+
+	fields := logrus.Fields{
+		"targetNodeId": nodeID,
+		"batchSize":    len(pending),
+		"attempts":     attempts + 1,
+	}
+
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	for _, batch := range rejected {
+		b.log.WithFields(fields).WithError(batch.err).Error("node rejected retried batch")
+		r.deadLetter(nodeID, batch.msgs, batch.err.Error(), attempts+1)
+	}
+
+	if sent > 0 {
+		r.retried[nodeID] += uint64(sent)
+		b.log.WithFields(fields).Info("retried propagation to node")
+	}
+
+	switch {
+	case member == nil:
+		r.deadLetter(nodeID, entryMessages(pending), "node left the cluster", attempts)
+		q.attempts = 0
+	case err != nil:
+		b.log.WithFields(fields).WithError(err).Error("failed to retry propagation to node")
+
+		// Messages queued during the attempt are newer than those retried
+		q.entries = append(failed, q.entries...)
+		q.attempts++
+
+		if over := len(q.entries) - r.size; over > 0 {
+			r.deadLetter(nodeID, entryMessages(q.entries[:over]), "retry queue is full", q.attempts)
+			q.entries = q.entries[over:]
+		}
+	default:
+		q.attempts = 0
+	}
+
+	if len(q.entries) == 0 || r.stopped {
+		delete(r.queues, nodeID)
+		return
+	}
+
+	q.timer = time.AfterFunc(r.backoff(q.attempts), func() {
+		b.retryNode(nodeID)
+	})
+}
+
+// batches splits messages waiting to be retried into batches within the retrier's
+// limits. A message larger than the byte limit is sent in a batch of its own.
+func (r *retrier) batches(entries []retryEntry) [][]retryEntry {
+	var out [][]retryEntry
+	var size int64
+
+	start := 0
+	for i := range entries {
+		// Each message is followed by a comma, and the batch is wrapped in brackets
+		n := int64(len(entries[i].msg.JSON())) + 1
+		if i == start {
+			size = n + 1
+			continue
+		}
+
+		if (r.batchSize > 0 && i-start >= r.batchSize) || (r.batchBytes > 0 && size+n > r.batchBytes) {
+			out = append(out, entries[start:i])
+			start = i
+			size = n + 1
+
+			continue
+		}
+
+		size += n
+	}
+
+	if start < len(entries) {
+		out = append(out, entries[start:])
+	}
+
+	return out
+}
+
+// member returns the member node with the given name, or nil if it isn't part of
+// the cluster.
+func (b *Broker) member(nodeID string) *memberlist.Node {
+	for _, member := range b.memberlist.Members() {
+		if member.Name == nodeID {
+			return member
+		}
+	}
+
+	return nil
+}
+
+// backoff returns how long to wait before the next retry, given the number of
+// attempts already made. Half of the wait is random.
+func (r *retrier) backoff(attempts int) time.Duration {
+	d := r.minBackoff
+	for i := 0; i < attempts && d < r.maxBackoff; i++ {
+		d *= 2
+	}
+
+	if r.maxBackoff > 0 && d > r.maxBackoff {
+		d = r.maxBackoff
+	}
+
+	if d <= 0 {
+		return 0
+	}
+
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// deadLetter records messages that were given up on. Only the most recent dead
+// letters are kept.
+func (r *retrier) deadLetter(nodeID string, msgs []Message, reason string, attempts int) {
+	if len(msgs) == 0 {
+		return
+	}
+
+	r.dropped[nodeID] += uint64(len(msgs))
+	r.deadLetters = append(r.deadLetters, DeadLetter{
+		Node:     nodeID,
+		Messages: msgs,
+		Reason:   reason,
+		Attempts: attempts,
+		At:       time.Now(),
+	})
+
+	if over := len(r.deadLetters) - DefaultDeadLetterSize; over > 0 {
+		r.deadLetters = r.deadLetters[over:]
+	}
+}
+
+// status records the number of messages waiting to be retried, retried and given
+// up on for each node.
+func (r *retrier) status(s *Status) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	s.RetryQueued = make(map[string]int)
+	for nodeID, q := range r.queues {
+		s.RetryQueued[nodeID] = len(q.entries)
+	}
+
+	s.Retried = make(map[string]uint64)
+	for nodeID, count := range r.retried {
+		s.Retried[nodeID] = count
+	}
+
+	s.RetryDropped = make(map[string]uint64)
+	for nodeID, count := range r.dropped {
+		s.RetryDropped[nodeID] = count
+	}
+}
+
+// stop cancels all pending retries.
+func (r *retrier) stop() {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	r.stopped = true
+	for nodeID, q := range r.queues {
+		if q.timer != nil {
+			q.timer.Stop()
+		}
+
+		delete(r.queues, nodeID)
+	}
+}
+
+func entryMessages(entries []retryEntry) []Message {
+	msgs := make([]Message, len(entries))
+	for i, entry := range entries {
+		msgs[i] = entry.msg
+	}
+
+	return msgs
+}
@@ -0,0 +1,65 @@
+package broker
+
+import (
+	"sync"
+	"time"
+)
+
+type (
+	// The scheduler type holds messages until the time they should be delivered.
+	// Each pending delivery is identified by a key, so that a message scheduled
+	// more than once is only delivered once.
+	scheduler struct {
+		mux     sync.Mutex
+		pending map[string]*time.Timer
+	}
+)
+
+func newScheduler() *scheduler {
+	return &scheduler{
+		pending: make(map[string]*time.Timer),
+	}
+}
+
+// schedule calls fn at the given time. If a delivery with the same key is already
+// pending, it is replaced.
+func (s *scheduler) schedule(key string, at time.Time, fn func()) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if timer, ok := s.pending[key]; ok {
+		timer.Stop()
+	}
+
+	var timer *time.Timer
+	timer = time.AfterFunc(time.Until(at), func() {
+		s.mux.Lock()
+		if s.pending[key] == timer {
+			delete(s.pending, key)
+		}
+		s.mux.Unlock()
+
+		fn()
+	})
+
+	s.pending[key] = timer
+}
+
+// len returns the number of pending deliveries.
+func (s *scheduler) len() int {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	return len(s.pending)
+}
+
+// stop cancels all pending deliveries.
+func (s *scheduler) stop() {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	for key, timer := range s.pending {
+		timer.Stop()
+		delete(s.pending, key)
+	}
+}
@@ -0,0 +1,18 @@
+package broker
+
+type (
+	// The EventStore interface describes a durable store of published messages
+	// the broker can use to replay events to clients, including those published
+	// before the node was restarted.
+	EventStore interface {
+		// Append writes a message published to the given channel to the store.
+		Append(channelID string, msg Message) error
+
+		// Since returns the stored messages for a channel that were published after
+		// the message with the given identifier, oldest first, and whether the
+		// identifier was found. If the identifier is empty or no longer stored, all
+		// stored messages for the channel are returned. If a limit is given, only
+		// that many of the most recent messages are returned.
+		Since(channelID, id string, limit int) ([]Message, bool, error)
+	}
+)
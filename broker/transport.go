@@ -0,0 +1,130 @@
+package broker
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+
+	"github.com/hashicorp/memberlist"
+	"github.com/sirupsen/logrus"
+)
+
+// The Transport type determines how messages are sent to other nodes in the
+// cluster.
+type Transport string
+
+const (
+	// TransportHTTP sends messages to the publishing endpoints of other nodes,
+	// using the HTTP port they provide as gossip metadata.
+	TransportHTTP Transport = "http"
+
+	// TransportGossip sends messages using the memberlist's reliable messaging,
+	// which uses the gossip encryption keyring and doesn't depend on the HTTP
+	// routes of other nodes.
+	TransportGossip Transport = "gossip"
+
+	// TransportPeer sends messages over a long-lived connection to each node,
+	// batching those sent at the same time. Each node advertises the port it
+	// accepts connections on through the memberlist.
+	TransportPeer Transport = "peer"
+)
+
+// The first byte of each message sent through the memberlist determines its type.
+const (
+	messageLocation byte = 'l'
+	messageEvent    byte = 'e'
+	messageBatch    byte = 'b'
+)
+
+// ParseTransport converts a string into a Transport, returning an error if it is
+// not a known transport.
+func ParseTransport(s string) (Transport, error) {
+	switch t := Transport(s); t {
+	case TransportHTTP, TransportGossip, TransportPeer:
+		return t, nil
+	default:
+		return "", fmt.Errorf("unknown transport %s", s)
+	}
+}
+
+// WithTransport sets how messages are sent to other nodes. TransportGossip and
+// TransportPeer require the broker's locations to be set using WithLocations, as
+// they handle messages received through the memberlist and share the port each
+// node accepts peer connections on. TransportPeer also requires a peer transport
+// set using WithPeerTransport. Requests that need a response, such as deduplication
+// checks, always use HTTP.
+func WithTransport(transport Transport) Option {
+	return func(b *Broker) {
+		b.transport = transport
+	}
+}
+
+// WithPeerTransport sets the transport used to send messages to other nodes when
+// using TransportPeer, along with the port this node accepts peer connections on.
+func WithPeerTransport(peers PeerTransport, port int) Option {
+	return func(b *Broker) {
+		b.peers = peers
+		b.peerPort = port
+	}
+}
+
+// peerAddr returns the address a member node accepts peer connections on, if
+// messages are sent using TransportPeer. Nodes that haven't advertised a port yet
+// are sent messages using HTTP.
+func (b *Broker) peerAddr(member *memberlist.Node) (string, bool) {
+	if b.transport != TransportPeer || b.peers == nil || b.locations == nil {
+		return "", false
+	}
+
+	port, ok := b.locations.peerPort(member.Name)
+
+	if !ok {
+		return "", false
+	}
+
+	return net.JoinHostPort(member.Addr.String(), strconv.Itoa(port)), true
+}
+
+// gossip returns true if messages are sent to other nodes through the memberlist.
+func (b *Broker) gossip() bool {
+	return b.transport == TransportGossip && b.locations != nil
+}
+
+// sendReliable sends a message of the given type to a member node using the
+// memberlist's reliable messaging.
+func (b *Broker) sendReliable(member *memberlist.Node, kind byte, data []byte) error {
+	return b.memberlist.SendReliable(member, append([]byte{kind}, data...))
+}
+
+// receive handles a message sent by another node through the memberlist,
+// publishing the events it contains.
+func (b *Broker) receive(kind byte, data []byte) {
+	switch kind {
+	case messageEvent:
+		var msg Message
+		if err := json.Unmarshal(data, &msg); err != nil {
+			b.log.WithError(err).Error("failed to decode event from node")
+			return
+		}
+
+		if _, err := b.Publish(msg.Channel, msg.Client, msg); err != nil {
+			b.log.WithFields(logrus.Fields{
+				"channel": msg.Channel,
+				"eventId": msg.ID,
+			}).WithError(err).Error("failed to publish event from node")
+		}
+	case messageBatch:
+		var msgs []Message
+		if err := json.Unmarshal(data, &msgs); err != nil {
+			b.log.WithError(err).Error("failed to decode batch from node")
+			return
+		}
+
+		for _, res := range b.PublishBatch(msgs) {
+			if res.Err != nil {
+				b.log.WithField("eventId", res.ID).WithError(res.Err).Error("failed to publish event from node")
+			}
+		}
+	}
+}
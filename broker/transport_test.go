@@ -0,0 +1,39 @@
+package broker_test
+
+import (
+	"testing"
+
+	"github.com/davidsbond/sse-cluster/broker"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseTransport(t *testing.T) {
+	t.Parallel()
+
+	tt := []struct {
+		Name              string
+		Transport         string
+		ExpectedTransport broker.Transport
+		ExpectError       bool
+	}{
+		{
+			Name:              "It should parse a known transport",
+			Transport:         "gossip",
+			ExpectedTransport: broker.TransportGossip,
+		},
+		{
+			Name:        "It should return an error for an unknown transport",
+			Transport:   "unknown",
+			ExpectError: true,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.Name, func(t *testing.T) {
+			transport, err := broker.ParseTransport(tc.Transport)
+
+			assert.Equal(t, tc.ExpectError, err != nil)
+			assert.Equal(t, tc.ExpectedTransport, transport)
+		})
+	}
+}
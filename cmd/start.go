@@ -3,15 +3,19 @@ package cmd
 import (
 	"context"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
 
 	"github.com/davidsbond/sse-cluster/broker"
 	"github.com/davidsbond/sse-cluster/handler"
+	"github.com/davidsbond/sse-cluster/peer"
+	"github.com/davidsbond/sse-cluster/store"
 	"github.com/gorilla/mux"
 	"github.com/hashicorp/memberlist"
 	"github.com/sirupsen/logrus"
@@ -37,7 +41,7 @@ func Start() cli.Command {
 				Value:  42000,
 			},
 			cli.StringFlag{
-				Usage:  "The key used to initialize the primary encryption key in a keyring",
+				Usage:  "The key used to initialize the primary encryption key in a keyring, must be 16, 24 or 32 bytes",
 				Name:   "gossip.secretKey",
 				EnvVar: "GOSSIP_SECRET_KEY",
 			},
@@ -52,18 +56,203 @@ func Start() cli.Command {
 				Name:   "http.server.cors.enabled",
 				EnvVar: "HTTP_SERVER_ENABLE_CORS",
 			},
+			cli.DurationFlag{
+				Name:   "http.server.heartbeat",
+				Usage:  "How often a heartbeat comment is written to idle event streams, zero disables heartbeats",
+				EnvVar: "HTTP_SERVER_HEARTBEAT",
+				Value:  time.Second * 15,
+			},
+			cli.DurationFlag{
+				Name:   "http.server.heartbeat.min",
+				Usage:  "The shortest heartbeat interval a client can request using the 'heartbeat' query parameter",
+				EnvVar: "HTTP_SERVER_HEARTBEAT_MIN",
+				Value:  handler.DefaultMinHeartbeatInterval,
+			},
+			cli.Int64Flag{
+				Name:   "http.server.batch.bytes",
+				Usage:  "The largest batch request body in bytes that is accepted, zero for no limit",
+				EnvVar: "HTTP_SERVER_BATCH_BYTES",
+				Value:  handler.DefaultMaxBatchBytes,
+			},
+			cli.IntFlag{
+				Name:   "http.server.batch.size",
+				Usage:  "The largest number of events a batch can contain, zero for no limit",
+				EnvVar: "HTTP_SERVER_BATCH_SIZE",
+				Value:  handler.DefaultMaxBatchSize,
+			},
 			cli.DurationFlag{
 				Name:   "http.client.timeout",
 				Usage:  "Sets the request timeout for the http client",
 				EnvVar: "HTTP_CLIENT_TIMEOUT",
 				Value:  time.Second * 10,
 			},
+			cli.IntFlag{
+				Name:   "channel.history.size",
+				Usage:  "The number of events each channel keeps for replaying to reconnecting clients",
+				EnvVar: "CHANNEL_HISTORY_SIZE",
+				Value:  broker.DefaultHistorySize,
+			},
+			cli.DurationFlag{
+				Name:   "channel.history.retention",
+				Usage:  "How long a channel's history is kept after the last event was published to it, zero keeps it indefinitely",
+				EnvVar: "CHANNEL_HISTORY_RETENTION",
+				Value:  broker.DefaultHistoryRetention,
+			},
+			cli.IntFlag{
+				Name:   "channel.replay.limit",
+				Usage:  "The maximum number of events replayed to a reconnecting client or returned by a history request, zero for no limit",
+				EnvVar: "CHANNEL_REPLAY_LIMIT",
+				Value:  broker.DefaultReplayLimit,
+			},
+			cli.StringFlag{
+				Name:   "propagation.transport",
+				Usage:  "How events are sent to other nodes: 'http' uses their publishing endpoints, 'gossip' uses the gossip protocol's encrypted reliable messaging, 'peer' uses long-lived connections to each node",
+				EnvVar: "PROPAGATION_TRANSPORT",
+				Value:  string(broker.TransportHTTP),
+			},
+			cli.IntFlag{
+				Name:   "peer.port",
+				Usage:  "The port to accept connections from other nodes on when using the 'peer' transport",
+				EnvVar: "PEER_PORT",
+				Value:  7947,
+			},
+			cli.DurationFlag{
+				Name:   "peer.send.timeout",
+				Usage:  "How long a node is given to acknowledge events sent over a peer connection before they are sent using HTTP",
+				EnvVar: "PEER_SEND_TIMEOUT",
+				Value:  peer.DefaultSendTimeout,
+			},
+			cli.StringFlag{
+				Name:   "propagation.mode",
+				Usage:  "How events reach other nodes: 'chain' relays them from node to node, 'fan-out' sends them to every node at once",
+				EnvVar: "PROPAGATION_MODE",
+				Value:  string(broker.PropagationChain),
+			},
+			cli.IntFlag{
+				Name:   "propagation.parallelism",
+				Usage:  "The number of nodes an event is sent to at once when using 'fan-out', zero for no limit",
+				EnvVar: "PROPAGATION_PARALLELISM",
+				Value:  broker.DefaultFanOutParallelism,
+			},
+			cli.IntFlag{
+				Name:   "retry.queue.size",
+				Usage:  "The number of events held for retrying to each node that couldn't be reached, zero to disable retrying",
+				EnvVar: "RETRY_QUEUE_SIZE",
+				Value:  broker.DefaultRetryQueueSize,
+			},
+			cli.DurationFlag{
+				Name:   "retry.max.age",
+				Usage:  "How long events are retried to a node before becoming dead letters",
+				EnvVar: "RETRY_MAX_AGE",
+				Value:  broker.DefaultRetryMaxAge,
+			},
+			cli.DurationFlag{
+				Name:   "retry.backoff.min",
+				Usage:  "How long to wait before the first retry to a node",
+				EnvVar: "RETRY_BACKOFF_MIN",
+				Value:  broker.DefaultRetryMinBackoff,
+			},
+			cli.DurationFlag{
+				Name:   "retry.backoff.max",
+				Usage:  "The longest time to wait between retries to a node",
+				EnvVar: "RETRY_BACKOFF_MAX",
+				Value:  broker.DefaultRetryMaxBackoff,
+			},
+			cli.DurationFlag{
+				Name:   "cluster.status.timeout",
+				Usage:  "How long each node is given to report its status for the cluster status, or its clients for presence lookups",
+				EnvVar: "CLUSTER_STATUS_TIMEOUT",
+				Value:  broker.DefaultStatusTimeout,
+			},
+			cli.StringSliceFlag{
+				Name:   "presence.events",
+				Usage:  "The channels that publish presence events when clients join or leave them, may be wildcard patterns",
+				EnvVar: "PRESENCE_EVENTS",
+			},
+			cli.IntFlag{
+				Name:   "ack.window",
+				Usage:  "The number of events a client using acknowledgements can have unacknowledged before no more are written to it, zero for no limit",
+				EnvVar: "ACK_WINDOW",
+				Value:  broker.DefaultAckWindow,
+			},
+			cli.DurationFlag{
+				Name:   "ack.retention",
+				Usage:  "How long the unacknowledged events of a disconnected client are kept for it to reconnect",
+				EnvVar: "ACK_RETENTION",
+				Value:  broker.DefaultAckRetention,
+			},
+			cli.StringSliceFlag{
+				Name:   "queue.channels",
+				Usage:  "The channels that deliver each event to a single subscriber across the cluster, may be wildcard patterns",
+				EnvVar: "QUEUE_CHANNELS",
+			},
+			cli.StringFlag{
+				Name:   "queue.selection",
+				Usage:  "How the subscriber of a queue channel is chosen: 'round-robin' or 'least-loaded'",
+				EnvVar: "QUEUE_SELECTION",
+				Value:  string(broker.SelectRoundRobin),
+			},
+			cli.DurationFlag{
+				Name:   "presence.max.age",
+				Usage:  "The oldest cached cluster-wide presence lookup that can be served to requests using 'max_age'",
+				EnvVar: "PRESENCE_MAX_AGE",
+				Value:  broker.DefaultPresenceMaxAge,
+			},
+			cli.IntFlag{
+				Name:   "client.buffer.size",
+				Usage:  "The number of events that can be queued for each client before the overflow policy applies",
+				EnvVar: "CLIENT_BUFFER_SIZE",
+				Value:  1,
+			},
+			cli.StringFlag{
+				Name:   "client.overflow.policy",
+				Usage:  "What to do when a client's buffer is full, one of 'block', 'drop-oldest', 'drop-newest' or 'disconnect'",
+				EnvVar: "CLIENT_OVERFLOW_POLICY",
+				Value:  string(broker.OverflowBlock),
+			},
+			cli.DurationFlag{
+				Name:   "client.overflow.timeout",
+				Usage:  "How long to wait for space in a client's buffer when using the 'block' policy, zero waits indefinitely",
+				EnvVar: "CLIENT_OVERFLOW_TIMEOUT",
+			},
+			cli.DurationFlag{
+				Name:   "dedup.window",
+				Usage:  "How long published event ids and idempotency keys are remembered to discard retries, zero disables deduplication",
+				EnvVar: "DEDUP_WINDOW",
+			},
+			cli.StringFlag{
+				Name:   "store.path",
+				Usage:  "If set, the directory events are durably stored in for replaying to clients",
+				EnvVar: "STORE_PATH",
+			},
+			cli.Int64Flag{
+				Name:   "store.segment.size",
+				Usage:  "The size in bytes an event store segment file can grow to before a new one is started",
+				EnvVar: "STORE_SEGMENT_SIZE",
+				Value:  store.DefaultSegmentSize,
+			},
+			cli.DurationFlag{
+				Name:   "store.retention.age",
+				Usage:  "How long events are kept in the event store, zero keeps events indefinitely",
+				EnvVar: "STORE_RETENTION_AGE",
+				Value:  time.Hour * 24,
+			},
+			cli.Int64Flag{
+				Name:   "store.retention.size",
+				Usage:  "The size in bytes the event store can grow to before the oldest events are deleted, zero for no limit",
+				EnvVar: "STORE_RETENTION_SIZE",
+			},
+			cli.DurationFlag{
+				Name:   "store.sync.interval",
+				Usage:  "How often appended events are flushed to disk, zero flushes after every event and a negative interval leaves flushing to the operating system",
+				EnvVar: "STORE_SYNC_INTERVAL",
+			},
 		},
 	}
 }
 
 func start(ctx *cli.Context) error {
-	list, err := createMemberList(ctx)
+	list, locations, err := createMemberList(ctx)
 
 	if err != nil {
 		return cli.NewExitError(err.Error(), 1)
@@ -73,10 +262,92 @@ func start(ctx *cli.Context) error {
 		Timeout: ctx.Duration("http.client.timeout"),
 	}
 
-	br := broker.New(list, cl)
-	hnd := handler.New(br)
+	policy, err := broker.ParseOverflowPolicy(ctx.String("client.overflow.policy"))
+
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+
+	propagation, err := broker.ParsePropagation(ctx.String("propagation.mode"))
+
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+
+	transport, err := broker.ParseTransport(ctx.String("propagation.transport"))
+
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+
+	selection, err := broker.ParseSelection(ctx.String("queue.selection"))
+
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+
+	opts := []broker.Option{
+		broker.WithHistorySize(ctx.Int("channel.history.size")),
+		broker.WithHistoryRetention(ctx.Duration("channel.history.retention")),
+		broker.WithReplayLimit(ctx.Int("channel.replay.limit")),
+		broker.WithPresenceMaxAge(ctx.Duration("presence.max.age")),
+		broker.WithAckWindow(ctx.Int("ack.window"), ctx.Duration("ack.retention")),
+		broker.WithPresenceEvents(ctx.StringSlice("presence.events")...),
+		broker.WithQueueChannels(selection, ctx.StringSlice("queue.channels")...),
+		broker.WithStatusTimeout(ctx.Duration("cluster.status.timeout")),
+		broker.WithLocations(locations),
+		broker.WithPropagation(propagation, ctx.Int("propagation.parallelism")),
+		broker.WithTransport(transport),
+		broker.WithRetry(ctx.Int("retry.queue.size"), ctx.Duration("retry.max.age")),
+		broker.WithRetryBackoff(ctx.Duration("retry.backoff.min"), ctx.Duration("retry.backoff.max")),
+		// Other nodes are expected to accept batches as large as this one does
+		broker.WithRetryBatch(ctx.Int("http.server.batch.size"), ctx.Int64("http.server.batch.bytes")),
+		broker.WithChannelOptions(
+			broker.WithClientOptions(
+				broker.WithBufferSize(ctx.Int("client.buffer.size")),
+				broker.WithOverflowPolicy(policy),
+				broker.WithBlockTimeout(ctx.Duration("client.overflow.timeout")),
+			),
+		),
+		broker.WithDedupWindow(ctx.Duration("dedup.window")),
+	}
+
+	if transport == broker.TransportPeer {
+		peers := peer.NewClient(list.LocalNode().Name, peer.WithSendTimeout(ctx.Duration("peer.send.timeout")))
+		defer peers.Close()
+
+		opts = append(opts, broker.WithPeerTransport(peers, ctx.Int("peer.port")))
+	}
+
+	if path := ctx.String("store.path"); path != "" {
+		st, err := createEventStore(ctx, path)
+
+		if err != nil {
+			return cli.NewExitError(err.Error(), 1)
+		}
+
+		defer st.Close()
+		opts = append(opts, broker.WithEventStore(st))
+	}
+
+	br := broker.New(list, cl, opts...)
+	hnd := handler.New(br,
+		handler.WithHeartbeatInterval(ctx.Duration("http.server.heartbeat")),
+		handler.WithMinHeartbeatInterval(ctx.Duration("http.server.heartbeat.min")),
+		handler.WithMaxBatchBytes(ctx.Int64("http.server.batch.bytes")),
+		handler.WithMaxBatchSize(ctx.Int("http.server.batch.size")),
+	)
 	svr := createHTTPServer(ctx, hnd)
 
+	var ps *peer.Server
+	if transport == broker.TransportPeer {
+		ps, err = startPeerServer(ctx, br)
+
+		if err != nil {
+			return cli.NewExitError(err.Error(), 1)
+		}
+	}
+
 	// Execute ListenAndServe in a separate goroutine as it blocks
 	go func() {
 		logrus.Info("starting http server")
@@ -86,14 +357,14 @@ func start(ctx *cli.Context) error {
 		}
 	}()
 
-	if err := handleExitSignal(br, svr, list); err != nil {
+	if err := handleExitSignal(br, svr, ps, list); err != nil {
 		return cli.NewExitError(err.Error(), 1)
 	}
 
 	return nil
 }
 
-func handleExitSignal(b *broker.Broker, svr *http.Server, ml *memberlist.Memberlist) error {
+func handleExitSignal(b *broker.Broker, svr *http.Server, ps *peer.Server, ml *memberlist.Memberlist) error {
 	stop := make(chan os.Signal, 1)
 	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
 
@@ -114,6 +385,12 @@ func handleExitSignal(b *broker.Broker, svr *http.Server, ml *memberlist.Memberl
 		return err
 	}
 
+	// Stop accepting events from other nodes over peer connections
+	if ps != nil {
+		logrus.Info("shutting down peer server")
+		ps.Close()
+	}
+
 	// Wait for any broker operations to finish
 	logrus.Info("waiting for broker operations to finish")
 	b.Close()
@@ -122,12 +399,43 @@ func handleExitSignal(b *broker.Broker, svr *http.Server, ml *memberlist.Memberl
 	return logrus.StandardLogger().Writer().Close()
 }
 
+func startPeerServer(ctx *cli.Context, br *broker.Broker) (*peer.Server, error) {
+	l, err := net.Listen("tcp", ":"+strconv.Itoa(ctx.Int("peer.port")))
+
+	if err != nil {
+		return nil, err
+	}
+
+	ps := peer.NewServer(br)
+
+	go func() {
+		logrus.Info("starting peer server")
+
+		if err := ps.Serve(l); err != nil {
+			logrus.WithError(err).Error("peer server exited")
+		}
+	}()
+
+	return ps, nil
+}
+
 func createHTTPServer(ctx *cli.Context, h *handler.Handler) *http.Server {
 	router := mux.NewRouter()
 
 	router.HandleFunc("/status", h.Status).Methods("GET")
+	router.HandleFunc("/cluster/status", h.ClusterStatus).Methods("GET")
+	router.HandleFunc("/dead-letters", h.DeadLetters).Methods("GET")
+
+	router.HandleFunc("/channels/{channel}", h.DescribeChannel).Methods("GET")
+	router.HandleFunc("/channels/{channel}", h.DeleteChannel).Methods("DELETE")
+	router.HandleFunc("/channels/{channel}", h.DeclareChannel).
+		Methods("PUT").
+		Headers("Content-Type", "application/json")
 
+	router.HandleFunc("/subscribe", h.Subscribe).Methods("GET")
 	router.HandleFunc("/channel/{channel}", h.Subscribe).Methods("GET")
+	router.HandleFunc("/channel/{channel}/history", h.History).Methods("GET")
+	router.HandleFunc("/channel/{channel}/clients", h.Clients).Methods("GET")
 	router.HandleFunc("/channel/{channel}/client/{client}", h.Subscribe).Methods("GET")
 
 	router.HandleFunc("/channel", h.Publish).
@@ -142,6 +450,34 @@ func createHTTPServer(ctx *cli.Context, h *handler.Handler) *http.Server {
 		Methods("POST").
 		Headers("Content-Type", "application/json")
 
+	router.HandleFunc("/batch", h.Batch).
+		Methods("POST").
+		Headers("Content-Type", "application/json")
+
+	router.HandleFunc("/channel/{channel}/client/{client}/ack", h.Ack).
+		Methods("POST").
+		Headers("Content-Type", "application/json")
+
+	router.HandleFunc("/client/{client}/handover", h.Handover).Methods("POST")
+
+	router.HandleFunc("/dedup", h.Dedup).
+		Methods("POST").
+		Headers("Content-Type", "application/json")
+
+	router.HandleFunc("/batch", h.Batch).
+		Methods("POST").
+		Headers("Content-Type", "application/x-ndjson")
+
+	for _, path := range []string{"/stream", "/channel/{channel}/stream"} {
+		router.HandleFunc(path, h.Stream).
+			Methods("POST").
+			Headers("Content-Type", "application/x-ndjson")
+
+		router.HandleFunc(path, h.Stream).
+			Methods("POST").
+			Headers("Content-Type", "text/event-stream")
+	}
+
 	if ctx.Bool("http.server.cors.enabled") {
 		router.Use(handler.CORSMiddleware)
 	}
@@ -155,19 +491,36 @@ func createHTTPServer(ctx *cli.Context, h *handler.Handler) *http.Server {
 	return svr
 }
 
-func createMemberList(ctx *cli.Context) (*memberlist.Memberlist, error) {
+func createEventStore(ctx *cli.Context, path string) (*store.Log, error) {
+	logrus.WithField("path", path).Info("opening event store")
+
+	return store.Open(path,
+		store.WithSegmentSize(ctx.Int64("store.segment.size")),
+		store.WithMaxAge(ctx.Duration("store.retention.age")),
+		store.WithMaxBytes(ctx.Int64("store.retention.size")),
+		store.WithSyncInterval(ctx.Duration("store.sync.interval")),
+	)
+}
+
+func createMemberList(ctx *cli.Context) (*memberlist.Memberlist, *broker.Locations, error) {
 	c := memberlist.DefaultLANConfig()
 
+	// Nodes provide their HTTP port as gossip metadata and share the clients
+	// connected to them, so messages for a client can be sent to its node.
+	locations := broker.NewLocations(c.Name, []byte(ctx.String("http.server.port")))
+
 	c.Logger = log.New(logrus.StandardLogger().Writer(), "", 0)
 	c.BindPort = ctx.Int("gossip.port")
-	c.SecretKey = []byte(ctx.String("gossip.secret-key"))
+	c.SecretKey = []byte(ctx.String("gossip.secretKey"))
+	c.Delegate = locations
+	c.Events = locations
 
 	logrus.Info("creating gossip memberlist")
 
 	list, err := memberlist.Create(c)
 
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	hosts := ctx.StringSlice("gossip.hosts")
@@ -182,15 +535,13 @@ func createMemberList(ctx *cli.Context) (*memberlist.Memberlist, error) {
 		actual = append(actual, host)
 	}
 
-	list.LocalNode().Meta = []byte(ctx.String("http.server.port"))
-
 	if len(actual) > 0 {
 		logrus.WithField("hosts", actual).Info("joining sse cluster")
 
 		if _, err := list.Join(actual); err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 	}
 
-	return list, nil
+	return list, locations, nil
 }
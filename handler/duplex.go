@@ -0,0 +1,13 @@
+//go:build !go1.21
+// +build !go1.21
+
+package handler
+
+import "net/http"
+
+// enableFullDuplex is a no-op before go 1.21. Streams over HTTP/2 are always full
+// duplex, but HTTP/1.x responses can only be written once the request body has
+// been read.
+func enableFullDuplex(w http.ResponseWriter) error {
+	return nil
+}
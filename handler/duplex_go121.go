@@ -0,0 +1,13 @@
+//go:build go1.21
+// +build go1.21
+
+package handler
+
+import "net/http"
+
+// enableFullDuplex allows the request body to be read after the response has
+// started being written, so HTTP/1.x clients can receive responses while still
+// sending the request.
+func enableFullDuplex(w http.ResponseWriter) error {
+	return http.NewResponseController(w).EnableFullDuplex()
+}
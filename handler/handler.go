@@ -4,7 +4,12 @@ package handler
 
 import (
 	"encoding/json"
+	"fmt"
+	"io"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/davidsbond/sse-cluster/broker"
 	"github.com/gorilla/mux"
@@ -16,26 +21,131 @@ type (
 	// The Handler type contains methods for handling inbound HTTP requests
 	// to the broker.
 	Handler struct {
-		broker Broker
-		log    *logrus.Entry
+		broker    Broker
+		log       *logrus.Entry
+		heartbeat time.Duration
+		minBeat   time.Duration
+		maxBytes  int64
+		maxItems  int
+	}
+
+	// The Option type is a function that modifies the configuration of the
+	// handler on creation.
+	Option func(*Handler)
+
+	// The streamItem type is a message read from a publisher stream, or the error
+	// that stopped the stream from being read.
+	streamItem struct {
+		msg broker.Message
+		err error
+	}
+
+	// The PublishResponse type is the response body returned when a message is
+	// published.
+	PublishResponse struct {
+		ID        string `json:"id"`
+		Duplicate bool   `json:"duplicate"`
+		Error     string `json:"error,omitempty"`
 	}
 
 	// The Broker interface defines methods the HTTP handlers use to perform
 	// operations against the broker from HTTP requests.
 	Broker interface {
 		Status() *broker.Status
-		Publish(string, string, broker.Message) error
-		NewClient(string, string) (*broker.Client, error)
-		RemoveClient(string, string)
+		ClusterStatus() *broker.ClusterStatus
+		DeadLetters() []broker.DeadLetter
+		Ack(string, string, []string) (int, error)
+		Handover(string) []broker.Message
+		Publish(string, string, broker.Message) (string, error)
+		PublishBatch([]broker.Message) []broker.BatchResult
+		NewClient([]string, string, ...broker.ClientOption) (*broker.Client, error)
+		RemoveClient([]string, string)
+		Replay([]string, string) []broker.Message
+		History(string, string, int) ([]broker.Message, error)
+		Expire(broker.Message)
+		CheckDuplicate(string, string) (string, bool)
+		ReleaseDuplicate(string)
+		Clients(string, string, time.Duration) *broker.ClientList
+		LocalClients(string) []broker.Presence
+		DeclareChannel(broker.ChannelConfig) (broker.ChannelConfig, error)
+		DescribeChannel(string) (broker.ChannelConfig, bool)
+		DeleteChannel(string) error
+		Authorize([]string, string) error
 	}
 )
 
+// heartbeat is the SSE comment written to idle event streams to keep them open.
+var heartbeat = []byte(": ping\n\n")
+
+// metadataPrefix is the prefix of query parameters that describe a subscriber.
+const metadataPrefix = "meta."
+
+// streamReadAhead is the number of messages read from a publisher stream ahead of
+// those being published.
+const streamReadAhead = 100
+
+const (
+	// DefaultMinHeartbeatInterval is the shortest heartbeat interval a client can
+	// request when no minimum is specified.
+	DefaultMinHeartbeatInterval = time.Second
+
+	// DefaultMaxBatchBytes is the largest batch request body in bytes that is
+	// accepted when no limit is specified.
+	DefaultMaxBatchBytes = 10 * 1024 * 1024
+
+	// DefaultMaxBatchSize is the largest number of messages a batch can contain
+	// when no limit is specified.
+	DefaultMaxBatchSize = 1000
+)
+
+// WithHeartbeatInterval sets how often a heartbeat comment is written to event
+// streams that have had no other traffic. An interval of zero disables heartbeats.
+func WithHeartbeatInterval(interval time.Duration) Option {
+	return func(h *Handler) {
+		h.heartbeat = interval
+	}
+}
+
+// WithMinHeartbeatInterval sets the shortest heartbeat interval a client can
+// request using the 'heartbeat' query parameter, so that clients cannot have the
+// node write to their stream continuously.
+func WithMinHeartbeatInterval(interval time.Duration) Option {
+	return func(h *Handler) {
+		h.minBeat = interval
+	}
+}
+
+// WithMaxBatchBytes sets the largest batch request body in bytes that is accepted.
+// A limit of zero accepts bodies of any size.
+func WithMaxBatchBytes(size int64) Option {
+	return func(h *Handler) {
+		h.maxBytes = size
+	}
+}
+
+// WithMaxBatchSize sets the largest number of messages a batch can contain. A limit
+// of zero accepts batches of any size.
+func WithMaxBatchSize(size int) Option {
+	return func(h *Handler) {
+		h.maxItems = size
+	}
+}
+
 // New creates a new instance of the Handler type with the given broker
-func New(br Broker) *Handler {
-	return &Handler{
-		broker: br,
-		log:    logrus.WithField("name", "handler"),
+func New(br Broker, opts ...Option) *Handler {
+	h := &Handler{
+		broker:   br,
+		minBeat:  DefaultMinHeartbeatInterval,
+		maxBytes: DefaultMaxBatchBytes,
+		maxItems: DefaultMaxBatchSize,
+		log:      logrus.WithField("name", "handler"),
+	}
+
+	for _, opt := range opts {
+		opt(h)
 	}
+
+	return h
 }
 
 // Status handles an incoming HTTP GET request that returns the current
@@ -50,8 +160,39 @@ func (h *Handler) Status(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 }
 
+// ClusterStatus handles an incoming HTTP GET request that returns the merged
+// status of every node in the cluster.
+func (h *Handler) ClusterStatus(w http.ResponseWriter, r *http.Request) {
+	status := h.broker.ClusterStatus()
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if err := json.NewEncoder(w).Encode(status); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// DeadLetters handles an incoming HTTP GET request that returns the most recent
+// messages that could not be propagated to other nodes.
+func (h *Handler) DeadLetters(w http.ResponseWriter, r *http.Request) {
+	letters := h.broker.DeadLetters()
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if err := json.NewEncoder(w).Encode(letters); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
 // Publish handles an incoming HTTP POST request and writes a message to the broker.
-// Returns a 400 if invalid JSON has been provided.
+// Returns a 400 if invalid JSON has been provided or the channel is a wildcard. On
+// success, the response body contains the message's identifier, which is assigned
+// by the broker if one was not provided. Retried publishes can be detected using the
+// message identifier or the 'Idempotency-Key' header, the response body indicates
+// whether the message was a duplicate. Delivery can be postponed using the message's
+// 'delay' field in milliseconds or its 'deliver_at' field, returns a 400 if the delay
+// is negative. Returns a 404 if the message is for a client that isn't connected to
+// any node.
 func (h *Handler) Publish(w http.ResponseWriter, r *http.Request) {
 	var msg broker.Message
 
@@ -59,20 +200,499 @@ func (h *Handler) Publish(w http.ResponseWriter, r *http.Request) {
 	channelID := vars["channel"]
 	clientID := vars["client"]
 
+	if broker.IsWildcard(channelID) {
+		http.Error(w, "cannot publish to a wildcard channel", http.StatusBadRequest)
+		return
+	}
+
 	if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	if err := h.broker.Publish(channelID, clientID, msg); err != nil {
+	if key := r.Header.Get("Idempotency-Key"); key != "" {
+		msg.IdempotencyKey = key
+	}
+
+	if msg.Delay < 0 {
+		http.Error(w, "delay cannot be negative", http.StatusBadRequest)
+		return
+	}
+
+	id, err := h.broker.Publish(channelID, clientID, msg)
+	duplicate := err == broker.ErrDuplicate
+
+	if err == broker.ErrClientNotFound {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	if err != nil && !duplicate {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	resp := PublishResponse{ID: id, Duplicate: duplicate}
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// Ack handles an incoming HTTP POST request that acknowledges events written to a
+// client that subscribed using '?ack=true'. The body contains the identifiers of the
+// acknowledged events that were published to the channel, and the response body
+// contains the number that were waiting to be acknowledged. Returns a 400 if invalid
+// JSON has been provided, or a 404 if no node holds events for the client.
+func (h *Handler) Ack(w http.ResponseWriter, r *http.Request) {
+	var req broker.AckRequest
+
+	vars := mux.Vars(r)
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	n, err := h.broker.Ack(vars["channel"], vars["client"], req.IDs)
+
+	if err == broker.ErrClientNotFound {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if err := json.NewEncoder(w).Encode(broker.AckResponse{Acknowledged: n}); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// Handover handles an incoming HTTP POST request from another node in the cluster
+// that a client using acknowledgements has reconnected to. The response body
+// contains the events this node was holding for the client that it didn't
+// acknowledge, which are no longer held here.
+func (h *Handler) Handover(w http.ResponseWriter, r *http.Request) {
+	msgs := h.broker.Handover(mux.Vars(r)["client"])
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if err := json.NewEncoder(w).Encode(broker.HandoverResponse{Messages: msgs}); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// Dedup handles an incoming HTTP POST request from another node in the cluster that
+// checks whether deduplication keys owned by this node have been seen. The body is
+// a JSON array of keys, each of which is released instead if its 'release' field
+// is set. The response body is a JSON array indicating whether each key was a
+// duplicate and the identifier of the original message, in the same order. Returns
+// a 400 if invalid JSON has been provided.
+func (h *Handler) Dedup(w http.ResponseWriter, r *http.Request) {
+	var reqs []broker.DedupRequest
+
+	if err := json.NewDecoder(r.Body).Decode(&reqs); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	resp := make([]broker.DedupResponse, len(reqs))
+
+	for i, req := range reqs {
+		if req.Release {
+			h.broker.ReleaseDuplicate(req.Key)
+			continue
+		}
+
+		resp[i].ID, resp[i].Duplicate = h.broker.CheckDuplicate(req.Key, req.ID)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// Batch handles an incoming HTTP POST request that publishes many messages at once.
+// The body is either a JSON array of messages or, if the 'Content-Type' header is
+// 'application/x-ndjson', newline-delimited JSON messages. Each message is published
+// to its 'channel' field, and to its 'client' field within that channel if set. The
+// response body is a JSON array containing the result of publishing each message,
+// in the same order. Returns a 400 if invalid JSON has been provided, or the body or
+// number of messages exceeds the handler's limits.
+func (h *Handler) Batch(w http.ResponseWriter, r *http.Request) {
+	var msgs []broker.Message
+
+	if h.maxBytes > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, h.maxBytes)
+	}
+
+	if r.Header.Get("Content-Type") == "application/x-ndjson" {
+		dec := json.NewDecoder(r.Body)
+
+		for dec.More() {
+			var msg broker.Message
+
+			if err := dec.Decode(&msg); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			msgs = append(msgs, msg)
+
+			// Stop reading as soon as the batch is too large
+			if h.maxItems > 0 && len(msgs) > h.maxItems {
+				break
+			}
+		}
+	} else if err := json.NewDecoder(r.Body).Decode(&msgs); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if h.maxItems > 0 && len(msgs) > h.maxItems {
+		http.Error(w, fmt.Sprintf("batch cannot contain more than %d messages", h.maxItems), http.StatusBadRequest)
+		return
+	}
+
+	results := h.broker.PublishBatch(msgs)
+	resp := make([]PublishResponse, len(results))
+
+	for i, result := range results {
+		resp[i] = newPublishResponse(result.ID, result.Err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// Stream handles a long-lived HTTP POST request that publishes messages as they are
+// read from the request body. The body is either newline-delimited JSON messages or,
+// if the 'Content-Type' header is 'text/event-stream', messages in the same format
+// they are delivered to subscribers. Each message is published to its 'channel'
+// field, or the channel in the URL if not set. An acknowledgement containing the
+// result of publishing each message is streamed back as newline-delimited JSON.
+// Messages that have already been read when the previous ones are acknowledged are
+// published together as a batch, of at most the handler's batch size. Only a few
+// messages are read ahead of those being published, so fast publishers are slowed
+// down to the rate the broker can accept messages.
+func (h *Handler) Stream(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+
+	if !ok {
+		http.Error(w, "client does not support streaming", http.StatusBadRequest)
+		return
+	}
+
+	channelID := mux.Vars(r)["channel"]
+
+	reqInfo := logrus.Fields{
+		"channel": channelID,
+		"host":    r.Host,
+	}
+
+	// Acknowledgements are written while the request body is still being read
+	if err := enableFullDuplex(w); err != nil {
+		h.log.WithError(err).WithFields(reqInfo).Warn("failed to enable full duplex")
+	}
+
+	var next func() (broker.Message, error)
+
+	if r.Header.Get("Content-Type") == "text/event-stream" {
+		next = newSSEDecoder(r.Body).Decode
+	} else {
+		dec := json.NewDecoder(r.Body)
+		next = func() (broker.Message, error) {
+			var msg broker.Message
+			err := dec.Decode(&msg)
+
+			return msg, err
+		}
+	}
+
+	h.log.WithFields(reqInfo).Info("new publisher stream")
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Cache-Control", "no-cache")
+
+	// Messages are read while earlier ones are being published, reading stops
+	// after the first error.
+	items := make(chan streamItem, streamReadAhead)
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		for {
+			msg, err := next()
+
+			if msg.Channel == "" {
+				msg.Channel = channelID
+			}
+
+			select {
+			case items <- streamItem{msg: msg, err: err}:
+			case <-done:
+				return
+			}
+
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	enc := json.NewEncoder(w)
+
+	for {
+		item := <-items
+		msgs, err := h.collect(items, item)
+
+		if len(msgs) > 0 {
+			for _, result := range h.broker.PublishBatch(msgs) {
+				if err := enc.Encode(newPublishResponse(result.ID, result.Err)); err != nil {
+					h.log.WithError(err).WithFields(reqInfo).Error("failed to write acknowledgement")
+					return
+				}
+			}
+		}
+
+		if err == io.EOF {
+			flusher.Flush()
+			h.log.WithFields(reqInfo).Info("publisher stream ended")
+			return
+		}
+
+		// The stream can't be recovered once it contains an invalid message, so
+		// acknowledge the error and stop reading.
+		if err != nil {
+			h.log.WithError(err).WithFields(reqInfo).Error("failed to read message")
+
+			enc.Encode(PublishResponse{Error: err.Error()})
+			flusher.Flush()
+
+			return
+		}
+
+		flusher.Flush()
+	}
+}
+
+// collect returns the given message read from a publisher stream along with any
+// others that have already been read, up to the handler's batch size. Any error
+// reading the stream is returned once the messages before it have been collected.
+func (h *Handler) collect(items <-chan streamItem, first streamItem) ([]broker.Message, error) {
+	if first.err != nil {
+		return nil, first.err
+	}
+
+	msgs := []broker.Message{first.msg}
+
+	for h.maxItems <= 0 || len(msgs) < h.maxItems {
+		select {
+		case item := <-items:
+			if item.err != nil {
+				return msgs, item.err
+			}
+
+			msgs = append(msgs, item.msg)
+		default:
+			return msgs, nil
+		}
+	}
+
+	return msgs, nil
+}
+
+// History handles an incoming HTTP GET request that returns the events published
+// to a channel as a JSON array. If the 'since' query parameter is provided, only
+// events published after the event with that identifier are returned. The 'limit'
+// query parameter caps the number of events returned to the most recent, up to
+// the broker's replay limit. Returns a 401 if the channel requires a token that
+// wasn't provided.
+func (h *Handler) History(w http.ResponseWriter, r *http.Request) {
+	channelID := mux.Vars(r)["channel"]
+	since := r.URL.Query().Get("since")
+
+	if err := h.broker.Authorize([]string{channelID}, token(r)); err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	var limit int
+	if value := r.URL.Query().Get("limit"); value != "" {
+		var err error
+		if limit, err = strconv.Atoi(value); err != nil || limit < 1 {
+			http.Error(w, fmt.Sprintf("invalid limit %s", value), http.StatusBadRequest)
+			return
+		}
+	}
+
+	msgs, err := h.broker.History(channelID, since, limit)
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if msgs == nil {
+		msgs = []broker.Message{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if err := json.NewEncoder(w).Encode(msgs); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// DeclareChannel handles an incoming HTTP PUT request that declares a channel with
+// the settings in the request body, replacing any it had before. The settings are
+// shared with every node and kept while the channel has no subscribers. The
+// response body contains the settings as declared, without the channel's token.
+// Returns a 400 if invalid JSON or settings have been provided.
+func (h *Handler) DeclareChannel(w http.ResponseWriter, r *http.Request) {
+	var cfg broker.ChannelConfig
+
+	if err := json.NewDecoder(r.Body).Decode(&cfg); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	cfg.ID = mux.Vars(r)["channel"]
+	cfg, err := h.broker.DeclareChannel(cfg)
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if err := json.NewEncoder(w).Encode(cfg); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// DescribeChannel handles an incoming HTTP GET request that returns the settings of
+// a declared channel, without its token. Returns a 404 if the channel hasn't been
+// declared.
+func (h *Handler) DescribeChannel(w http.ResponseWriter, r *http.Request) {
+	cfg, ok := h.broker.DescribeChannel(mux.Vars(r)["channel"])
+
+	if !ok {
+		http.Error(w, broker.ErrChannelNotFound.Error(), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if err := json.NewEncoder(w).Encode(cfg); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// DeleteChannel handles an incoming HTTP DELETE request that removes the settings of
+// a declared channel from every node. Its subscribers stay connected. Returns a 404
+// if the channel hasn't been declared.
+func (h *Handler) DeleteChannel(w http.ResponseWriter, r *http.Request) {
+	err := h.broker.DeleteChannel(mux.Vars(r)["channel"])
+
+	if err == broker.ErrChannelNotFound {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Clients handles an incoming HTTP GET request that returns the clients subscribed
+// to a channel across the cluster, including the node each client is connected to
+// and its metadata, along with the nodes that couldn't be reached. The 'max_age'
+// query parameter allows a cached result up to that old to be returned, e.g.
+// '?max_age=5s'. If the 'local' query parameter is 'true', only clients connected
+// to this node are returned. Returns a 401 if the channel requires a token that
+// wasn't provided.
+func (h *Handler) Clients(w http.ResponseWriter, r *http.Request) {
+	channelID := mux.Vars(r)["channel"]
+
+	if err := h.broker.Authorize([]string{channelID}, token(r)); err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	var clients *broker.ClientList
+
+	if r.URL.Query().Get("local") == "true" {
+		clients = &broker.ClientList{Clients: h.broker.LocalClients(channelID)}
+	} else {
+		var maxAge time.Duration
+
+		if value := r.URL.Query().Get("max_age"); value != "" {
+			var err error
+			if maxAge, err = time.ParseDuration(value); err != nil || maxAge < 0 {
+				http.Error(w, fmt.Sprintf("invalid max age %s", value), http.StatusBadRequest)
+				return
+			}
+		}
+
+		clients = h.broker.Clients(channelID, token(r), maxAge)
+	}
+
+	// Cached lookups are shared, so empty fields are filled in on a copy
+	resp := *clients
+
+	if resp.Clients == nil {
+		resp.Clients = []broker.Presence{}
+	}
+
+	if resp.Unreachable == nil {
+		resp.Unreachable = map[string]string{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
 }
 
 // Subscribe handles an incoming HTTP GET request and starts an event-stream with
 // the client. The connection remains open while events are read from the broker.
-// Events are written sequentially in 'text/event-stream' format. When the client
-// disconnects, they're removed from the broker.
+// Many channels can be subscribed to over a single stream by providing multiple
+// 'channel' query parameters, in which case each event's data is wrapped in an
+// object that also contains the channel it was published to. Event types can be
+// filtered using the 'event' query parameter, e.g. '?event=a,b' to receive only
+// 'a' and 'b' events or '?event=!c' to receive everything except 'c' events.
+// Events are written sequentially in 'text/event-stream' format. If the client
+// provides a 'Last-Event-ID' header, any buffered events published after that
+// identifier are written before live events. While the stream is idle, a heartbeat
+// comment is written periodically, the interval can be overridden using the
+// 'heartbeat' query parameter down to the handler's minimum, or disabled using
+// '?heartbeat=0'. Metadata describing the client for the presence API can be given
+// using query parameters prefixed with 'meta.', e.g. '?meta.name=alice'. Clients
+// with an identifier can use '?ack=true' to acknowledge the events they receive,
+// in which case events they haven't acknowledged are written again when they
+// reconnect and no more events are written while too many are unacknowledged.
+// Declared channels that require a token can only be subscribed to using a bearer
+// token in the 'Authorization' header or the 'token' query parameter, returns a 401
+// otherwise. Returns a 409 if a declared channel has too many clients.
+// When the client disconnects, a write to the stream fails, or the client is
+// disconnected by the broker for falling behind, they're removed from the broker.
 func (h *Handler) Subscribe(w http.ResponseWriter, r *http.Request) {
 	flusher, ok := w.(http.Flusher)
 
@@ -81,19 +701,53 @@ func (h *Handler) Subscribe(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	interval := h.heartbeat
+
+	if value := r.URL.Query().Get("heartbeat"); value != "" {
+		var err error
+
+		if interval, err = time.ParseDuration(value); err != nil || interval < 0 || (interval > 0 && interval < h.minBeat) {
+			http.Error(w, fmt.Sprintf("invalid heartbeat interval %s", value), http.StatusBadRequest)
+			return
+		}
+	}
+
 	vars := mux.Vars(r)
 
-	// Get the channel/client IDs from the url params
-	channelID := vars["channel"]
+	// Get the channel/client IDs from the url params, multiple channels can be
+	// provided using the 'channel' query parameter.
+	channelIDs := r.URL.Query()["channel"]
+	if channelID, ok := vars["channel"]; ok {
+		channelIDs = []string{channelID}
+	}
+
+	if len(channelIDs) == 0 {
+		http.Error(w, "at least one channel must be provided", http.StatusBadRequest)
+		return
+	}
+
+	acks := r.URL.Query().Get("ack") == "true"
 	clientID, ok := vars["client"]
 
+	if !ok && acks {
+		http.Error(w, "acknowledgements require a client identifier", http.StatusBadRequest)
+		return
+	}
+
 	if !ok {
 		clientID = xid.New().String()
 	}
 
+	if err := h.broker.Authorize(channelIDs, token(r)); err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	multi := len(channelIDs) > 1
+
 	reqInfo := logrus.Fields{
 		"client":  clientID,
-		"channel": channelID,
+		"channel": strings.Join(channelIDs, ","),
 		"host":    r.Host,
 	}
 
@@ -104,27 +758,181 @@ func (h *Handler) Subscribe(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Cache-Control", "no-cache")
 	w.Header().Set("Connection", "keep-alive")
 
-	client, err := h.broker.NewClient(channelID, clientID)
+	metadata := make(map[string]string)
+	for key, values := range r.URL.Query() {
+		if strings.HasPrefix(key, metadataPrefix) && len(values) > 0 {
+			metadata[strings.TrimPrefix(key, metadataPrefix)] = values[0]
+		}
+	}
+
+	opts := []broker.ClientOption{
+		broker.WithEventFilter(broker.ParseEventFilter(r.URL.Query()["event"]...)),
+		broker.WithMetadata(metadata),
+	}
+
+	if acks {
+		opts = append(opts, broker.WithAcks())
+	}
+
+	client, err := h.broker.NewClient(channelIDs, clientID, opts...)
+
+	if err == broker.ErrChannelFull {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
 
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
+	// disconnect removes the client once a write to the stream has failed. Events
+	// it didn't acknowledge are kept for when it reconnects.
+	disconnect := func(err error) {
+		h.broker.RemoveClient(channelIDs, clientID)
+		h.log.WithError(err).WithFields(reqInfo).Error("failed to write data, disconnecting subscriber")
+	}
+
+	// The client is registered before the history is read, so events published
+	// in-between may arrive both in the replay and live. Keep track of what was
+	// replayed so those aren't written twice.
+	replayed := make(map[string]bool)
+
+	// Events the client didn't acknowledge before it last disconnected are written
+	// first, they're still waiting to be acknowledged.
+	for _, msg := range client.Unacked() {
+		if _, err := w.Write(eventBytes(msg, multi)); err != nil {
+			disconnect(err)
+			return
+		}
+
+		replayed[msg.Channel+"/"+msg.ID] = true
+	}
+
+	if lastEventID := r.Header.Get("Last-Event-ID"); lastEventID != "" {
+		for _, msg := range h.broker.Replay(channelIDs, lastEventID) {
+			if !client.Accepts(msg) || replayed[msg.Channel+"/"+msg.ID] {
+				continue
+			}
+
+			client.Track(msg)
+
+			if _, err := w.Write(eventBytes(msg, multi)); err != nil {
+				disconnect(err)
+				return
+			}
+
+			if msg.ID != "" {
+				replayed[msg.Channel+"/"+msg.ID] = true
+			}
+		}
+	}
+
+	flusher.Flush()
+
+	var ticks <-chan time.Time
+
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		ticks = ticker.C
+	}
+
+	lastWrite := time.Now()
+
 	for {
 		select {
 		case msg := <-client.Messages():
-			if _, err := w.Write(msg.Bytes()); err != nil {
-				h.log.WithError(err).WithFields(reqInfo).Error("failed to write data")
+			if key := msg.Channel + "/" + msg.ID; replayed[key] {
+				delete(replayed, key)
+				continue
+			}
+
+			// Messages can expire while queued for slow clients
+			if msg.Expired() {
+				client.Untrack(msg)
+				h.broker.Expire(msg)
+				continue
+			}
+
+			if _, err := w.Write(eventBytes(msg, multi)); err != nil {
+				disconnect(err)
+				return
+			}
+
+			flusher.Flush()
+			lastWrite = time.Now()
+		case <-ticks:
+			// Skip the heartbeat if events have kept the stream alive recently
+			if time.Since(lastWrite) < interval {
 				continue
 			}
 
+			if _, err := w.Write(heartbeat); err != nil {
+				disconnect(err)
+				return
+			}
+
 			flusher.Flush()
+			lastWrite = time.Now()
+		case <-client.Done():
+			h.broker.RemoveClient(channelIDs, clientID)
+			h.log.WithFields(reqInfo).Warn("subscriber disconnected by broker")
+
+			return
 		case <-r.Context().Done():
-			h.broker.RemoveClient(channelID, clientID)
+			h.broker.RemoveClient(channelIDs, clientID)
 			h.log.WithFields(reqInfo).Info("subscriber disconnected")
 
 			return
 		}
 	}
 }
+
+// eventBytes returns the textual form of a message to write to an event stream. For
+// streams subscribed to many channels, the data is wrapped in an object that also
+// contains the channel the message was published to.
+func eventBytes(msg broker.Message, multi bool) []byte {
+	if !multi {
+		return msg.Bytes()
+	}
+
+	data, _ := json.Marshal(struct {
+		Channel string          `json:"channel"`
+		Data    json.RawMessage `json:"data,omitempty"`
+	}{
+		Channel: msg.Channel,
+		Data:    msg.Data,
+	})
+
+	msg.Data = data
+
+	return msg.Bytes()
+}
+
+// token returns the bearer token provided in the 'Authorization' header, or the
+// 'token' query parameter for clients such as browsers' EventSource that can't set
+// headers.
+func token(r *http.Request) string {
+	if header := r.Header.Get("Authorization"); strings.HasPrefix(header, "Bearer ") {
+		return strings.TrimPrefix(header, "Bearer ")
+	}
+
+	return r.URL.Query().Get("token")
+}
+
+// newPublishResponse creates the response for a single published message. Duplicate
+// messages are not treated as errors.
+func newPublishResponse(id string, err error) PublishResponse {
+	resp := PublishResponse{
+		ID:        id,
+		Duplicate: err == broker.ErrDuplicate,
+	}
+
+	if err != nil && err != broker.ErrDuplicate {
+		resp.Error = err.Error()
+	}
+
+	return resp
+}
@@ -4,6 +4,8 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
+	"io"
 	"net/http"
 	"net/http/httptest"
 	"testing"
@@ -54,28 +56,839 @@ func TestHandler_Status(t *testing.T) {
 	}
 }
 
+func TestHandler_ClusterStatus(t *testing.T) {
+	t.Parallel()
+	logrus.SetLevel(logrus.PanicLevel)
+
+	tt := []struct {
+		Name                string
+		ExpectedCode        int
+		ExpectedContentType string
+		ExpectationFunc     func(*mock.Mock)
+	}{
+		{
+			Name:                "It should get cluster status",
+			ExpectedCode:        http.StatusOK,
+			ExpectedContentType: "application/json",
+			ExpectationFunc: func(m *mock.Mock) {
+				m.On("ClusterStatus").Return(&broker.ClusterStatus{})
+			},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.Name, func(t *testing.T) {
+			m := &MockBroker{}
+			tc.ExpectationFunc(&m.Mock)
+
+			h := handler.New(m)
+			r := httptest.NewRequest("GET", "/cluster/status", nil)
+			w := httptest.NewRecorder()
+
+			h.ClusterStatus(w, r)
+
+			assert.Equal(t, tc.ExpectedCode, w.Code)
+			assert.Equal(t, tc.ExpectedContentType, w.Header().Get("Content-Type"))
+			m.AssertExpectations(t)
+		})
+	}
+}
+
+func TestHandler_DeadLetters(t *testing.T) {
+	t.Parallel()
+	logrus.SetLevel(logrus.PanicLevel)
+
+	tt := []struct {
+		Name                string
+		ExpectedCode        int
+		ExpectedContentType string
+		ExpectedBody        string
+		ExpectationFunc     func(*mock.Mock)
+	}{
+		{
+			Name:                "It should get dead letters",
+			ExpectedCode:        http.StatusOK,
+			ExpectedContentType: "application/json",
+			ExpectedBody:        `[{"node":"other","messages":[{"id":"1","event":"","retry":0,"been_to":null}],"reason":"node left the cluster","attempts":2,"at":"0001-01-01T00:00:00Z"}]`,
+			ExpectationFunc: func(m *mock.Mock) {
+				m.On("DeadLetters").Return([]broker.DeadLetter{
+					{
+						Node:     "other",
+						Messages: []broker.Message{{ID: "1"}},
+						Reason:   "node left the cluster",
+						Attempts: 2,
+					},
+				})
+			},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.Name, func(t *testing.T) {
+			m := &MockBroker{}
+			tc.ExpectationFunc(&m.Mock)
+
+			h := handler.New(m)
+			r := httptest.NewRequest("GET", "/dead-letters", nil)
+			w := httptest.NewRecorder()
+
+			h.DeadLetters(w, r)
+
+			assert.Equal(t, tc.ExpectedCode, w.Code)
+			assert.Equal(t, tc.ExpectedContentType, w.Header().Get("Content-Type"))
+			assert.JSONEq(t, tc.ExpectedBody, w.Body.String())
+			m.AssertExpectations(t)
+		})
+	}
+}
+
+func TestHandler_Ack(t *testing.T) {
+	t.Parallel()
+	logrus.SetLevel(logrus.PanicLevel)
+
+	tt := []struct {
+		Name            string
+		Body            string
+		ExpectedCode    int
+		ExpectedBody    string
+		ExpectationFunc func(*mock.Mock)
+	}{
+		{
+			Name:         "It should acknowledge events",
+			Body:         `{"ids":["1","2"]}`,
+			ExpectedCode: http.StatusOK,
+			ExpectedBody: `{"acknowledged":2}`,
+			ExpectationFunc: func(m *mock.Mock) {
+				m.On("Ack", "test", "client", []string{"1", "2"}).Return(2, nil)
+			},
+		},
+		{
+			Name:         "When no node holds events for the client, returns a 404",
+			Body:         `{"ids":["1"]}`,
+			ExpectedCode: http.StatusNotFound,
+			ExpectationFunc: func(m *mock.Mock) {
+				m.On("Ack", "test", "client", []string{"1"}).Return(0, broker.ErrClientNotFound)
+			},
+		},
+		{
+			Name:            "When invalid JSON is provided, returns a 400",
+			Body:            `{`,
+			ExpectedCode:    http.StatusBadRequest,
+			ExpectationFunc: func(m *mock.Mock) {},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.Name, func(t *testing.T) {
+			m := &MockBroker{}
+			tc.ExpectationFunc(&m.Mock)
+
+			h := handler.New(m)
+			r := httptest.NewRequest("POST", "/channel/test/client/client/ack", bytes.NewBufferString(tc.Body))
+			w := httptest.NewRecorder()
+
+			router := mux.NewRouter()
+			router.HandleFunc("/channel/{channel}/client/{client}/ack", h.Ack)
+			router.ServeHTTP(w, r)
+
+			assert.Equal(t, tc.ExpectedCode, w.Code)
+
+			if tc.ExpectedBody != "" {
+				assert.JSONEq(t, tc.ExpectedBody, w.Body.String())
+			}
+
+			m.AssertExpectations(t)
+		})
+	}
+}
+
+func TestHandler_Handover(t *testing.T) {
+	t.Parallel()
+	logrus.SetLevel(logrus.PanicLevel)
+
+	tt := []struct {
+		Name            string
+		ExpectedBody    string
+		ExpectationFunc func(*mock.Mock)
+	}{
+		{
+			Name:         "It should return the events held for the client",
+			ExpectedBody: `{"messages":[{"id":"1","event":"","retry":0,"channel":"test","been_to":null}]}`,
+			ExpectationFunc: func(m *mock.Mock) {
+				m.On("Handover", "client").Return([]broker.Message{{ID: "1", Channel: "test"}})
+			},
+		},
+		{
+			Name:         "When no events are held for the client, returns none",
+			ExpectedBody: `{"messages":null}`,
+			ExpectationFunc: func(m *mock.Mock) {
+				m.On("Handover", "client").Return(nil)
+			},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.Name, func(t *testing.T) {
+			m := &MockBroker{}
+			tc.ExpectationFunc(&m.Mock)
+
+			h := handler.New(m)
+			r := httptest.NewRequest("POST", "/client/client/handover", nil)
+			w := httptest.NewRecorder()
+
+			router := mux.NewRouter()
+			router.HandleFunc("/client/{client}/handover", h.Handover)
+			router.ServeHTTP(w, r)
+
+			assert.Equal(t, http.StatusOK, w.Code)
+			assert.JSONEq(t, tc.ExpectedBody, w.Body.String())
+
+			m.AssertExpectations(t)
+		})
+	}
+}
+
+func TestHandler_SubscribeAcks(t *testing.T) {
+	t.Parallel()
+	logrus.SetLevel(logrus.PanicLevel)
+
+	m := &MockBroker{clients: make(map[string]*broker.Client)}
+	h := handler.New(m)
+
+	r := httptest.NewRequest("GET", "/subscribe/test?ack=true", nil)
+	w := httptest.NewRecorder()
+
+	router := mux.NewRouter()
+	router.HandleFunc("/subscribe/{channel}", h.Subscribe)
+	router.ServeHTTP(w, r)
+
+	// Acknowledgements are held for a client identifier, which must be provided
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	m.AssertNotCalled(t, "NewClient", mock.Anything, mock.Anything)
+}
+
+func TestHandler_SubscribeDeclared(t *testing.T) {
+	t.Parallel()
+	logrus.SetLevel(logrus.PanicLevel)
+
+	tt := []struct {
+		Name            string
+		URL             string
+		Header          string
+		ExpectedCode    int
+		ExpectationFunc func(*mock.Mock)
+	}{
+		{
+			Name:         "When the token is missing, returns a 401",
+			URL:          "/subscribe/secret",
+			ExpectedCode: http.StatusUnauthorized,
+			ExpectationFunc: func(m *mock.Mock) {
+				m.On("Authorize", []string{"secret"}, "").Return(broker.ErrUnauthorized)
+			},
+		},
+		{
+			Name:         "It should read the token from the authorization header",
+			URL:          "/subscribe/secret",
+			Header:       "Bearer header",
+			ExpectedCode: http.StatusConflict,
+			ExpectationFunc: func(m *mock.Mock) {
+				m.On("Authorize", []string{"secret"}, "header").Return(nil)
+				m.On("NewClient", []string{"secret"}, mock.Anything).Return(nil, broker.ErrChannelFull)
+			},
+		},
+		{
+			Name:         "When the channel has too many clients, returns a 409",
+			URL:          "/subscribe/secret?token=query",
+			ExpectedCode: http.StatusConflict,
+			ExpectationFunc: func(m *mock.Mock) {
+				m.On("Authorize", []string{"secret"}, "query").Return(nil)
+				m.On("NewClient", []string{"secret"}, mock.Anything).Return(nil, broker.ErrChannelFull)
+			},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.Name, func(t *testing.T) {
+			m := &MockBroker{clients: make(map[string]*broker.Client)}
+			tc.ExpectationFunc(&m.Mock)
+
+			h := handler.New(m)
+
+			r := httptest.NewRequest("GET", tc.URL, nil)
+			if tc.Header != "" {
+				r.Header.Set("Authorization", tc.Header)
+			}
+
+			w := httptest.NewRecorder()
+
+			router := mux.NewRouter()
+			router.HandleFunc("/subscribe/{channel}", h.Subscribe)
+			router.ServeHTTP(w, r)
+
+			assert.Equal(t, tc.ExpectedCode, w.Code)
+			m.AssertExpectations(t)
+		})
+	}
+}
+
+func TestHandler_DeclareChannel(t *testing.T) {
+	t.Parallel()
+	logrus.SetLevel(logrus.PanicLevel)
+
+	tt := []struct {
+		Name            string
+		Body            string
+		ExpectedCode    int
+		ExpectedBody    string
+		ExpectationFunc func(*mock.Mock)
+	}{
+		{
+			Name:         "It should declare the channel in the URL",
+			Body:         `{"id": "other", "max_clients": 2, "token": "secret"}`,
+			ExpectedCode: http.StatusOK,
+			ExpectedBody: `{"id":"test","max_clients":2,"auth_required":true,"updated":"0001-01-01T00:00:00Z"}`,
+			ExpectationFunc: func(m *mock.Mock) {
+				m.On("DeclareChannel", broker.ChannelConfig{ID: "test", MaxClients: 2, Token: "secret"}).
+					Return(broker.ChannelConfig{ID: "test", MaxClients: 2, AuthRequired: true}, nil)
+			},
+		},
+		{
+			Name:            "When invalid JSON is provided, returns a 400",
+			Body:            `{`,
+			ExpectedCode:    http.StatusBadRequest,
+			ExpectationFunc: func(m *mock.Mock) {},
+		},
+		{
+			Name:         "When the settings are invalid, returns a 400",
+			Body:         `{"delivery": "unknown"}`,
+			ExpectedCode: http.StatusBadRequest,
+			ExpectationFunc: func(m *mock.Mock) {
+				m.On("DeclareChannel", broker.ChannelConfig{ID: "test", Delivery: "unknown"}).
+					Return(broker.ChannelConfig{}, errors.New("unknown delivery mode unknown"))
+			},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.Name, func(t *testing.T) {
+			m := &MockBroker{}
+			tc.ExpectationFunc(&m.Mock)
+
+			h := handler.New(m)
+			r := httptest.NewRequest("PUT", "/channels/test", bytes.NewBufferString(tc.Body))
+			w := httptest.NewRecorder()
+
+			router := mux.NewRouter()
+			router.HandleFunc("/channels/{channel}", h.DeclareChannel)
+			router.ServeHTTP(w, r)
+
+			assert.Equal(t, tc.ExpectedCode, w.Code)
+
+			if tc.ExpectedBody != "" {
+				assert.JSONEq(t, tc.ExpectedBody, w.Body.String())
+			}
+
+			m.AssertExpectations(t)
+		})
+	}
+}
+
+func TestHandler_DescribeChannel(t *testing.T) {
+	t.Parallel()
+	logrus.SetLevel(logrus.PanicLevel)
+
+	tt := []struct {
+		Name            string
+		ExpectedCode    int
+		ExpectedBody    string
+		ExpectationFunc func(*mock.Mock)
+	}{
+		{
+			Name:         "It should return the channel's settings",
+			ExpectedCode: http.StatusOK,
+			ExpectedBody: `{"id":"test","delivery":"queue","auth_required":false,"updated":"0001-01-01T00:00:00Z"}`,
+			ExpectationFunc: func(m *mock.Mock) {
+				m.On("DescribeChannel", "test").Return(broker.ChannelConfig{ID: "test", Delivery: broker.DeliveryQueue}, true)
+			},
+		},
+		{
+			Name:         "When the channel hasn't been declared, returns a 404",
+			ExpectedCode: http.StatusNotFound,
+			ExpectationFunc: func(m *mock.Mock) {
+				m.On("DescribeChannel", "test").Return(broker.ChannelConfig{}, false)
+			},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.Name, func(t *testing.T) {
+			m := &MockBroker{}
+			tc.ExpectationFunc(&m.Mock)
+
+			h := handler.New(m)
+			r := httptest.NewRequest("GET", "/channels/test", nil)
+			w := httptest.NewRecorder()
+
+			router := mux.NewRouter()
+			router.HandleFunc("/channels/{channel}", h.DescribeChannel)
+			router.ServeHTTP(w, r)
+
+			assert.Equal(t, tc.ExpectedCode, w.Code)
+
+			if tc.ExpectedBody != "" {
+				assert.JSONEq(t, tc.ExpectedBody, w.Body.String())
+			}
+
+			m.AssertExpectations(t)
+		})
+	}
+}
+
+func TestHandler_DeleteChannel(t *testing.T) {
+	t.Parallel()
+	logrus.SetLevel(logrus.PanicLevel)
+
+	tt := []struct {
+		Name            string
+		ExpectedCode    int
+		ExpectationFunc func(*mock.Mock)
+	}{
+		{
+			Name:         "It should delete the channel",
+			ExpectedCode: http.StatusNoContent,
+			ExpectationFunc: func(m *mock.Mock) {
+				m.On("DeleteChannel", "test").Return(nil)
+			},
+		},
+		{
+			Name:         "When the channel hasn't been declared, returns a 404",
+			ExpectedCode: http.StatusNotFound,
+			ExpectationFunc: func(m *mock.Mock) {
+				m.On("DeleteChannel", "test").Return(broker.ErrChannelNotFound)
+			},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.Name, func(t *testing.T) {
+			m := &MockBroker{}
+			tc.ExpectationFunc(&m.Mock)
+
+			h := handler.New(m)
+			r := httptest.NewRequest("DELETE", "/channels/test", nil)
+			w := httptest.NewRecorder()
+
+			router := mux.NewRouter()
+			router.HandleFunc("/channels/{channel}", h.DeleteChannel)
+			router.ServeHTTP(w, r)
+
+			assert.Equal(t, tc.ExpectedCode, w.Code)
+			m.AssertExpectations(t)
+		})
+	}
+}
+
 func TestHandler_Publish(t *testing.T) {
 	t.Parallel()
 	logrus.SetLevel(logrus.PanicLevel)
 
+	tt := []struct {
+		Name              string
+		Channel           string
+		Message           broker.Message
+		ExpectedCode      int
+		ExpectedID        string
+		ExpectedDuplicate bool
+		ExpectationFunc   func(*mock.Mock)
+	}{
+		{
+			Name:    "When message is published successfully, returns a 200",
+			Channel: "success",
+			Message: broker.Message{
+				ID:    "test",
+				Event: "test",
+				Data:  []byte("{}"),
+			},
+			ExpectedCode: http.StatusOK,
+			ExpectedID:   "test",
+			ExpectationFunc: func(m *mock.Mock) {
+				m.On("Publish", "success", mock.Anything, mock.Anything).Return("test", nil)
+			},
+		},
+		{
+			Name:    "When message is a duplicate, returns a 200",
+			Channel: "duplicate",
+			Message: broker.Message{
+				ID:    "test",
+				Event: "test",
+				Data:  []byte("{}"),
+			},
+			ExpectedCode:      http.StatusOK,
+			ExpectedID:        "test",
+			ExpectedDuplicate: true,
+			ExpectationFunc: func(m *mock.Mock) {
+				m.On("Publish", "duplicate", mock.Anything, mock.Anything).Return("test", broker.ErrDuplicate)
+			},
+		},
+		{
+			Name:    "When the client is not connected to any node, returns a 404",
+			Channel: "missing",
+			Message: broker.Message{
+				ID:    "test",
+				Event: "test",
+				Data:  []byte("{}"),
+			},
+			ExpectedCode: http.StatusNotFound,
+			ExpectationFunc: func(m *mock.Mock) {
+				m.On("Publish", "missing", mock.Anything, mock.Anything).Return("", broker.ErrClientNotFound)
+			},
+		},
+		{
+			Name:    "When publishing to a wildcard channel, returns a 400",
+			Channel: "orders.*",
+			Message: broker.Message{
+				ID:    "test",
+				Event: "test",
+				Data:  []byte("{}"),
+			},
+			ExpectedCode:    http.StatusBadRequest,
+			ExpectationFunc: func(m *mock.Mock) {},
+		},
+		{
+			Name:    "When the delay is negative, returns a 400",
+			Channel: "test",
+			Message: broker.Message{
+				ID:    "test",
+				Delay: -1,
+			},
+			ExpectedCode:    http.StatusBadRequest,
+			ExpectationFunc: func(m *mock.Mock) {},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.Name, func(t *testing.T) {
+			m := &MockBroker{clients: make(map[string]*broker.Client)}
+			h := handler.New(m)
+
+			tc.ExpectationFunc(&m.Mock)
+
+			body, _ := json.Marshal(tc.Message)
+			r := httptest.NewRequest("POST", "/publish/"+tc.Channel, bytes.NewBuffer(body))
+			w := httptest.NewRecorder()
+
+			router := mux.NewRouter()
+			router.HandleFunc("/publish/{channel}", h.Publish)
+
+			router.ServeHTTP(w, r)
+
+			assert.Equal(t, tc.ExpectedCode, w.Code)
+
+			if tc.ExpectedCode != http.StatusOK {
+				return
+			}
+
+			var resp handler.PublishResponse
+			if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+				assert.Fail(t, err.Error())
+				return
+			}
+
+			assert.Equal(t, tc.ExpectedID, resp.ID)
+			assert.Equal(t, tc.ExpectedDuplicate, resp.Duplicate)
+		})
+	}
+}
+
+func TestHandler_History(t *testing.T) {
+	t.Parallel()
+	logrus.SetLevel(logrus.PanicLevel)
+
+	tt := []struct {
+		Name             string
+		Channel          string
+		Since            string
+		Limit            string
+		ExpectedCode     int
+		ExpectedMessages []broker.Message
+		ExpectationFunc  func(*mock.Mock)
+	}{
+		{
+			Name:         "It should return channel history",
+			Channel:      "success",
+			Since:        "1",
+			ExpectedCode: http.StatusOK,
+			ExpectedMessages: []broker.Message{
+				{ID: "2", Data: []byte("{}")},
+			},
+			ExpectationFunc: func(m *mock.Mock) {
+				m.On("History", "success", "1", 0).Return([]broker.Message{
+					{ID: "2", Data: []byte("{}")},
+				}, nil)
+			},
+		},
+		{
+			Name:             "It should return an empty array for unknown channels",
+			Channel:          "unknown",
+			ExpectedCode:     http.StatusOK,
+			ExpectedMessages: []broker.Message{},
+			ExpectationFunc: func(m *mock.Mock) {
+				m.On("History", "unknown", "", 0).Return(nil, nil)
+			},
+		},
+		{
+			Name:         "It should pass the limit to the broker",
+			Channel:      "success",
+			Limit:        "1",
+			ExpectedCode: http.StatusOK,
+			ExpectedMessages: []broker.Message{
+				{ID: "2", Data: []byte("{}")},
+			},
+			ExpectationFunc: func(m *mock.Mock) {
+				m.On("History", "success", "", 1).Return([]broker.Message{
+					{ID: "2", Data: []byte("{}")},
+				}, nil)
+			},
+		},
+		{
+			Name:            "When the limit is invalid, returns a 400",
+			Channel:         "success",
+			Limit:           "0",
+			ExpectedCode:    http.StatusBadRequest,
+			ExpectationFunc: func(m *mock.Mock) {},
+		},
+		{
+			Name:         "When the channel requires a token, returns a 401",
+			Channel:      "secret",
+			ExpectedCode: http.StatusUnauthorized,
+			ExpectationFunc: func(m *mock.Mock) {
+				m.On("Authorize", []string{"secret"}, "").Return(broker.ErrUnauthorized)
+			},
+		},
+		{
+			Name:         "When the history cannot be read, returns a 500",
+			Channel:      "error",
+			ExpectedCode: http.StatusInternalServerError,
+			ExpectationFunc: func(m *mock.Mock) {
+				m.On("History", "error", "", 0).Return(nil, errors.New("error"))
+			},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.Name, func(t *testing.T) {
+			m := &MockBroker{}
+			h := handler.New(m)
+
+			tc.ExpectationFunc(&m.Mock)
+
+			url := "/history/" + tc.Channel + "?since=" + tc.Since
+			if tc.Limit != "" {
+				url += "&limit=" + tc.Limit
+			}
+
+			r := httptest.NewRequest("GET", url, nil)
+			w := httptest.NewRecorder()
+
+			router := mux.NewRouter()
+			router.HandleFunc("/history/{channel}", h.History)
+
+			router.ServeHTTP(w, r)
+
+			assert.Equal(t, tc.ExpectedCode, w.Code)
+
+			if tc.ExpectedCode != http.StatusOK {
+				return
+			}
+
+			var msgs []broker.Message
+			if err := json.NewDecoder(w.Body).Decode(&msgs); err != nil {
+				assert.Fail(t, err.Error())
+				return
+			}
+
+			assert.Equal(t, tc.ExpectedMessages, msgs)
+		})
+	}
+}
+
+func TestHandler_Clients(t *testing.T) {
+	t.Parallel()
+	logrus.SetLevel(logrus.PanicLevel)
+
+	clients := &broker.ClientList{
+		Clients: []broker.Presence{
+			{ID: "a", Node: "test", Channels: []string{"test"}},
+		},
+		Unreachable: map[string]string{
+			"other": "timeout",
+		},
+	}
+
+	tt := []struct {
+		Name            string
+		Query           string
+		Token           string
+		ExpectedCode    int
+		ExpectedClients *broker.ClientList
+		ExpectationFunc func(*mock.Mock)
+	}{
+		{
+			Name:            "It should return clients across the cluster",
+			ExpectedCode:    http.StatusOK,
+			ExpectedClients: clients,
+			ExpectationFunc: func(m *mock.Mock) {
+				m.On("Clients", "test", "", time.Duration(0)).Return(clients)
+			},
+		},
+		{
+			Name:            "It should allow cached clients",
+			Query:           "?max_age=5s",
+			ExpectedCode:    http.StatusOK,
+			ExpectedClients: clients,
+			ExpectationFunc: func(m *mock.Mock) {
+				m.On("Clients", "test", "", time.Second*5).Return(clients)
+			},
+		},
+		{
+			Name:         "It should return local clients",
+			Query:        "?local=true",
+			ExpectedCode: http.StatusOK,
+			ExpectedClients: &broker.ClientList{
+				Clients:     []broker.Presence{},
+				Unreachable: map[string]string{},
+			},
+			ExpectationFunc: func(m *mock.Mock) {
+				m.On("LocalClients", "test").Return(nil)
+			},
+		},
+		{
+			Name:            "It should pass the token on to other nodes",
+			Token:           "secret",
+			ExpectedCode:    http.StatusOK,
+			ExpectedClients: clients,
+			ExpectationFunc: func(m *mock.Mock) {
+				m.On("Authorize", []string{"test"}, "secret").Return(nil)
+				m.On("Clients", "test", "secret", time.Duration(0)).Return(clients)
+			},
+		},
+		{
+			Name:         "When the token is wrong, returns a 401",
+			Token:        "wrong",
+			ExpectedCode: http.StatusUnauthorized,
+			ExpectationFunc: func(m *mock.Mock) {
+				m.On("Authorize", []string{"test"}, "wrong").Return(broker.ErrUnauthorized)
+			},
+		},
+		{
+			Name:         "When the token is wrong for local clients, returns a 401",
+			Query:        "?local=true",
+			ExpectedCode: http.StatusUnauthorized,
+			ExpectationFunc: func(m *mock.Mock) {
+				m.On("Authorize", []string{"test"}, "").Return(broker.ErrUnauthorized)
+			},
+		},
+		{
+			Name:            "When the max age is invalid, returns a 400",
+			Query:           "?max_age=invalid",
+			ExpectedCode:    http.StatusBadRequest,
+			ExpectationFunc: func(m *mock.Mock) {},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.Name, func(t *testing.T) {
+			m := &MockBroker{}
+			h := handler.New(m)
+
+			tc.ExpectationFunc(&m.Mock)
+
+			r := httptest.NewRequest("GET", "/channel/test/clients"+tc.Query, nil)
+			w := httptest.NewRecorder()
+
+			if tc.Token != "" {
+				r.Header.Set("Authorization", "Bearer "+tc.Token)
+			}
+
+			router := mux.NewRouter()
+			router.HandleFunc("/channel/{channel}/clients", h.Clients)
+
+			router.ServeHTTP(w, r)
+
+			assert.Equal(t, tc.ExpectedCode, w.Code)
+			m.AssertExpectations(t)
+
+			if tc.ExpectedCode != http.StatusOK {
+				return
+			}
+
+			var actual *broker.ClientList
+			if err := json.NewDecoder(w.Body).Decode(&actual); err != nil {
+				assert.Fail(t, err.Error())
+				return
+			}
+
+			assert.Equal(t, tc.ExpectedClients, actual)
+		})
+	}
+}
+
+func TestHandler_Subscribe(t *testing.T) {
+	t.Parallel()
+	logrus.SetLevel(logrus.PanicLevel)
+
 	tt := []struct {
 		Name            string
 		Channel         string
+		LastEventID     string
 		Message         broker.Message
+		Replayed        []broker.Message
 		ExpectedCode    int
 		ExpectationFunc func(*mock.Mock)
 	}{
 		{
-			Name:    "When message is published successfully, returns a 200",
-			Channel: "success",
+			Name:         "When subscription is successful, writes a 200",
+			Channel:      "success",
+			ExpectedCode: http.StatusOK,
 			Message: broker.Message{
 				ID:    "test",
 				Event: "test",
 				Data:  []byte("{}"),
 			},
+			ExpectationFunc: func(m *mock.Mock) {
+				m.On("NewClient", []string{"success"}, mock.Anything).Return(nil, nil)
+				m.On("Publish", "success", mock.Anything, mock.Anything).Return("", nil)
+				m.On("RemoveClient", []string{"success"}, mock.Anything).Return(nil)
+			},
+		},
+		{
+			Name:         "When a last event id is provided, replays missed events",
+			Channel:      "replay",
+			LastEventID:  "1",
 			ExpectedCode: http.StatusOK,
+			Message: broker.Message{
+				ID:    "3",
+				Event: "test",
+				Data:  []byte("{}"),
+			},
+			Replayed: []broker.Message{
+				{
+					ID:    "2",
+					Event: "test",
+					Data:  []byte("{}"),
+				},
+			},
 			ExpectationFunc: func(m *mock.Mock) {
-				m.On("Publish", "success", mock.Anything, mock.Anything).Return(nil)
+				m.On("NewClient", []string{"replay"}, mock.Anything).Return(nil, nil)
+				m.On("Replay", []string{"replay"}, "1").Return([]broker.Message{
+					{
+						ID:    "2",
+						Event: "test",
+						Data:  []byte("{}"),
+					},
+				})
+				m.On("Publish", "replay", mock.Anything, mock.Anything).Return("", nil)
+				m.On("RemoveClient", []string{"replay"}, mock.Anything).Return(nil)
 			},
 		},
 	}
@@ -87,76 +900,563 @@ func TestHandler_Publish(t *testing.T) {
 
 			tc.ExpectationFunc(&m.Mock)
 
-			body, _ := json.Marshal(tc.Message)
-			r := httptest.NewRequest("POST", "/publish/"+tc.Channel, bytes.NewBuffer(body))
+			r := httptest.NewRequest("GET", "/subscribe/"+tc.Channel, nil)
 			w := httptest.NewRecorder()
 
+			if tc.LastEventID != "" {
+				r.Header.Set("Last-Event-ID", tc.LastEventID)
+			}
+
 			router := mux.NewRouter()
-			router.HandleFunc("/publish/{channel}", h.Publish)
+			router.HandleFunc("/subscribe/{channel}", h.Subscribe)
 
-			router.ServeHTTP(w, r)
+			ctx, cancel := context.WithCancel(r.Context())
+			done := make(chan struct{})
+
+			go func() {
+				router.ServeHTTP(w, r.WithContext(ctx))
+				close(done)
+			}()
+
+			<-time.After(time.Millisecond * 100)
+
+			if _, err := m.Publish(tc.Channel, "", tc.Message); err != nil {
+				assert.Fail(t, err.Error())
+			}
+
+			<-time.After(time.Millisecond * 100)
+			cancel()
+			<-done
+
+			var expected []byte
+			for _, msg := range tc.Replayed {
+				expected = append(expected, msg.Bytes()...)
+			}
+
+			expected = append(expected, tc.Message.Bytes()...)
 
 			assert.Equal(t, tc.ExpectedCode, w.Code)
+			assert.Equal(t, expected, w.Body.Bytes())
 		})
 	}
 }
 
-func TestHandler_Subscribe(t *testing.T) {
+func TestHandler_Heartbeat(t *testing.T) {
 	t.Parallel()
 	logrus.SetLevel(logrus.PanicLevel)
 
 	tt := []struct {
-		Name            string
-		Channel         string
-		Message         broker.Message
-		ExpectedCode    int
-		ExpectationFunc func(*mock.Mock)
+		Name          string
+		Interval      time.Duration
+		Query         string
+		ExpectedCode  int
+		ExpectedPings bool
 	}{
 		{
-			Name:         "When subscription is successful, writes a 200",
-			Channel:      "success",
+			Name:          "It should write heartbeats to idle streams",
+			Interval:      time.Millisecond * 20,
+			ExpectedCode:  http.StatusOK,
+			ExpectedPings: true,
+		},
+		{
+			Name:          "It should allow the interval to be overridden",
+			Query:         "?heartbeat=20ms",
+			ExpectedCode:  http.StatusOK,
+			ExpectedPings: true,
+		},
+		{
+			Name:         "When the interval is below the minimum, returns a 400",
+			Query:        "?heartbeat=1ms",
+			ExpectedCode: http.StatusBadRequest,
+		},
+		{
+			Name:         "It should allow heartbeats to be disabled",
+			Interval:     time.Millisecond * 20,
+			Query:        "?heartbeat=0",
+			ExpectedCode: http.StatusOK,
+		},
+		{
+			Name:         "When the interval is invalid, returns a 400",
+			Query:        "?heartbeat=invalid",
+			ExpectedCode: http.StatusBadRequest,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.Name, func(t *testing.T) {
+			m := &MockBroker{clients: make(map[string]*broker.Client)}
+			m.On("NewClient", []string{"heartbeat"}, mock.Anything).Return(nil, nil)
+			m.On("RemoveClient", []string{"heartbeat"}, mock.Anything).Return(nil)
+
+			h := handler.New(m,
+				handler.WithHeartbeatInterval(tc.Interval),
+				handler.WithMinHeartbeatInterval(time.Millisecond*10),
+			)
+
+			r := httptest.NewRequest("GET", "/subscribe/heartbeat"+tc.Query, nil)
+			w := httptest.NewRecorder()
+
+			router := mux.NewRouter()
+			router.HandleFunc("/subscribe/{channel}", h.Subscribe)
+
+			ctx, cancel := context.WithCancel(r.Context())
+			done := make(chan struct{})
+
+			go func() {
+				router.ServeHTTP(w, r.WithContext(ctx))
+				close(done)
+			}()
+
+			<-time.After(time.Millisecond * 100)
+			cancel()
+			<-done
+
+			assert.Equal(t, tc.ExpectedCode, w.Code)
+
+			if tc.ExpectedCode != http.StatusOK {
+				return
+			}
+
+			assert.Equal(t, tc.ExpectedPings, bytes.Contains(w.Body.Bytes(), []byte(": ping\n\n")))
+		})
+	}
+}
+
+func TestHandler_SubscribeMultipleChannels(t *testing.T) {
+	t.Parallel()
+	logrus.SetLevel(logrus.PanicLevel)
+
+	tt := []struct {
+		Name         string
+		Query        string
+		Channels     []string
+		Message      broker.Message
+		ExpectedCode int
+		ExpectedBody []byte
+	}{
+		{
+			Name:         "It should write events wrapped with their channel",
+			Query:        "?channel=a&channel=b",
+			Channels:     []string{"a", "b"},
 			ExpectedCode: http.StatusOK,
 			Message: broker.Message{
-				ID:    "test",
-				Event: "test",
-				Data:  []byte("{}"),
-			},
-			ExpectationFunc: func(m *mock.Mock) {
-				m.On("NewClient", "success", mock.Anything).Return(nil, nil)
-				m.On("Publish", "success", mock.Anything, mock.Anything).Return(nil)
-				m.On("RemoveClient", "success", mock.Anything).Return(nil)
+				ID:      "test",
+				Channel: "b",
+				Data:    []byte(`{"key":"value"}`),
 			},
+			ExpectedBody: []byte("id: test\ndata: {\"channel\":\"b\",\"data\":{\"key\":\"value\"}}\n\n"),
+		},
+		{
+			Name:         "When no channel is provided, returns a 400",
+			ExpectedCode: http.StatusBadRequest,
 		},
 	}
 
 	for _, tc := range tt {
 		t.Run(tc.Name, func(t *testing.T) {
 			m := &MockBroker{clients: make(map[string]*broker.Client)}
-			h := handler.New(m)
+			m.On("NewClient", tc.Channels, mock.Anything).Return(nil, nil)
+			m.On("Publish", mock.Anything, mock.Anything, mock.Anything).Return("", nil)
+			m.On("RemoveClient", tc.Channels, mock.Anything).Return(nil)
 
-			tc.ExpectationFunc(&m.Mock)
+			h := handler.New(m)
 
-			r := httptest.NewRequest("GET", "/subscribe/"+tc.Channel, nil)
+			r := httptest.NewRequest("GET", "/subscribe"+tc.Query, nil)
 			w := httptest.NewRecorder()
 
 			router := mux.NewRouter()
-			router.HandleFunc("/subscribe/{channel}", h.Subscribe)
+			router.HandleFunc("/subscribe", h.Subscribe)
 
 			ctx, cancel := context.WithCancel(r.Context())
-			go router.ServeHTTP(w, r.WithContext(ctx))
+			done := make(chan struct{})
+
+			go func() {
+				router.ServeHTTP(w, r.WithContext(ctx))
+				close(done)
+			}()
 
 			<-time.After(time.Millisecond * 100)
 
-			if err := m.Publish(tc.Channel, "", tc.Message); err != nil {
-				assert.Fail(t, err.Error())
+			if tc.Message.Channel != "" {
+				if _, err := m.Publish(tc.Message.Channel, "", tc.Message); err != nil {
+					assert.Fail(t, err.Error())
+				}
 			}
 
 			<-time.After(time.Millisecond * 100)
 			cancel()
-			<-time.After(time.Millisecond * 100)
+			<-done
+
+			assert.Equal(t, tc.ExpectedCode, w.Code)
+
+			if tc.ExpectedCode == http.StatusOK {
+				assert.Equal(t, tc.ExpectedBody, w.Body.Bytes())
+			}
+		})
+	}
+}
+
+func TestHandler_Dedup(t *testing.T) {
+	t.Parallel()
+	logrus.SetLevel(logrus.PanicLevel)
+
+	tt := []struct {
+		Name             string
+		Body             string
+		ExpectedCode     int
+		ExpectedResponse []broker.DedupResponse
+		ExpectationFunc  func(*mock.Mock)
+	}{
+		{
+			Name:         "It should check each key",
+			Body:         `[{"key":"a/b/c","id":"2"},{"key":"a/b/d","id":"3"}]`,
+			ExpectedCode: http.StatusOK,
+			ExpectedResponse: []broker.DedupResponse{
+				{ID: "1", Duplicate: true},
+				{ID: "3"},
+			},
+			ExpectationFunc: func(m *mock.Mock) {
+				m.On("CheckDuplicate", "a/b/c", "2").Return("1", true)
+				m.On("CheckDuplicate", "a/b/d", "3").Return("3", false)
+			},
+		},
+		{
+			Name:             "It should release a key",
+			Body:             `[{"key":"a/b/c","release":true}]`,
+			ExpectedCode:     http.StatusOK,
+			ExpectedResponse: []broker.DedupResponse{{}},
+			ExpectationFunc: func(m *mock.Mock) {
+				m.On("ReleaseDuplicate", "a/b/c").Return()
+			},
+		},
+		{
+			Name:            "When the body is invalid, returns a 400",
+			Body:            `{`,
+			ExpectedCode:    http.StatusBadRequest,
+			ExpectationFunc: func(m *mock.Mock) {},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.Name, func(t *testing.T) {
+			m := &MockBroker{}
+			h := handler.New(m)
+
+			tc.ExpectationFunc(&m.Mock)
+
+			r := httptest.NewRequest("POST", "/dedup", bytes.NewBufferString(tc.Body))
+			w := httptest.NewRecorder()
+
+			h.Dedup(w, r)
+
+			assert.Equal(t, tc.ExpectedCode, w.Code)
+			m.AssertExpectations(t)
+
+			if tc.ExpectedCode != http.StatusOK {
+				return
+			}
+
+			var resp []broker.DedupResponse
+			if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+				assert.Fail(t, err.Error())
+				return
+			}
+
+			assert.Equal(t, tc.ExpectedResponse, resp)
+		})
+	}
+}
+
+func TestHandler_Batch(t *testing.T) {
+	t.Parallel()
+	logrus.SetLevel(logrus.PanicLevel)
+
+	msgs := []broker.Message{
+		{ID: "1", Channel: "a"},
+		{ID: "2", Channel: "b", Client: "test"},
+	}
+
+	tt := []struct {
+		Name             string
+		ContentType      string
+		Body             string
+		ExpectedCode     int
+		Options          []handler.Option
+		ExpectedResponse []handler.PublishResponse
+		ExpectationFunc  func(*mock.Mock)
+	}{
+		{
+			Name:         "It should publish a JSON array of messages",
+			ContentType:  "application/json",
+			Body:         `[{"id":"1","channel":"a"},{"id":"2","channel":"b","client":"test"}]`,
+			ExpectedCode: http.StatusOK,
+			ExpectedResponse: []handler.PublishResponse{
+				{ID: "1"},
+				{ID: "2", Duplicate: true},
+			},
+			ExpectationFunc: func(m *mock.Mock) {
+				m.On("PublishBatch", msgs).Return([]broker.BatchResult{
+					{ID: "1"},
+					{ID: "2", Err: broker.ErrDuplicate},
+				})
+			},
+		},
+		{
+			Name:         "It should publish newline-delimited messages",
+			ContentType:  "application/x-ndjson",
+			Body:         "{\"id\":\"1\",\"channel\":\"a\"}\n{\"id\":\"2\",\"channel\":\"b\",\"client\":\"test\"}\n",
+			ExpectedCode: http.StatusOK,
+			ExpectedResponse: []handler.PublishResponse{
+				{ID: "1"},
+				{ID: "2", Error: "error"},
+			},
+			ExpectationFunc: func(m *mock.Mock) {
+				m.On("PublishBatch", msgs).Return([]broker.BatchResult{
+					{ID: "1"},
+					{ID: "2", Err: errors.New("error")},
+				})
+			},
+		},
+		{
+			Name:            "When the body is invalid, returns a 400",
+			ContentType:     "application/x-ndjson",
+			Body:            "{\"id\":\"1\"}\n{",
+			ExpectedCode:    http.StatusBadRequest,
+			ExpectationFunc: func(m *mock.Mock) {},
+		},
+		{
+			Name:            "When the batch contains too many messages, returns a 400",
+			ContentType:     "application/json",
+			Body:            `[{"id":"1","channel":"a"},{"id":"2","channel":"b","client":"test"}]`,
+			Options:         []handler.Option{handler.WithMaxBatchSize(1)},
+			ExpectedCode:    http.StatusBadRequest,
+			ExpectationFunc: func(m *mock.Mock) {},
+		},
+		{
+			Name:            "When the body is too large, returns a 400",
+			ContentType:     "application/x-ndjson",
+			Body:            "{\"id\":\"1\",\"channel\":\"a\"}\n{\"id\":\"2\",\"channel\":\"b\",\"client\":\"test\"}\n",
+			Options:         []handler.Option{handler.WithMaxBatchBytes(10)},
+			ExpectedCode:    http.StatusBadRequest,
+			ExpectationFunc: func(m *mock.Mock) {},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.Name, func(t *testing.T) {
+			m := &MockBroker{}
+			h := handler.New(m, tc.Options...)
+
+			tc.ExpectationFunc(&m.Mock)
+
+			r := httptest.NewRequest("POST", "/batch", bytes.NewBufferString(tc.Body))
+			r.Header.Set("Content-Type", tc.ContentType)
+			w := httptest.NewRecorder()
+
+			h.Batch(w, r)
 
 			assert.Equal(t, tc.ExpectedCode, w.Code)
-			assert.Equal(t, tc.Message.Bytes(), w.Body.Bytes())
+
+			if tc.ExpectedCode != http.StatusOK {
+				return
+			}
+
+			var resp []handler.PublishResponse
+			if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+				assert.Fail(t, err.Error())
+				return
+			}
+
+			assert.Equal(t, tc.ExpectedResponse, resp)
+		})
+	}
+}
+
+func TestHandler_Stream(t *testing.T) {
+	t.Parallel()
+	logrus.SetLevel(logrus.PanicLevel)
+
+	tt := []struct {
+		Name             string
+		ContentType      string
+		Body             string
+		Errors           map[string]error
+		ExpectedMessages []broker.Message
+		ExpectedResponse []handler.PublishResponse
+	}{
+		{
+			Name:        "It should publish newline-delimited messages",
+			ContentType: "application/x-ndjson",
+			Body:        "{\"id\":\"1\"}\n{\"id\":\"2\",\"channel\":\"other\",\"client\":\"test\"}\n",
+			Errors: map[string]error{
+				"2": broker.ErrDuplicate,
+			},
+			ExpectedMessages: []broker.Message{
+				{ID: "1", Channel: "stream"},
+				{ID: "2", Channel: "other", Client: "test"},
+			},
+			ExpectedResponse: []handler.PublishResponse{
+				{ID: "1"},
+				{ID: "2", Duplicate: true},
+			},
+		},
+		{
+			Name:        "It should publish event stream messages",
+			ContentType: "text/event-stream",
+			Body:        ": comment\nid: 1\nevent: test\ndata: {\"a\":\ndata: 1}\n\nid: 2\ndata: text\nretry: 10\n",
+			ExpectedMessages: []broker.Message{
+				{
+					ID:      "1",
+					Event:   "test",
+					Channel: "stream",
+					Data:    []byte("{\"a\":\n1}"),
+				},
+				{
+					ID:      "2",
+					Channel: "stream",
+					Retry:   10,
+					Data:    []byte("\"text\""),
+				},
+			},
+			ExpectedResponse: []handler.PublishResponse{
+				{ID: "1"},
+				{ID: "2"},
+			},
+		},
+		{
+			Name:        "It should acknowledge invalid messages and stop reading",
+			ContentType: "application/x-ndjson",
+			Body:        "{\"id\":\"1\"}\n{\n{\"id\":\"3\"}\n",
+			ExpectedMessages: []broker.Message{
+				{ID: "1", Channel: "stream"},
+			},
+			ExpectedResponse: []handler.PublishResponse{
+				{ID: "1"},
+				{Error: "invalid character '{' looking for beginning of object key string"},
+			},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.Name, func(t *testing.T) {
+			m := &MockBroker{}
+			h := handler.New(m)
+
+			// Messages may be published in batches of any size, depending on how
+			// many had been read at the time.
+			var published []broker.Message
+			m.On("PublishBatch", mock.Anything).Return(func(msgs []broker.Message) []broker.BatchResult {
+				published = append(published, msgs...)
+
+				results := make([]broker.BatchResult, len(msgs))
+				for i, msg := range msgs {
+					results[i] = broker.BatchResult{ID: msg.ID, Err: tc.Errors[msg.ID]}
+				}
+
+				return results
+			})
+
+			r := httptest.NewRequest("POST", "/stream/stream", bytes.NewBufferString(tc.Body))
+			r.Header.Set("Content-Type", tc.ContentType)
+			w := httptest.NewRecorder()
+
+			router := mux.NewRouter()
+			router.HandleFunc("/stream/{channel}", h.Stream)
+
+			router.ServeHTTP(w, r)
+
+			var resp []handler.PublishResponse
+			dec := json.NewDecoder(w.Body)
+
+			for dec.More() {
+				var ack handler.PublishResponse
+				if err := dec.Decode(&ack); err != nil {
+					assert.Fail(t, err.Error())
+					return
+				}
+
+				resp = append(resp, ack)
+			}
+
+			assert.Equal(t, http.StatusOK, w.Code)
+			assert.Equal(t, "application/x-ndjson", w.Header().Get("Content-Type"))
+			assert.Equal(t, tc.ExpectedMessages, published)
+			assert.Equal(t, tc.ExpectedResponse, resp)
 		})
 	}
 }
+
+func TestHandler_StreamAcknowledgesIncrementally(t *testing.T) {
+	t.Parallel()
+	logrus.SetLevel(logrus.PanicLevel)
+
+	m := &MockBroker{}
+	m.On("PublishBatch", mock.Anything).Return(func(msgs []broker.Message) []broker.BatchResult {
+		results := make([]broker.BatchResult, len(msgs))
+		for i := range msgs {
+			results[i] = broker.BatchResult{ID: "test"}
+		}
+
+		return results
+	})
+
+	h := handler.New(m)
+
+	router := mux.NewRouter()
+	router.HandleFunc("/stream/{channel}", h.Stream)
+
+	svr := httptest.NewServer(router)
+	defer svr.Close()
+
+	pr, pw := io.Pipe()
+	defer pw.Close()
+
+	req, _ := http.NewRequest("POST", svr.URL+"/stream/stream", pr)
+	req.Header.Set("Content-Type", "application/x-ndjson")
+
+	// Writes to the pipe block until the request is being sent, so the request
+	// is started before the first message is written.
+	type result struct {
+		resp *http.Response
+		err  error
+	}
+
+	results := make(chan result, 1)
+	go func() {
+		resp, err := http.DefaultClient.Do(req)
+		results <- result{resp: resp, err: err}
+	}()
+
+	if _, err := pw.Write([]byte("{\"id\":\"1\"}\n")); err != nil {
+		assert.Fail(t, err.Error())
+		return
+	}
+
+	res := <-results
+
+	if res.err != nil {
+		assert.Fail(t, res.err.Error())
+		return
+	}
+
+	resp := res.resp
+	defer resp.Body.Close()
+
+	dec := json.NewDecoder(resp.Body)
+
+	// Each acknowledgement should be received before the next message is sent
+	for i := 0; i < 3; i++ {
+		var ack handler.PublishResponse
+		if err := dec.Decode(&ack); err != nil {
+			assert.Fail(t, err.Error())
+			return
+		}
+
+		assert.Equal(t, "test", ack.ID)
+
+		if _, err := pw.Write([]byte("{\"id\":\"1\"}\n")); err != nil {
+			assert.Fail(t, err.Error())
+			return
+		}
+	}
+}
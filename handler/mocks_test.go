@@ -1,6 +1,9 @@
 package handler_test
 
 import (
+	"sync"
+	"time"
+
 	"github.com/davidsbond/sse-cluster/broker"
 	"github.com/stretchr/testify/mock"
 )
@@ -9,6 +12,7 @@ type (
 	MockBroker struct {
 		mock.Mock
 
+		mux     sync.Mutex
 		clients map[string]*broker.Client
 	}
 )
@@ -23,27 +27,170 @@ func (m *MockBroker) Status() *broker.Status {
 	return nil
 }
 
-func (m *MockBroker) Publish(channel, client string, msg broker.Message) error {
-	if cl, ok := m.clients[channel]; ok {
+func (m *MockBroker) ClusterStatus() *broker.ClusterStatus {
+	args := m.Called()
+
+	if args.Get(0) != nil {
+		return args.Get(0).(*broker.ClusterStatus)
+	}
+
+	return nil
+}
+
+func (m *MockBroker) DeadLetters() []broker.DeadLetter {
+	args := m.Called()
+
+	if args.Get(0) != nil {
+		return args.Get(0).([]broker.DeadLetter)
+	}
+
+	return nil
+}
+
+func (m *MockBroker) Ack(channel, client string, ids []string) (int, error) {
+	args := m.Called(channel, client, ids)
+	return args.Int(0), args.Error(1)
+}
+
+func (m *MockBroker) Handover(client string) []broker.Message {
+	args := m.Called(client)
+
+	if args.Get(0) != nil {
+		return args.Get(0).([]broker.Message)
+	}
+
+	return nil
+}
+
+func (m *MockBroker) Publish(channel, client string, msg broker.Message) (string, error) {
+	m.mux.Lock()
+	cl, ok := m.clients[channel]
+	m.mux.Unlock()
+
+	if ok && cl.Accepts(msg) {
 		cl.Write(msg)
 	}
 
 	args := m.Called(channel, client, msg)
 
-	return args.Error(0)
+	return args.String(0), args.Error(1)
 }
 
-func (m *MockBroker) NewClient(channel string, clientID string) (*broker.Client, error) {
-	args := m.Called(channel, clientID)
+func (m *MockBroker) NewClient(channels []string, clientID string, opts ...broker.ClientOption) (*broker.Client, error) {
+	args := m.Called(channels, clientID)
 
-	cl := broker.NewClient(clientID)
-	m.clients[channel] = cl
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	cl := broker.NewClient(clientID, opts...)
+	for _, channel := range channels {
+		m.clients[channel] = cl
+	}
 
 	return cl, args.Error(1)
 }
 
-func (m *MockBroker) RemoveClient(channel string, client string) {
-	delete(m.clients, channel)
+func (m *MockBroker) RemoveClient(channels []string, client string) {
+	m.mux.Lock()
+	for _, channel := range channels {
+		delete(m.clients, channel)
+	}
+	m.mux.Unlock()
+
+	m.Called(channels, client)
+}
+
+func (m *MockBroker) Replay(channels []string, lastEventID string) []broker.Message {
+	args := m.Called(channels, lastEventID)
+
+	if args.Get(0) != nil {
+		return args.Get(0).([]broker.Message)
+	}
+
+	return nil
+}
+
+func (m *MockBroker) History(channel, since string, limit int) ([]broker.Message, error) {
+	args := m.Called(channel, since, limit)
+
+	if args.Get(0) != nil {
+		return args.Get(0).([]broker.Message), args.Error(1)
+	}
+
+	return nil, args.Error(1)
+}
+
+func (m *MockBroker) Expire(msg broker.Message) {
+	m.Called(msg)
+}
+
+func (m *MockBroker) CheckDuplicate(key, id string) (string, bool) {
+	args := m.Called(key, id)
+
+	return args.String(0), args.Bool(1)
+}
+
+func (m *MockBroker) ReleaseDuplicate(key string) {
+	m.Called(key)
+}
+
+func (m *MockBroker) Clients(channel, token string, maxAge time.Duration) *broker.ClientList {
+	args := m.Called(channel, token, maxAge)
 
-	m.Called(channel, client)
+	if args.Get(0) != nil {
+		return args.Get(0).(*broker.ClientList)
+	}
+
+	return nil
+}
+
+func (m *MockBroker) LocalClients(channel string) []broker.Presence {
+	args := m.Called(channel)
+
+	if args.Get(0) != nil {
+		return args.Get(0).([]broker.Presence)
+	}
+
+	return nil
+}
+
+func (m *MockBroker) PublishBatch(msgs []broker.Message) []broker.BatchResult {
+	args := m.Called(msgs)
+
+	// Batches of varying sizes can be handled by returning a function
+	if fn, ok := args.Get(0).(func([]broker.Message) []broker.BatchResult); ok {
+		return fn(msgs)
+	}
+
+	if args.Get(0) != nil {
+		return args.Get(0).([]broker.BatchResult)
+	}
+
+	return nil
+}
+
+func (m *MockBroker) DeclareChannel(cfg broker.ChannelConfig) (broker.ChannelConfig, error) {
+	args := m.Called(cfg)
+	return args.Get(0).(broker.ChannelConfig), args.Error(1)
+}
+
+func (m *MockBroker) DescribeChannel(channel string) (broker.ChannelConfig, bool) {
+	args := m.Called(channel)
+	return args.Get(0).(broker.ChannelConfig), args.Bool(1)
+}
+
+func (m *MockBroker) DeleteChannel(channel string) error {
+	args := m.Called(channel)
+	return args.Error(0)
+}
+
+// Authorize allows every subscription unless the test expects it to be called.
+func (m *MockBroker) Authorize(channels []string, token string) error {
+	for _, call := range m.ExpectedCalls {
+		if call.Method == "Authorize" {
+			return m.Called(channels, token).Error(0)
+		}
+	}
+
+	return nil
 }
@@ -0,0 +1,108 @@
+package handler
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/davidsbond/sse-cluster/broker"
+)
+
+type (
+	// The sseDecoder type reads messages from an 'text/event-stream' formatted
+	// stream. In addition to the standard fields, the 'channel' and 'client'
+	// fields can be used to specify where each message is published.
+	sseDecoder struct {
+		scanner *bufio.Scanner
+	}
+)
+
+// The maximum length of a single line in an 'text/event-stream' formatted stream.
+const maxSSELineSize = 1024 * 1024
+
+func newSSEDecoder(r io.Reader) *sseDecoder {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, maxSSELineSize)
+
+	return &sseDecoder{scanner: scanner}
+}
+
+// Decode reads the next message from the stream. Messages are terminated by a blank
+// line and multiple 'data' fields are joined with newlines. If the data is not valid
+// JSON, it is encoded as a JSON string. Returns io.EOF once the stream has ended.
+func (d *sseDecoder) Decode() (broker.Message, error) {
+	var msg broker.Message
+	var data []string
+
+	fields := 0
+	for d.scanner.Scan() {
+		line := d.scanner.Text()
+
+		switch {
+		// A blank line dispatches the event, if it has any fields
+		case line == "":
+			if fields > 0 {
+				return withData(msg, data), nil
+			}
+
+			continue
+		// Lines starting with a colon are comments
+		case strings.HasPrefix(line, ":"):
+			continue
+		}
+
+		field, value := line, ""
+		if i := strings.IndexByte(line, ':'); i >= 0 {
+			field = line[:i]
+			value = strings.TrimPrefix(line[i+1:], " ")
+		}
+
+		fields++
+
+		switch field {
+		case "id":
+			msg.ID = value
+		case "event":
+			msg.Event = value
+		case "data":
+			data = append(data, value)
+		case "retry":
+			if retry, err := strconv.Atoi(value); err == nil {
+				msg.Retry = retry
+			}
+		case "channel":
+			msg.Channel = value
+		case "client":
+			msg.Client = value
+		}
+	}
+
+	if err := d.scanner.Err(); err != nil {
+		return msg, err
+	}
+
+	// Dispatch the final event if the stream ended without a blank line
+	if fields > 0 {
+		return withData(msg, data), nil
+	}
+
+	return msg, io.EOF
+}
+
+func withData(msg broker.Message, data []string) broker.Message {
+	if len(data) == 0 {
+		return msg
+	}
+
+	joined := strings.Join(data, "\n")
+
+	if json.Valid([]byte(joined)) {
+		msg.Data = json.RawMessage(joined)
+	} else {
+		msg.Data, _ = json.Marshal(joined)
+	}
+
+	return msg
+}
@@ -0,0 +1,453 @@
+package peer
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/davidsbond/sse-cluster/broker"
+	"github.com/sirupsen/logrus"
+)
+
+type (
+	// The Client type sends messages to other nodes over a long-lived connection
+	// to each, created when the first message is sent to a node. Messages sent to
+	// the same node at the same time are batched into a single frame.
+	Client struct {
+		node        string
+		timeout     time.Duration
+		sendTimeout time.Duration
+		keepAlive   time.Duration
+		maxBatch    int
+
+		mux    sync.Mutex
+		conns  map[string]*conn
+		closed bool
+		log    *logrus.Entry
+	}
+
+	// The Option type is a function that modifies the configuration of the
+	// client on creation.
+	Option func(*Client)
+
+	// The conn type is a connection to a single node. Messages are queued and
+	// written by a single goroutine, which batches everything queued since its
+	// last write. Written batches wait for the node to acknowledge them, which it
+	// does in the order they were written.
+	conn struct {
+		addr     string
+		conn     net.Conn
+		w        *bufio.Writer
+		version  byte
+		maxBatch int
+		timeout  time.Duration
+
+		mux      sync.Mutex
+		queue    []*send
+		inflight [][]*send
+		notify   chan struct{}
+		err      error
+		done     chan struct{}
+	}
+
+	// The send type is a group of messages waiting to be written to a connection,
+	// along with where to report the outcome.
+	send struct {
+		msgs   []broker.Message
+		result chan error
+	}
+)
+
+const (
+	// DefaultDialTimeout is how long connecting to a node and completing the
+	// handshake can take when no timeout is specified.
+	DefaultDialTimeout = time.Second * 5
+
+	// DefaultSendTimeout is how long writing messages to a node and waiting for it
+	// to acknowledge them can take when no timeout is specified.
+	DefaultSendTimeout = time.Second * 10
+
+	// DefaultKeepAlive is how often idle connections are probed to detect nodes
+	// that have gone away when no interval is specified.
+	DefaultKeepAlive = time.Second * 15
+
+	// DefaultMaxBatchSize is the largest number of messages written in a single
+	// frame when no size is specified.
+	DefaultMaxBatchSize = 1000
+)
+
+var (
+	// ErrClosed is returned when sending messages using a client that has been
+	// closed.
+	ErrClosed = errors.New("peer client is closed")
+
+	// ErrTimeout is returned when a node doesn't acknowledge messages within the
+	// send timeout.
+	ErrTimeout = errors.New("timed out waiting for peer to acknowledge messages")
+)
+
+// WithDialTimeout sets how long connecting to a node and completing the handshake
+// can take.
+func WithDialTimeout(timeout time.Duration) Option {
+	return func(c *Client) {
+		c.timeout = timeout
+	}
+}
+
+// WithSendTimeout sets how long writing messages to a node and waiting for it to
+// acknowledge them can take. A node that takes longer has its connection closed,
+// failing every message waiting to be acknowledged by it. A timeout of zero waits
+// forever.
+func WithSendTimeout(timeout time.Duration) Option {
+	return func(c *Client) {
+		c.sendTimeout = timeout
+	}
+}
+
+// WithKeepAlive sets how often idle connections are probed to detect nodes that
+// have gone away.
+func WithKeepAlive(interval time.Duration) Option {
+	return func(c *Client) {
+		c.keepAlive = interval
+	}
+}
+
+// WithMaxBatchSize sets the largest number of messages written in a single frame.
+func WithMaxBatchSize(size int) Option {
+	return func(c *Client) {
+		c.maxBatch = size
+	}
+}
+
+// NewClient creates a new instance of the Client type for the node with the given
+// name.
+func NewClient(node string, opts ...Option) *Client {
+	c := &Client{
+		node:        node,
+		timeout:     DefaultDialTimeout,
+		sendTimeout: DefaultSendTimeout,
+		keepAlive:   DefaultKeepAlive,
+		maxBatch:    DefaultMaxBatchSize,
+		conns:       make(map[string]*conn),
+		log:         logrus.WithField("name", "peer"),
+	}
+
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	return c
+}
+
+// Send writes messages to the node at the given address, connecting to it if there
+// is no connection already. It returns once the node has acknowledged publishing
+// the messages, or an error if they couldn't be sent or weren't acknowledged within
+// the send timeout. A connection that fails is discarded so that the next messages
+// sent to the node reconnect.
+func (c *Client) Send(addr string, msgs []broker.Message) error {
+	cn, err := c.conn(addr)
+
+	if err != nil {
+		return err
+	}
+
+	return cn.send(msgs)
+}
+
+// Close closes every connection to other nodes.
+func (c *Client) Close() error {
+	c.mux.Lock()
+	c.closed = true
+	conns := c.conns
+	c.conns = make(map[string]*conn)
+	c.mux.Unlock()
+
+	for _, cn := range conns {
+		cn.close(ErrClosed)
+	}
+
+	return nil
+}
+
+func (c *Client) conn(addr string) (*conn, error) {
+	c.mux.Lock()
+	cn, ok := c.conns[addr]
+	closed := c.closed
+	c.mux.Unlock()
+
+	if closed {
+		return nil, ErrClosed
+	}
+
+	if ok {
+		return cn, nil
+	}
+
+	cn, err := c.dial(addr)
+
+	if err != nil {
+		return nil, err
+	}
+
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	// Another message may have connected to the node at the same time
+	if existing, ok := c.conns[addr]; ok {
+		cn.close(nil)
+		return existing, nil
+	}
+
+	if c.closed {
+		cn.close(ErrClosed)
+		return nil, ErrClosed
+	}
+
+	c.conns[addr] = cn
+
+	go func() {
+		<-cn.done
+		c.forget(cn)
+	}()
+
+	return cn, nil
+}
+
+func (c *Client) forget(cn *conn) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	if c.conns[cn.addr] == cn {
+		delete(c.conns, cn.addr)
+	}
+}
+
+// dial connects to a node and performs the handshake.
+func (c *Client) dial(addr string) (*conn, error) {
+	dialer := net.Dialer{Timeout: c.timeout, KeepAlive: c.keepAlive}
+	nc, err := dialer.Dial("tcp", addr)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if c.timeout > 0 {
+		nc.SetDeadline(time.Now().Add(c.timeout))
+	}
+
+	w := bufio.NewWriter(nc)
+	r := bufio.NewReader(nc)
+
+	if err := writeHello(w, Version, c.node); err != nil {
+		nc.Close()
+		return nil, err
+	}
+
+	version, err := readAccept(r)
+
+	if err == nil {
+		version, err = negotiate(version)
+	}
+
+	if err != nil {
+		nc.Close()
+		return nil, err
+	}
+
+	nc.SetDeadline(time.Time{})
+
+	cn := &conn{
+		addr:     addr,
+		conn:     nc,
+		w:        w,
+		version:  version,
+		maxBatch: c.maxBatch,
+		timeout:  c.sendTimeout,
+		notify:   make(chan struct{}, 1),
+		done:     make(chan struct{}),
+	}
+
+	c.log.WithFields(logrus.Fields{
+		"addr":    addr,
+		"version": version,
+	}).Info("connected to peer")
+
+	go cn.write()
+	go cn.read(r)
+
+	return cn, nil
+}
+
+func (cn *conn) send(msgs []broker.Message) error {
+	s := &send{msgs: msgs, result: make(chan error, 1)}
+
+	cn.mux.Lock()
+	if cn.err != nil {
+		err := cn.err
+		cn.mux.Unlock()
+
+		return err
+	}
+
+	cn.queue = append(cn.queue, s)
+	cn.mux.Unlock()
+
+	select {
+	case cn.notify <- struct{}{}:
+	default:
+	}
+
+	if cn.timeout <= 0 {
+		return <-s.result
+	}
+
+	timer := time.NewTimer(cn.timeout)
+	defer timer.Stop()
+
+	select {
+	case err := <-s.result:
+		return err
+	case <-timer.C:
+		// The node may have stopped reading, so later messages can't be sent
+		// over the connection either. Closing it reports the outcome of every
+		// send, unless it was acknowledged in the meantime.
+		cn.close(ErrTimeout)
+		return <-s.result
+	}
+}
+
+// write writes the messages queued for the connection, batching those queued
+// since the last write into a single frame.
+func (cn *conn) write() {
+	for {
+		select {
+		case <-cn.done:
+			return
+		case <-cn.notify:
+		}
+
+		for {
+			batch := cn.next()
+
+			if len(batch) == 0 {
+				break
+			}
+
+			var msgs []broker.Message
+			for _, s := range batch {
+				msgs = append(msgs, s.msgs...)
+			}
+
+			if cn.timeout > 0 {
+				cn.conn.SetWriteDeadline(time.Now().Add(cn.timeout))
+			}
+
+			if err := writeFrame(cn.w, frameBatch, encodeBatch(msgs)); err != nil {
+				cn.close(err)
+				return
+			}
+		}
+	}
+}
+
+// next moves the sends that make up the next frame from the queue to those waiting
+// to be acknowledged. A single send larger than the maximum batch size is written
+// in a frame of its own.
+func (cn *conn) next() []*send {
+	cn.mux.Lock()
+	defer cn.mux.Unlock()
+
+	if cn.err != nil {
+		return nil
+	}
+
+	size := 0
+	n := 0
+	for n < len(cn.queue) {
+		size += len(cn.queue[n].msgs)
+
+		if n > 0 && cn.maxBatch > 0 && size > cn.maxBatch {
+			break
+		}
+
+		n++
+	}
+
+	batch := cn.queue[:n:n]
+	cn.queue = cn.queue[n:]
+
+	if len(batch) > 0 {
+		cn.inflight = append(cn.inflight, batch)
+	}
+
+	return batch
+}
+
+// read reads the acknowledgements sent by the node until the connection closes, so
+// that a node that has gone away is noticed before the next message is sent to it.
+func (cn *conn) read(r *bufio.Reader) {
+	for {
+		kind, _, err := readFrame(r)
+
+		if err != nil {
+			cn.close(err)
+			return
+		}
+
+		if kind == frameAck {
+			cn.ack()
+		}
+	}
+}
+
+// ack reports the success of the oldest batch waiting to be acknowledged.
+func (cn *conn) ack() {
+	cn.mux.Lock()
+	defer cn.mux.Unlock()
+
+	if len(cn.inflight) == 0 {
+		return
+	}
+
+	batch := cn.inflight[0]
+	cn.inflight = cn.inflight[1:]
+
+	for _, s := range batch {
+		s.result <- nil
+	}
+}
+
+// close closes the connection, failing any messages still queued or waiting to be
+// acknowledged with the given error.
+func (cn *conn) close(err error) {
+	if err == nil {
+		err = ErrClosed
+	}
+
+	cn.mux.Lock()
+
+	if cn.err != nil {
+		cn.mux.Unlock()
+		return
+	}
+
+	cn.err = err
+	queue := cn.queue
+	for _, batch := range cn.inflight {
+		queue = append(queue, batch...)
+	}
+
+	cn.queue = nil
+	cn.inflight = nil
+
+	close(cn.done)
+	cn.mux.Unlock()
+
+	cn.conn.Close()
+
+	for _, s := range queue {
+		s.result <- err
+	}
+}
@@ -0,0 +1,340 @@
+// Package peer contains a transport that propagates events between nodes over
+// long-lived connections, batching the messages sent to each node into frames
+// using a compact binary encoding.
+package peer
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/davidsbond/sse-cluster/broker"
+)
+
+const (
+	// Version is the newest version of the peer protocol supported. Both ends of a
+	// connection agree on the newest version they support during the handshake.
+	Version byte = 1
+
+	// The oldest version of the peer protocol supported.
+	minVersion byte = 1
+
+	// The bytes that start each handshake, so that connections from something
+	// other than a peer are rejected.
+	magic = "SSEP"
+
+	// The type of frame containing a batch of messages.
+	frameBatch byte = 1
+
+	// The type of frame sent in reply to each batch once its messages have been
+	// published.
+	frameAck byte = 2
+
+	// The largest frame that will be read, so that a corrupt length can't exhaust
+	// the node's memory.
+	maxFrameSize = 64 * 1024 * 1024
+)
+
+// ErrUnsupportedVersion is returned when a peer doesn't support any version of the
+// peer protocol this node supports.
+var ErrUnsupportedVersion = errors.New("unsupported peer protocol version")
+
+// writeHello writes the start of a handshake, containing the newest supported
+// version of the protocol and the name of the node.
+func writeHello(w *bufio.Writer, version byte, node string) error {
+	w.WriteString(magic)
+	w.WriteByte(version)
+
+	var buf bytes.Buffer
+	writeString(&buf, node)
+	w.Write(buf.Bytes())
+
+	return w.Flush()
+}
+
+// readHello reads the start of a handshake, returning the version and the name of
+// the node that sent it.
+func readHello(r *bufio.Reader) (byte, string, error) {
+	version, err := readMagic(r)
+
+	if err != nil {
+		return 0, "", err
+	}
+
+	n, err := binary.ReadUvarint(r)
+
+	if err != nil {
+		return 0, "", err
+	}
+
+	if n > maxFrameSize {
+		return 0, "", fmt.Errorf("node name of %d bytes is too large", n)
+	}
+
+	node := make([]byte, n)
+	if _, err := io.ReadFull(r, node); err != nil {
+		return 0, "", err
+	}
+
+	return version, string(node), nil
+}
+
+// writeAccept writes the response to a handshake, containing the version of the
+// protocol the connection will use.
+func writeAccept(w *bufio.Writer, version byte) error {
+	w.WriteString(magic)
+	w.WriteByte(version)
+
+	return w.Flush()
+}
+
+// readAccept reads the response to a handshake, returning the version of the
+// protocol the connection will use.
+func readAccept(r *bufio.Reader) (byte, error) {
+	return readMagic(r)
+}
+
+func readMagic(r *bufio.Reader) (byte, error) {
+	header := make([]byte, len(magic)+1)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, err
+	}
+
+	if string(header[:len(magic)]) != magic {
+		return 0, errors.New("connection is not from a peer")
+	}
+
+	return header[len(magic)], nil
+}
+
+// negotiate returns the newest version of the protocol supported by both ends of
+// a connection.
+func negotiate(version byte) (byte, error) {
+	if version > Version {
+		version = Version
+	}
+
+	if version < minVersion {
+		return 0, ErrUnsupportedVersion
+	}
+
+	return version, nil
+}
+
+// writeFrame writes a frame of the given type, prefixed with its length.
+func writeFrame(w *bufio.Writer, kind byte, payload []byte) error {
+	var header [5]byte
+	header[0] = kind
+	binary.BigEndian.PutUint32(header[1:], uint32(len(payload)))
+
+	w.Write(header[:])
+	w.Write(payload)
+
+	return w.Flush()
+}
+
+// readFrame reads a single frame, returning its type and payload.
+func readFrame(r *bufio.Reader) (byte, []byte, error) {
+	var header [5]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, nil, err
+	}
+
+	size := binary.BigEndian.Uint32(header[1:])
+	if size > maxFrameSize {
+		return 0, nil, fmt.Errorf("frame of %d bytes is too large", size)
+	}
+
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+
+	return header[0], payload, nil
+}
+
+// encodeBatch encodes many messages into the payload of a batch frame.
+func encodeBatch(msgs []broker.Message) []byte {
+	var buf bytes.Buffer
+
+	writeUvarint(&buf, uint64(len(msgs)))
+	for _, msg := range msgs {
+		encodeMessage(&buf, msg)
+	}
+
+	return buf.Bytes()
+}
+
+// decodeBatch decodes the messages in the payload of a batch frame.
+func decodeBatch(payload []byte) ([]broker.Message, error) {
+	d := &decoder{r: bytes.NewReader(payload)}
+
+	n := d.uvarint()
+	if d.err == nil && n > uint64(len(payload)) {
+		return nil, fmt.Errorf("batch of %d messages is larger than its frame", n)
+	}
+
+	msgs := make([]broker.Message, 0, n)
+	for i := uint64(0); i < n && d.err == nil; i++ {
+		msgs = append(msgs, d.message())
+	}
+
+	if d.err != nil {
+		return nil, d.err
+	}
+
+	return msgs, nil
+}
+
+func encodeMessage(buf *bytes.Buffer, msg broker.Message) {
+	writeString(buf, msg.ID)
+	writeString(buf, msg.Event)
+	writeData(buf, msg.Data)
+	writeVarint(buf, int64(msg.Retry))
+	writeVarint(buf, int64(msg.TTL))
+	writeTime(buf, msg.ExpiresAt)
+	writeVarint(buf, int64(msg.Delay))
+	writeTime(buf, msg.DeliverAt)
+	writeString(buf, msg.Channel)
+	writeString(buf, msg.Client)
+	writeString(buf, msg.IdempotencyKey)
+
+	writeUvarint(buf, uint64(len(msg.BeenTo)))
+	for _, node := range msg.BeenTo {
+		writeString(buf, node)
+	}
+}
+
+func writeUvarint(buf *bytes.Buffer, v uint64) {
+	var b [binary.MaxVarintLen64]byte
+	buf.Write(b[:binary.PutUvarint(b[:], v)])
+}
+
+func writeVarint(buf *bytes.Buffer, v int64) {
+	var b [binary.MaxVarintLen64]byte
+	buf.Write(b[:binary.PutVarint(b[:], v)])
+}
+
+func writeString(buf *bytes.Buffer, s string) {
+	writeUvarint(buf, uint64(len(s)))
+	buf.WriteString(s)
+}
+
+// writeData writes a message's data. Its length is offset by one so that a message
+// without data can be told apart from one with empty data.
+func writeData(buf *bytes.Buffer, data []byte) {
+	if data == nil {
+		writeUvarint(buf, 0)
+		return
+	}
+
+	writeUvarint(buf, uint64(len(data))+1)
+	buf.Write(data)
+}
+
+// writeTime writes an optional time as nanoseconds since the Unix epoch, with zero
+// meaning no time.
+func writeTime(buf *bytes.Buffer, t *time.Time) {
+	if t == nil {
+		writeVarint(buf, 0)
+		return
+	}
+
+	writeVarint(buf, t.UnixNano())
+}
+
+// The decoder type reads the fields of encoded messages, stopping at the first
+// error.
+type decoder struct {
+	r   *bytes.Reader
+	err error
+}
+
+func (d *decoder) message() broker.Message {
+	msg := broker.Message{
+		ID:        d.string(),
+		Event:     d.string(),
+		Data:      d.data(),
+		Retry:     int(d.varint()),
+		TTL:       int(d.varint()),
+		ExpiresAt: d.time(),
+		Delay:     int(d.varint()),
+		DeliverAt: d.time(),
+		Channel:   d.string(),
+		Client:    d.string(),
+
+		IdempotencyKey: d.string(),
+	}
+
+	n := d.uvarint()
+	for i := uint64(0); i < n && d.err == nil; i++ {
+		msg.BeenTo = append(msg.BeenTo, d.string())
+	}
+
+	return msg
+}
+
+func (d *decoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+
+	var v uint64
+	v, d.err = binary.ReadUvarint(d.r)
+
+	return v
+}
+
+func (d *decoder) varint() int64 {
+	if d.err != nil {
+		return 0
+	}
+
+	var v int64
+	v, d.err = binary.ReadVarint(d.r)
+
+	return v
+}
+
+func (d *decoder) bytes(n uint64) []byte {
+	if d.err != nil {
+		return nil
+	}
+
+	if n > uint64(d.r.Len()) {
+		d.err = io.ErrUnexpectedEOF
+		return nil
+	}
+
+	b := make([]byte, n)
+	_, d.err = io.ReadFull(d.r, b)
+
+	return b
+}
+
+func (d *decoder) string() string {
+	return string(d.bytes(d.uvarint()))
+}
+
+func (d *decoder) data() []byte {
+	n := d.uvarint()
+	if n == 0 {
+		return nil
+	}
+
+	return d.bytes(n - 1)
+}
+
+func (d *decoder) time() *time.Time {
+	v := d.varint()
+	if v == 0 {
+		return nil
+	}
+
+	t := time.Unix(0, v)
+	return &t
+}
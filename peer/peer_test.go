@@ -0,0 +1,315 @@
+package peer_test
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/davidsbond/sse-cluster/broker"
+	"github.com/davidsbond/sse-cluster/peer"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+type (
+	MockPublisher struct {
+		mux     sync.Mutex
+		batches [][]broker.Message
+		notify  chan struct{}
+	}
+)
+
+func NewMockPublisher() *MockPublisher {
+	return &MockPublisher{notify: make(chan struct{}, 100)}
+}
+
+func (m *MockPublisher) PublishBatch(msgs []broker.Message) []broker.BatchResult {
+	m.mux.Lock()
+	m.batches = append(m.batches, msgs)
+	m.mux.Unlock()
+
+	m.notify <- struct{}{}
+
+	results := make([]broker.BatchResult, len(msgs))
+	for i, msg := range msgs {
+		results[i].ID = msg.ID
+	}
+
+	return results
+}
+
+// Messages waits for the given number of messages to be published, returning every
+// batch received.
+func (m *MockPublisher) Messages(t *testing.T, n int) [][]broker.Message {
+	for {
+		m.mux.Lock()
+		total := 0
+		for _, batch := range m.batches {
+			total += len(batch)
+		}
+
+		if total >= n {
+			batches := m.batches
+			m.mux.Unlock()
+
+			return batches
+		}
+		m.mux.Unlock()
+
+		select {
+		case <-m.notify:
+		case <-time.After(time.Second * 5):
+			assert.Fail(t, "timed out waiting for messages")
+			return nil
+		}
+	}
+}
+
+func startServer(t *testing.T, addr string, pub peer.Publisher) (*peer.Server, string) {
+	l, err := net.Listen("tcp", addr)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := peer.NewServer(pub)
+	go s.Serve(l)
+
+	return s, l.Addr().String()
+}
+
+func TestClient_Send(t *testing.T) {
+	t.Parallel()
+	logrus.SetLevel(logrus.PanicLevel)
+
+	now := time.Unix(0, time.Now().UnixNano())
+
+	tt := []struct {
+		Name     string
+		Messages []broker.Message
+	}{
+		{
+			Name: "It should send every field of a message",
+			Messages: []broker.Message{
+				{
+					ID:             "1",
+					Event:          "test",
+					Data:           []byte(`{"hello":"world"}`),
+					Retry:          1000,
+					TTL:            60000,
+					ExpiresAt:      &now,
+					Delay:          -1,
+					DeliverAt:      &now,
+					Channel:        "test",
+					Client:         "client",
+					IdempotencyKey: "key",
+					BeenTo:         []string{"a", "b"},
+				},
+			},
+		},
+		{
+			Name: "It should tell messages without data from those with empty data",
+			Messages: []broker.Message{
+				{ID: "1", Channel: "test"},
+				{ID: "2", Channel: "test", Data: []byte{}},
+			},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.Name, func(t *testing.T) {
+			pub := NewMockPublisher()
+			s, addr := startServer(t, "127.0.0.1:0", pub)
+			defer s.Close()
+
+			c := peer.NewClient("test")
+			defer c.Close()
+
+			assert.NoError(t, c.Send(addr, tc.Messages))
+
+			batches := pub.Messages(t, len(tc.Messages))
+			if assert.Len(t, batches, 1) {
+				assert.Equal(t, tc.Messages, batches[0])
+			}
+		})
+	}
+}
+
+func TestClient_SendBatching(t *testing.T) {
+	t.Parallel()
+	logrus.SetLevel(logrus.PanicLevel)
+
+	pub := NewMockPublisher()
+	s, addr := startServer(t, "127.0.0.1:0", pub)
+	defer s.Close()
+
+	c := peer.NewClient("test", peer.WithMaxBatchSize(10))
+	defer c.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, c.Send(addr, []broker.Message{{ID: "1", Channel: "test"}}))
+		}()
+	}
+
+	wg.Wait()
+
+	batches := pub.Messages(t, 100)
+	for _, batch := range batches {
+		assert.True(t, len(batch) <= 10, "batch of %d messages is larger than the maximum", len(batch))
+	}
+}
+
+func TestClient_SendReconnect(t *testing.T) {
+	t.Parallel()
+	logrus.SetLevel(logrus.PanicLevel)
+
+	pub := NewMockPublisher()
+	s, addr := startServer(t, "127.0.0.1:0", pub)
+
+	c := peer.NewClient("test")
+	defer c.Close()
+
+	assert.NoError(t, c.Send(addr, []broker.Message{{ID: "1"}}))
+	pub.Messages(t, 1)
+
+	// Restart the server on the same address, closing the client's connection
+	s.Close()
+	s, _ = startServer(t, addr, pub)
+	defer s.Close()
+
+	// The closed connection may not be noticed until a write to it fails
+	var err error
+	for i := 0; i < 50; i++ {
+		if err = c.Send(addr, []broker.Message{{ID: "2"}}); err == nil {
+			break
+		}
+
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	assert.NoError(t, err)
+	pub.Messages(t, 2)
+}
+
+func TestClient_SendUnsupportedVersion(t *testing.T) {
+	t.Parallel()
+	logrus.SetLevel(logrus.PanicLevel)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer l.Close()
+
+	// A node that doesn't support any version replies with version zero
+	go func() {
+		nc, err := l.Accept()
+
+		if err != nil {
+			return
+		}
+
+		defer nc.Close()
+
+		buf := make([]byte, 64)
+		nc.Read(buf)
+		nc.Write([]byte("SSEP\x00"))
+	}()
+
+	c := peer.NewClient("test")
+	defer c.Close()
+
+	assert.Equal(t, peer.ErrUnsupportedVersion, c.Send(l.Addr().String(), []broker.Message{{ID: "1"}}))
+}
+
+func TestClient_SendTimeout(t *testing.T) {
+	t.Parallel()
+	logrus.SetLevel(logrus.PanicLevel)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer l.Close()
+
+	// A node that completes the handshake but never acknowledges any messages
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		for {
+			nc, err := l.Accept()
+
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer nc.Close()
+
+				buf := make([]byte, 64)
+				nc.Read(buf)
+				nc.Write([]byte("SSEP\x01"))
+
+				<-done
+			}()
+		}
+	}()
+
+	c := peer.NewClient("test", peer.WithSendTimeout(time.Millisecond*100))
+	defer c.Close()
+
+	start := time.Now()
+	assert.Equal(t, peer.ErrTimeout, c.Send(l.Addr().String(), []broker.Message{{ID: "1"}}))
+	assert.True(t, time.Since(start) < time.Second, "send waited for longer than the timeout")
+
+	// Later sends aren't left waiting on the discarded connection
+	assert.Equal(t, peer.ErrTimeout, c.Send(l.Addr().String(), []broker.Message{{ID: "2"}}))
+}
+
+func TestClient_SendClosed(t *testing.T) {
+	t.Parallel()
+
+	c := peer.NewClient("test")
+	c.Close()
+
+	assert.Equal(t, peer.ErrClosed, c.Send("127.0.0.1:0", []broker.Message{{ID: "1"}}))
+}
+
+func TestServer_RejectsUnsupportedVersion(t *testing.T) {
+	t.Parallel()
+	logrus.SetLevel(logrus.PanicLevel)
+
+	s, addr := startServer(t, "127.0.0.1:0", NewMockPublisher())
+	defer s.Close()
+
+	nc, err := net.Dial("tcp", addr)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer nc.Close()
+
+	// Version zero is never supported
+	nc.Write([]byte("SSEP\x00\x04test"))
+
+	buf := make([]byte, 5)
+	nc.SetReadDeadline(time.Now().Add(time.Second * 5))
+
+	if _, err := nc.Read(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, "SSEP\x00", string(buf))
+}
@@ -0,0 +1,224 @@
+package peer
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/davidsbond/sse-cluster/broker"
+	"github.com/sirupsen/logrus"
+)
+
+type (
+	// The Publisher type is the broker that messages received from other nodes are
+	// published to.
+	Publisher interface {
+		PublishBatch([]broker.Message) []broker.BatchResult
+	}
+
+	// The Server type accepts connections from other nodes and publishes the
+	// messages they send.
+	Server struct {
+		publisher Publisher
+		timeout   time.Duration
+
+		mux       sync.Mutex
+		listeners map[net.Listener]bool
+		conns     map[net.Conn]bool
+		closed    bool
+		wg        sync.WaitGroup
+		log       *logrus.Entry
+	}
+
+	// The ServerOption type is a function that modifies the configuration of the
+	// server on creation.
+	ServerOption func(*Server)
+)
+
+// WithHandshakeTimeout sets how long a node has to complete the handshake once it
+// has connected.
+func WithHandshakeTimeout(timeout time.Duration) ServerOption {
+	return func(s *Server) {
+		s.timeout = timeout
+	}
+}
+
+// NewServer creates a new instance of the Server type that publishes the messages
+// it receives to the given publisher.
+func NewServer(publisher Publisher, opts ...ServerOption) *Server {
+	s := &Server{
+		publisher: publisher,
+		timeout:   DefaultDialTimeout,
+		listeners: make(map[net.Listener]bool),
+		conns:     make(map[net.Conn]bool),
+		log:       logrus.WithField("name", "peer"),
+	}
+
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	return s
+}
+
+// Serve accepts connections from other nodes on the given listener until the
+// server is closed.
+func (s *Server) Serve(l net.Listener) error {
+	s.mux.Lock()
+	if s.closed {
+		s.mux.Unlock()
+		l.Close()
+
+		return ErrClosed
+	}
+
+	s.listeners[l] = true
+	s.mux.Unlock()
+
+	for {
+		nc, err := l.Accept()
+
+		if err != nil {
+			s.mux.Lock()
+			closed := s.closed
+			s.mux.Unlock()
+
+			if closed {
+				return nil
+			}
+
+			return err
+		}
+
+		if !s.track(nc) {
+			nc.Close()
+			return nil
+		}
+
+		s.wg.Add(1)
+		go s.serve(nc)
+	}
+}
+
+// Close stops accepting connections, closes those from other nodes and waits for
+// the messages being published to finish.
+func (s *Server) Close() error {
+	s.mux.Lock()
+	s.closed = true
+
+	for l := range s.listeners {
+		l.Close()
+	}
+
+	for nc := range s.conns {
+		nc.Close()
+	}
+
+	s.mux.Unlock()
+	s.wg.Wait()
+
+	return nil
+}
+
+func (s *Server) track(nc net.Conn) bool {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if s.closed {
+		return false
+	}
+
+	s.conns[nc] = true
+	return true
+}
+
+func (s *Server) serve(nc net.Conn) {
+	defer s.wg.Done()
+	defer func() {
+		s.mux.Lock()
+		delete(s.conns, nc)
+		s.mux.Unlock()
+
+		nc.Close()
+	}()
+
+	log := s.log.WithField("addr", nc.RemoteAddr().String())
+
+	r := bufio.NewReader(nc)
+	w := bufio.NewWriter(nc)
+
+	if s.timeout > 0 {
+		nc.SetDeadline(time.Now().Add(s.timeout))
+	}
+
+	version, node, err := readHello(r)
+
+	if err != nil {
+		log.WithError(err).Error("failed to read handshake from peer")
+		return
+	}
+
+	// Reply with the newest version both nodes support. If there isn't one, the
+	// reply contains version zero, which no node supports.
+	accepted, err := negotiate(version)
+
+	if err != nil {
+		writeAccept(w, 0)
+		log.WithField("version", version).WithError(err).Error("rejected peer")
+		return
+	}
+
+	if err := writeAccept(w, accepted); err != nil {
+		log.WithError(err).Error("failed to complete handshake with peer")
+		return
+	}
+
+	nc.SetDeadline(time.Time{})
+
+	log = log.WithFields(logrus.Fields{
+		"peer":    node,
+		"version": accepted,
+	})
+
+	log.Info("accepted peer")
+
+	for {
+		kind, payload, err := readFrame(r)
+
+		if err == io.EOF {
+			log.Info("peer disconnected")
+			return
+		}
+
+		if err != nil {
+			log.WithError(err).Error("failed to read frame from peer")
+			return
+		}
+
+		// Frames of types added in newer versions are skipped
+		if kind != frameBatch {
+			log.WithField("frameType", kind).Warn("skipped unknown frame from peer")
+			continue
+		}
+
+		msgs, err := decodeBatch(payload)
+
+		if err != nil {
+			log.WithError(err).Error("failed to decode batch from peer")
+			return
+		}
+
+		for _, res := range s.publisher.PublishBatch(msgs) {
+			if res.Err != nil {
+				log.WithField("eventId", res.ID).WithError(res.Err).Error("failed to publish event from peer")
+			}
+		}
+
+		if err := writeFrame(w, frameAck, nil); err != nil {
+			log.WithError(err).Error("failed to acknowledge batch from peer")
+			return
+		}
+	}
+}
@@ -0,0 +1,517 @@
+// Package store contains a file-backed implementation of the broker's event store.
+package store
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/davidsbond/sse-cluster/broker"
+	"github.com/sirupsen/logrus"
+)
+
+type (
+	// The Log type is an append-only event store that writes messages to segment
+	// files within a directory. Each segment is named after the sequence number
+	// of its first record, and an in-memory index of each channel's records is
+	// rebuilt from the segments when the log is opened.
+	Log struct {
+		dir         string
+		segmentSize int64
+		maxAge      time.Duration
+		maxBytes    int64
+		sync        time.Duration
+
+		mux      sync.RWMutex
+		dirty    bool
+		done     chan struct{}
+		wg       sync.WaitGroup
+		seq      uint64
+		segments []*segment
+		index    map[string][]entry
+		log      *logrus.Entry
+	}
+
+	// The Option type is a function that modifies the configuration of the
+	// log when it is opened.
+	Option func(*Log)
+
+	// The segment type represents a single file within the log.
+	segment struct {
+		base     uint64
+		file     *os.File
+		size     int64
+		modified time.Time
+	}
+
+	// The entry type represents the location of a single record in the log.
+	entry struct {
+		id      string
+		segment *segment
+		offset  int64
+		length  int64
+	}
+
+	// The record type is the form each message takes when written to a segment.
+	record struct {
+		Seq     uint64         `json:"seq"`
+		Time    time.Time      `json:"time"`
+		Channel string         `json:"channel"`
+		Message broker.Message `json:"message"`
+	}
+)
+
+const (
+	// DefaultSegmentSize is the size in bytes a segment can grow to before a
+	// new segment is started.
+	DefaultSegmentSize = 64 * 1024 * 1024
+
+	segmentExt = ".log"
+)
+
+// WithSegmentSize sets the size in bytes a segment can grow to before a new
+// segment is started.
+func WithSegmentSize(size int64) Option {
+	return func(l *Log) {
+		l.segmentSize = size
+	}
+}
+
+// WithMaxAge sets how long messages are retained. Segments whose newest message
+// is older than the given duration are deleted. A duration of zero retains messages
+// indefinitely.
+func WithMaxAge(age time.Duration) Option {
+	return func(l *Log) {
+		l.maxAge = age
+	}
+}
+
+// WithMaxBytes sets the total size in bytes the log can grow to before the oldest
+// segments are deleted. A size of zero places no limit on the log.
+func WithMaxBytes(size int64) Option {
+	return func(l *Log) {
+		l.maxBytes = size
+	}
+}
+
+// WithSyncInterval sets how often appended messages are flushed to stable storage.
+// An interval of zero flushes after every append, so that an acknowledged message
+// survives the loss of the node. A longer interval trades the messages appended
+// within it for faster appends, and a negative interval leaves flushing to the
+// operating system.
+func WithSyncInterval(interval time.Duration) Option {
+	return func(l *Log) {
+		l.sync = interval
+	}
+}
+
+// Open opens the log in the given directory, creating it if it does not exist.
+// Existing segments are read to rebuild the index.
+func Open(dir string, opts ...Option) (*Log, error) {
+	l := &Log{
+		dir:         dir,
+		segmentSize: DefaultSegmentSize,
+		index:       make(map[string][]entry),
+		done:        make(chan struct{}),
+		log: logrus.WithFields(logrus.Fields{
+			"name": "store",
+			"dir":  dir,
+		}),
+	}
+
+	for _, opt := range opts {
+		opt(l)
+	}
+
+	if l.segmentSize <= 0 {
+		return nil, fmt.Errorf("invalid segment size %d, must be greater than zero", l.segmentSize)
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	infos, err := ioutil.ReadDir(dir)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, info := range infos {
+		if !info.IsDir() && strings.HasSuffix(info.Name(), segmentExt) {
+			names = append(names, info.Name())
+		}
+	}
+
+	// Segment names are zero-padded, so they sort in the order they were written
+	sort.Strings(names)
+
+	for i, name := range names {
+		if err := l.load(filepath.Join(dir, name), i == len(names)-1); err != nil {
+			l.Close()
+			return nil, err
+		}
+	}
+
+	if len(l.segments) == 0 {
+		if err := l.roll(); err != nil {
+			return nil, err
+		}
+	}
+
+	l.enforceRetention()
+
+	if l.sync > 0 {
+		l.wg.Add(1)
+		go l.syncEvery(l.sync)
+	}
+
+	return l, nil
+}
+
+// Append writes a message published to the given channel to the end of the log.
+func (l *Log) Append(channelID string, msg broker.Message) error {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	// The nodes a message has been through are only relevant while it is being
+	// propagated.
+	msg.BeenTo = nil
+
+	rec := record{
+		Seq:     l.seq + 1,
+		Time:    time.Now(),
+		Channel: channelID,
+		Message: msg,
+	}
+
+	data, err := json.Marshal(rec)
+
+	if err != nil {
+		return err
+	}
+
+	data = append(data, '\n')
+
+	seg := l.segments[len(l.segments)-1]
+
+	if seg.size > 0 && seg.size+int64(len(data)) > l.segmentSize {
+		if err := l.roll(); err != nil {
+			return err
+		}
+
+		seg = l.segments[len(l.segments)-1]
+	}
+
+	if _, err := seg.file.WriteAt(data, seg.size); err != nil {
+		return err
+	}
+
+	if l.sync == 0 {
+		if err := seg.file.Sync(); err != nil {
+			return err
+		}
+	} else {
+		l.dirty = true
+	}
+
+	l.index[channelID] = append(l.index[channelID], entry{
+		id:      msg.ID,
+		segment: seg,
+		offset:  seg.size,
+		length:  int64(len(data)),
+	})
+
+	l.seq = rec.Seq
+	seg.size += int64(len(data))
+	seg.modified = rec.Time
+
+	l.enforceRetention()
+
+	return nil
+}
+
+// Since returns the messages for a channel that were appended after the message
+// with the given identifier, oldest first, and whether the identifier was found.
+// If the identifier is empty or no longer retained, all retained messages for the
+// channel are returned. If a limit is given, only that many of the most recent
+// messages are read.
+func (l *Log) Since(channelID, id string, limit int) ([]broker.Message, bool, error) {
+	l.mux.RLock()
+	defer l.mux.RUnlock()
+
+	entries := l.index[channelID]
+
+	start := 0
+	found := false
+	for i := len(entries) - 1; i >= 0 && id != ""; i-- {
+		if entries[i].id == id {
+			start = i + 1
+			found = true
+			break
+		}
+	}
+
+	if limit > 0 && len(entries)-start > limit {
+		start = len(entries) - limit
+	}
+
+	out := make([]broker.Message, 0, len(entries)-start)
+	for _, e := range entries[start:] {
+		data := make([]byte, e.length)
+
+		if _, err := e.segment.file.ReadAt(data, e.offset); err != nil {
+			return nil, false, err
+		}
+
+		var rec record
+		if err := json.Unmarshal(data, &rec); err != nil {
+			return nil, false, err
+		}
+
+		out = append(out, rec.Message)
+	}
+
+	return out, found, nil
+}
+
+// Close flushes and closes all open segment files.
+func (l *Log) Close() error {
+	close(l.done)
+	l.wg.Wait()
+
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	var out error
+	if err := l.flush(); err != nil {
+		out = err
+	}
+
+	for _, seg := range l.segments {
+		if err := seg.file.Close(); err != nil {
+			out = err
+		}
+	}
+
+	l.segments = nil
+
+	return out
+}
+
+// syncEvery flushes appended messages to stable storage at the given interval
+// until the log is closed.
+func (l *Log) syncEvery(interval time.Duration) {
+	defer l.wg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-l.done:
+			return
+		case <-ticker.C:
+			l.mux.Lock()
+			if err := l.flush(); err != nil {
+				l.log.WithError(err).Error("failed to sync segment")
+			}
+			l.mux.Unlock()
+		}
+	}
+}
+
+// flush syncs the segment currently being written to if anything has been
+// appended to it since it was last synced.
+func (l *Log) flush() error {
+	if !l.dirty || len(l.segments) == 0 {
+		return nil
+	}
+
+	if err := l.segments[len(l.segments)-1].file.Sync(); err != nil {
+		return err
+	}
+
+	l.dirty = false
+
+	return nil
+}
+
+// load reads an existing segment file, adding each record to the index. Records
+// that can't be decoded are skipped. If the last segment, which is appended to,
+// ends with a partially written record, it is truncated to the last complete
+// record. Earlier segments are never modified.
+func (l *Log) load(path string, last bool) error {
+	var base uint64
+	if _, err := fmt.Sscanf(filepath.Base(path), "%020d"+segmentExt, &base); err != nil {
+		return fmt.Errorf("invalid segment name %s: %v", path, err)
+	}
+
+	file, err := os.OpenFile(path, os.O_RDWR, 0644)
+
+	if err != nil {
+		return err
+	}
+
+	seg := &segment{
+		base: base,
+		file: file,
+	}
+
+	reader := bufio.NewReader(file)
+
+	// The end of the last record that was decoded, anything after it in the last
+	// segment is a torn write.
+	var end int64
+
+	for {
+		line, err := reader.ReadBytes('\n')
+
+		if err != nil {
+			// Anything left without a trailing newline was never completely written.
+			if len(line) > 0 {
+				l.log.WithField("segment", path).Warn("skipped partially written record")
+			}
+
+			break
+		}
+
+		offset := seg.size
+		seg.size += int64(len(line))
+
+		var rec record
+		if err := json.Unmarshal(line, &rec); err != nil {
+			l.log.WithError(err).WithFields(logrus.Fields{
+				"segment": path,
+				"offset":  offset,
+			}).Error("skipped corrupt record")
+
+			continue
+		}
+
+		l.index[rec.Channel] = append(l.index[rec.Channel], entry{
+			id:      rec.Message.ID,
+			segment: seg,
+			offset:  offset,
+			length:  int64(len(line)),
+		})
+
+		l.seq = rec.Seq
+		end = seg.size
+		seg.modified = rec.Time
+	}
+
+	if last {
+		if err := file.Truncate(end); err != nil {
+			file.Close()
+			return err
+		}
+
+		seg.size = end
+	}
+
+	if seg.modified.IsZero() {
+		if info, err := file.Stat(); err == nil {
+			seg.modified = info.ModTime()
+		}
+	}
+
+	l.segments = append(l.segments, seg)
+
+	return nil
+}
+
+// roll starts a new segment, which all subsequent records are appended to.
+func (l *Log) roll() error {
+	// Records are only ever appended to the newest segment, so it must be synced
+	// before it stops being the one that is flushed.
+	if err := l.flush(); err != nil {
+		return err
+	}
+
+	base := l.seq + 1
+	path := filepath.Join(l.dir, fmt.Sprintf("%020d", base)+segmentExt)
+
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+
+	if err != nil {
+		return err
+	}
+
+	l.segments = append(l.segments, &segment{
+		base:     base,
+		file:     file,
+		modified: time.Now(),
+	})
+
+	l.log.WithField("segment", path).Info("started new segment")
+
+	return nil
+}
+
+// enforceRetention deletes the oldest segments while they exceed the configured
+// age or size limits. The segment currently being written to is never deleted.
+func (l *Log) enforceRetention() {
+	for len(l.segments) > 1 {
+		oldest := l.segments[0]
+
+		expired := l.maxAge > 0 && time.Since(oldest.modified) > l.maxAge
+		oversized := l.maxBytes > 0 && l.size() > l.maxBytes
+
+		if !expired && !oversized {
+			return
+		}
+
+		l.remove(oldest)
+	}
+}
+
+// remove deletes the oldest segment and all index entries that point to it.
+func (l *Log) remove(seg *segment) {
+	path := seg.file.Name()
+
+	if err := seg.file.Close(); err != nil {
+		l.log.WithError(err).WithField("segment", path).Error("failed to close segment")
+	}
+
+	if err := os.Remove(path); err != nil {
+		l.log.WithError(err).WithField("segment", path).Error("failed to delete segment")
+	}
+
+	l.segments = l.segments[1:]
+
+	// Entries are in the order they were written, so any pointing to the oldest
+	// segment are at the start of each channel's index.
+	for channelID, entries := range l.index {
+		i := 0
+		for i < len(entries) && entries[i].segment == seg {
+			i++
+		}
+
+		if i == len(entries) {
+			delete(l.index, channelID)
+			continue
+		}
+
+		l.index[channelID] = entries[i:]
+	}
+
+	l.log.WithField("segment", path).Info("deleted expired segment")
+}
+
+func (l *Log) size() int64 {
+	var total int64
+	for _, seg := range l.segments {
+		total += seg.size
+	}
+
+	return total
+}
@@ -0,0 +1,326 @@
+package store_test
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/davidsbond/sse-cluster/broker"
+	"github.com/davidsbond/sse-cluster/store"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLog_Since(t *testing.T) {
+	t.Parallel()
+	logrus.SetLevel(logrus.PanicLevel)
+
+	tt := []struct {
+		Name             string
+		Options          []store.Option
+		Channel          string
+		Messages         []broker.Message
+		Since            string
+		Limit            int
+		ExpectedMessages []broker.Message
+	}{
+		{
+			Name:    "It should return messages after the given id",
+			Channel: "test",
+			Messages: []broker.Message{
+				{ID: "1"},
+				{ID: "2"},
+				{ID: "3"},
+			},
+			Since: "1",
+			ExpectedMessages: []broker.Message{
+				{ID: "2"},
+				{ID: "3"},
+			},
+		},
+		{
+			Name:    "It should return all messages without an id",
+			Channel: "test",
+			Messages: []broker.Message{
+				{ID: "1"},
+				{ID: "2"},
+			},
+			ExpectedMessages: []broker.Message{
+				{ID: "1"},
+				{ID: "2"},
+			},
+		},
+		{
+			Name:    "It should read messages across segments",
+			Channel: "test",
+			Options: []store.Option{
+				store.WithSegmentSize(1),
+			},
+			Messages: []broker.Message{
+				{ID: "1"},
+				{ID: "2"},
+				{ID: "3"},
+			},
+			Since: "1",
+			ExpectedMessages: []broker.Message{
+				{ID: "2"},
+				{ID: "3"},
+			},
+		},
+		{
+			Name:    "It should return only the most recent messages up to the limit",
+			Channel: "test",
+			Messages: []broker.Message{
+				{ID: "1"},
+				{ID: "2"},
+				{ID: "3"},
+			},
+			Limit: 2,
+			ExpectedMessages: []broker.Message{
+				{ID: "2"},
+				{ID: "3"},
+			},
+		},
+		{
+			Name:    "It should return messages when syncing periodically",
+			Channel: "test",
+			Options: []store.Option{
+				store.WithSyncInterval(time.Millisecond),
+			},
+			Messages: []broker.Message{
+				{ID: "1"},
+			},
+			ExpectedMessages: []broker.Message{
+				{ID: "1"},
+			},
+		},
+		{
+			Name:    "It should delete segments exceeding the size limit",
+			Channel: "test",
+			Options: []store.Option{
+				store.WithSegmentSize(1),
+				store.WithMaxBytes(1),
+			},
+			Messages: []broker.Message{
+				{ID: "1"},
+				{ID: "2"},
+				{ID: "3"},
+			},
+			ExpectedMessages: []broker.Message{
+				{ID: "3"},
+			},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.Name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "store")
+
+			if err != nil {
+				assert.Fail(t, err.Error())
+				return
+			}
+
+			defer os.RemoveAll(dir)
+
+			l, err := store.Open(dir, tc.Options...)
+
+			if err != nil {
+				assert.Fail(t, err.Error())
+				return
+			}
+
+			defer l.Close()
+
+			for _, msg := range tc.Messages {
+				if err := l.Append("other", msg); err != nil {
+					assert.Fail(t, err.Error())
+					return
+				}
+
+				if err := l.Append(tc.Channel, msg); err != nil {
+					assert.Fail(t, err.Error())
+					return
+				}
+			}
+
+			msgs, _, err := l.Since(tc.Channel, tc.Since, tc.Limit)
+
+			if err != nil {
+				assert.Fail(t, err.Error())
+				return
+			}
+
+			assert.Equal(t, tc.ExpectedMessages, msgs)
+		})
+	}
+}
+
+func TestOpen(t *testing.T) {
+	t.Parallel()
+	logrus.SetLevel(logrus.PanicLevel)
+
+	tt := []struct {
+		Name             string
+		Channel          string
+		Messages         []broker.Message
+		Partial          string
+		Corrupt          bool
+		ExpectedMessages []broker.Message
+	}{
+		{
+			Name:    "It should rebuild the index from existing segments",
+			Channel: "test",
+			Messages: []broker.Message{
+				{ID: "1"},
+				{ID: "2"},
+			},
+			ExpectedMessages: []broker.Message{
+				{ID: "1"},
+				{ID: "2"},
+			},
+		},
+		{
+			Name:    "It should ignore partially written records",
+			Channel: "test",
+			Messages: []broker.Message{
+				{ID: "1"},
+			},
+			Partial: `{"seq":2,"channel":"test","mess`,
+			ExpectedMessages: []broker.Message{
+				{ID: "1"},
+			},
+		},
+		{
+			Name:    "It should skip corrupt records in earlier segments",
+			Channel: "test",
+			Messages: []broker.Message{
+				{ID: "1"},
+				{ID: "2"},
+				{ID: "3"},
+			},
+			Corrupt: true,
+			ExpectedMessages: []broker.Message{
+				{ID: "1"},
+				{ID: "3"},
+			},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.Name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "store")
+
+			if err != nil {
+				assert.Fail(t, err.Error())
+				return
+			}
+
+			defer os.RemoveAll(dir)
+
+			// Each record gets a segment of its own
+			l, err := store.Open(dir, store.WithSegmentSize(1))
+
+			if err != nil {
+				assert.Fail(t, err.Error())
+				return
+			}
+
+			for _, msg := range tc.Messages {
+				if err := l.Append(tc.Channel, msg); err != nil {
+					assert.Fail(t, err.Error())
+					return
+				}
+			}
+
+			if err := l.Close(); err != nil {
+				assert.Fail(t, err.Error())
+				return
+			}
+
+			// Overwrite the middle record without changing the segment's size
+			if tc.Corrupt {
+				path := filepath.Join(dir, fmt.Sprintf("%020d.log", 2))
+				data, err := ioutil.ReadFile(path)
+
+				if err != nil {
+					assert.Fail(t, err.Error())
+					return
+				}
+
+				corrupt := append(bytes.Repeat([]byte("x"), len(data)-1), '\n')
+				if err := ioutil.WriteFile(path, corrupt, 0644); err != nil {
+					assert.Fail(t, err.Error())
+					return
+				}
+			}
+
+			if tc.Partial != "" {
+				path := filepath.Join(dir, fmt.Sprintf("%020d.log", len(tc.Messages)))
+				file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+
+				if err != nil {
+					assert.Fail(t, err.Error())
+					return
+				}
+
+				file.WriteString(tc.Partial)
+				file.Close()
+			}
+
+			l, err = store.Open(dir)
+
+			if err != nil {
+				assert.Fail(t, err.Error())
+				return
+			}
+
+			defer l.Close()
+
+			msgs, _, err := l.Since(tc.Channel, "", 0)
+
+			if err != nil {
+				assert.Fail(t, err.Error())
+				return
+			}
+
+			assert.Equal(t, tc.ExpectedMessages, msgs)
+
+			// Appending after reopening should continue from the last complete record.
+			if err := l.Append(tc.Channel, broker.Message{ID: "new"}); err != nil {
+				assert.Fail(t, err.Error())
+				return
+			}
+
+			msgs, _, err = l.Since(tc.Channel, "", 0)
+
+			if err != nil {
+				assert.Fail(t, err.Error())
+				return
+			}
+
+			assert.Len(t, msgs, len(tc.ExpectedMessages)+1)
+		})
+	}
+}
+
+func TestOpen_SegmentSize(t *testing.T) {
+	t.Parallel()
+	logrus.SetLevel(logrus.PanicLevel)
+
+	dir, err := ioutil.TempDir("", "store")
+
+	if err != nil {
+		assert.Fail(t, err.Error())
+		return
+	}
+
+	defer os.RemoveAll(dir)
+
+	_, err = store.Open(dir, store.WithSegmentSize(0))
+	assert.Error(t, err)
+}